@@ -41,6 +41,8 @@ type AST struct {
 	Root      []Expr
 	TypeDecls []*TypeDecl
 	Externals []*External
+	// Imports modules of stdlib imported by `import name;`, which are compiled with the program
+	Imports []*Import
 }
 
 func (a *AST) File() *locerr.Source {
@@ -86,6 +88,16 @@ type Param struct {
 	Type  Expr
 }
 
+// ReadOnly reports if record field is declared by `val`
+func (p Param) ReadOnly() bool {
+	return p.Token != nil && p.Token.Kind == token.VAL
+}
+
+// Const reports if type param is declared by `N: const`, which is substituted by int constant
+func (p Param) Const() bool {
+	return p.Token != nil && p.Token.Kind == token.CONST
+}
+
 func (p Param) Pos() locerr.Pos {
 	return p.Token.Start
 }
@@ -114,6 +126,8 @@ type FuncType struct {
 	Params   []*Param
 	TpParams []*Param
 	RetType  Expr
+	// Effects effect row declared by `with e1, e2`, which are the effects the func may perform
+	Effects []*Symbol
 }
 
 // AST node which meets Expr interface
@@ -284,7 +298,7 @@ type (
 	LetTuple struct {
 		LetToken    *token.Token
 		Symbols     []*Symbol
-		Bound, Body Expr
+		Bound, Body Expr // Body maybe nil
 		Type        Expr // Maybe nil
 	}
 
@@ -302,6 +316,119 @@ type (
 		Array, Index, Assignee Expr
 	}
 
+	RecordPut struct {
+		Record   Expr
+		Key      *VarRef
+		Assignee Expr
+	}
+
+	// AddrOf `&x` takes reference to local variable x
+	AddrOf struct {
+		AmpToken *token.Token
+		Child    Expr
+	}
+
+	// Deref `*p` reads value p refers to
+	Deref struct {
+		StarToken *token.Token
+		Child     Expr
+	}
+
+	// DerefPut `*p = v` writes value p refers to
+	DerefPut struct {
+		StarToken *token.Token
+		Ref       Expr
+		Assignee  Expr
+	}
+
+	// Propagate `r?` gives the ok value of result r, or returns its err from the enclosing function
+	Propagate struct {
+		Child         Expr
+		QuestionToken *token.Token
+	}
+
+	// Throw `throw e` raises e as exception, which unwinds to the nearest try catching type of e
+	Throw struct {
+		ThrowToken *token.Token
+		Child      Expr
+	}
+
+	// Try `try { body } catch e: T { handler }` runs handler with e bound to exception of type T thrown in body
+	Try struct {
+		TryToken  *token.Token
+		EndToken  *token.Token
+		Body      []Expr
+		Var       *Symbol
+		CatchType Expr
+		Handler   []Expr
+	}
+
+	// Handle `handle { body } with { clauses }` runs body, whose operations of the handled effect are performed by
+	// the clauses
+	Handle struct {
+		HandleToken *token.Token
+		EndToken    *token.Token
+		Body        []Expr
+		Clauses     []*OpClause
+	}
+
+	// OpClause `op(x, k) -> body` of handle. The last param is the continuation resuming the handled body
+	OpClause struct {
+		Token  *token.Token
+		Op     *Symbol
+		Params []*Symbol
+		Body   []Expr
+	}
+
+	// ForIn `for (x in src) { body }` runs body with x bound to each element of src, which is array, range or
+	// iterator
+	ForIn struct {
+		ForToken *token.Token
+		EndToken *token.Token
+		Var      *Symbol
+		Src      Expr
+		Body     []Expr
+	}
+
+	// Range `lo..hi` is the ints from lo up to hi, hi excluded. It is iterated by for in
+	Range struct {
+		Lo, Hi Expr
+	}
+
+	// Yield `yield e` gives e as the next element of the enclosing generator, which goes on after it when the next
+	// element is asked
+	Yield struct {
+		YieldToken *token.Token
+		Child      Expr
+	}
+
+	// Impl `impl trait for type { methods }` declares that type implements trait by methods of the block
+	Impl struct {
+		StartToken *token.Token
+		EndToken   *token.Token
+		Trait      *Symbol
+		Target     *Symbol
+		Methods    []*LetRec
+		Types      []*AssocType
+		Consts     []*AssocConst
+	}
+
+	// AssocType `type item` declares associated type in trait. It is bound by `type item = int` in impl block
+	AssocType struct {
+		Token *token.Token
+		Ident *Symbol
+		Type  Expr // nil in trait
+	}
+
+	// AssocConst `const n: int` declares associated constant in trait. It is defined by `const n: int = 3` in impl
+	// block
+	AssocConst struct {
+		Token *token.Token
+		Ident *Symbol
+		Type  Expr
+		Value Expr // nil in trait
+	}
+
 	RecLit struct {
 		Ref    *VarRef
 		TpArgs []Expr
@@ -321,9 +448,11 @@ type (
 		Cases      []*Case
 	}
 
+	// Case `case pattern if guard: body`. Guard is nil if case has none
 	Case struct {
 		StartToken *token.Token
 		Cond       Expr
+		Guard      Expr
 		Body       []Expr
 	}
 
@@ -331,12 +460,18 @@ type (
 		StartToken *token.Token
 		EndToken   *token.Token
 		Elems      []Expr
+		ElemType   Expr // Maybe nil
 	}
 
 	TupleType struct {
 		ElemTypes []Expr
 	}
 
+	// Bounds multiple trait bounds of type param like `T: a + b`
+	Bounds struct {
+		Refs []*VarRef
+	}
+
 	// Note: `int` has no param
 	CtorType struct {
 		StartToken *token.Token // Maybe nil
@@ -355,6 +490,8 @@ type (
 		Token *token.Token
 		Ident *Symbol
 		Type  Expr
+		// Derives names of builtin traits whose methods are synthesized for the type
+		Derives []*Symbol
 	}
 
 	External struct {
@@ -364,6 +501,13 @@ type (
 		Type       Expr
 		C          string
 	}
+
+	// Import `import name;` imports module name of stdlib
+	Import struct {
+		StartToken *token.Token
+		EndToken   *token.Token
+		Module     *Symbol
+	}
 )
 
 func (e *Unit) Pos() locerr.Pos {
@@ -610,11 +754,24 @@ func (e *Tuple) End() locerr.Pos {
 	return e.Elems[len(e.Elems)-1].End()
 }
 
+// Immutable reports if binding is declared by `val`
+func (e *Let) Immutable() bool {
+	return e.LetToken != nil && e.LetToken.Kind == token.VAL
+}
+
+// Immutable reports if binding is declared by `val`
+func (e *LetTuple) Immutable() bool {
+	return e.LetToken != nil && e.LetToken.Kind == token.VAL
+}
+
 func (e *LetTuple) Pos() locerr.Pos {
 	return e.LetToken.Start
 }
 func (e *LetTuple) End() locerr.Pos {
-	return e.Body.End()
+	if e.Body != nil {
+		return e.Body.End()
+	}
+	return e.Bound.End()
 }
 
 func (e *ArrayMake) Pos() locerr.Pos {
@@ -638,6 +795,97 @@ func (e *ArrayPut) End() locerr.Pos {
 	return e.Assignee.End()
 }
 
+func (e *RecordPut) Pos() locerr.Pos {
+	return e.Record.Pos()
+}
+func (e *RecordPut) End() locerr.Pos {
+	return e.Assignee.End()
+}
+
+func (e *AddrOf) Pos() locerr.Pos {
+	return e.AmpToken.Start
+}
+func (e *AddrOf) End() locerr.Pos {
+	return e.Child.End()
+}
+
+func (e *Deref) Pos() locerr.Pos {
+	return e.StarToken.Start
+}
+func (e *Deref) End() locerr.Pos {
+	return e.Child.End()
+}
+
+func (e *DerefPut) Pos() locerr.Pos {
+	return e.StarToken.Start
+}
+func (e *DerefPut) End() locerr.Pos {
+	return e.Assignee.End()
+}
+
+func (e *Propagate) Pos() locerr.Pos {
+	return e.Child.Pos()
+}
+func (e *Propagate) End() locerr.Pos {
+	return e.QuestionToken.End
+}
+
+func (e *Throw) Pos() locerr.Pos {
+	return e.ThrowToken.Start
+}
+func (e *Throw) End() locerr.Pos {
+	return e.Child.End()
+}
+
+func (e *Try) Pos() locerr.Pos {
+	return e.TryToken.Start
+}
+func (e *Try) End() locerr.Pos {
+	return e.EndToken.End
+}
+
+func (e *Handle) Pos() locerr.Pos {
+	return e.HandleToken.Start
+}
+func (e *Handle) End() locerr.Pos {
+	return e.EndToken.End
+}
+
+func (e *OpClause) Pos() locerr.Pos {
+	return e.Token.Start
+}
+func (e *OpClause) End() locerr.Pos {
+	return e.Body[len(e.Body)-1].End()
+}
+
+func (e *ForIn) Pos() locerr.Pos {
+	return e.ForToken.Start
+}
+func (e *ForIn) End() locerr.Pos {
+	return e.EndToken.End
+}
+
+func (e *Range) Pos() locerr.Pos {
+	return e.Lo.Pos()
+}
+func (e *Range) End() locerr.Pos {
+	return e.Hi.End()
+}
+
+func (e *Yield) Pos() locerr.Pos {
+	return e.YieldToken.Start
+}
+func (e *Yield) End() locerr.Pos {
+	return e.Child.End()
+}
+
+func (e *Impl) Pos() locerr.Pos {
+	return e.StartToken.Start
+}
+func (e *Impl) End() locerr.Pos {
+	return e.EndToken.End
+}
+
 func (e *RecLit) Pos() locerr.Pos {
 	return e.Ref.Pos()
 }
@@ -647,6 +895,26 @@ func (e *RecLit) End() locerr.Pos {
 	return last.Type.End()
 }
 
+func (e *AssocType) Pos() locerr.Pos {
+	return e.Token.Start
+}
+func (e *AssocType) End() locerr.Pos {
+	if e.Type == nil {
+		return e.Token.End
+	}
+	return e.Type.End()
+}
+
+func (e *AssocConst) Pos() locerr.Pos {
+	return e.Token.Start
+}
+func (e *AssocConst) End() locerr.Pos {
+	if e.Value == nil {
+		return e.Type.End()
+	}
+	return e.Value.End()
+}
+
 func (e *DotAcs) Pos() locerr.Pos {
 	return e.Expr.Pos()
 }
@@ -683,6 +951,13 @@ func (e *TupleType) End() locerr.Pos {
 	return e.ElemTypes[len(e.ElemTypes)-1].End()
 }
 
+func (e *Bounds) Pos() locerr.Pos {
+	return e.Refs[0].Pos()
+}
+func (e *Bounds) End() locerr.Pos {
+	return e.Refs[len(e.Refs)-1].End()
+}
+
 func (e *CtorType) Pos() locerr.Pos {
 	switch len(e.ParamTypes) {
 	case 0:
@@ -728,6 +1003,13 @@ func (e *External) End() locerr.Pos {
 	return e.EndToken.End
 }
 
+func (e *Import) Pos() locerr.Pos {
+	return e.StartToken.Start
+}
+func (e *Import) End() locerr.Pos {
+	return e.EndToken.End
+}
+
 func (e *Unit) Name() string      { return "Unit" }
 func (e *Bool) Name() string      { return "Bool" }
 func (e *Int) Name() string       { return "Int" }
@@ -779,12 +1061,28 @@ func (e *ArrayMake) Name() string    { return "ArrayCreate" }
 func (e *ArraySize) Name() string    { return "ArraySize" }
 func (e *ApplyBracket) Name() string { return "ApplyBracket" }
 func (e *ArrayPut) Name() string     { return "ArrayPut" }
+func (e *RecordPut) Name() string    { return "RecordPut" }
+func (e *AddrOf) Name() string       { return "AddrOf" }
+func (e *Deref) Name() string        { return "Deref" }
+func (e *DerefPut) Name() string     { return "DerefPut" }
+func (e *Propagate) Name() string    { return "Propagate" }
+func (e *Throw) Name() string        { return "Throw" }
+func (e *Try) Name() string          { return fmt.Sprintf("Try (catch %s)", e.Var.Name) }
+func (e *Handle) Name() string       { return fmt.Sprintf("Handle (%d)", len(e.Clauses)) }
+func (e *OpClause) Name() string     { return fmt.Sprintf("OpClause (%s)", e.Op.Name) }
+func (e *ForIn) Name() string        { return fmt.Sprintf("ForIn (%s)", e.Var.Name) }
+func (e *Range) Name() string        { return "Range" }
+func (e *Yield) Name() string        { return "Yield" }
+func (e *Impl) Name() string         { return fmt.Sprintf("Impl (%s for %s)", e.Trait.Name, e.Target.Name) }
+func (e *AssocType) Name() string    { return fmt.Sprintf("AssocType (%s)", e.Ident.Name) }
+func (e *AssocConst) Name() string   { return fmt.Sprintf("AssocConst (%s)", e.Ident.Name) }
 func (e *RecLit) Name() string       { return "RecLit" }
 func (e *DotAcs) Name() string       { return "DotAcs" }
 func (e *Match) Name() string        { return fmt.Sprintf("Match (%s)", e.Target.Name()) }
 func (e *Case) Name() string         { return fmt.Sprintf("Case (%s)", e.Cond.Name()) }
 func (e *ArrayLit) Name() string     { return fmt.Sprintf("ArrayLit (%d)", len(e.Elems)) }
 func (e *TupleType) Name() string    { return fmt.Sprintf("TupleType (%d)", len(e.ElemTypes)) }
+func (e *Bounds) Name() string       { return fmt.Sprintf("Bounds (%d)", len(e.Refs)) }
 func (e *CtorType) Name() string {
 	len := len(e.ParamTypes)
 	if len == 0 {
@@ -796,3 +1094,4 @@ func (e *FuncType) Name() string { return "FuncType" }
 func (e *Typed) Name() string    { return "Typed" }
 func (e *TypeDecl) Name() string { return fmt.Sprintf("TypeDecl (%s)", e.Ident.Name) }
 func (e *External) Name() string { return fmt.Sprintf("External (%s => %s)", e.Ident.Name, e.C) }
+func (e *Import) Name() string   { return fmt.Sprintf("Import (%s)", e.Module.Name) }
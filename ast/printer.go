@@ -32,6 +32,9 @@ func Fprint(out io.Writer, a *AST) {
 	for _, e := range a.Externals {
 		Visit(p, e)
 	}
+	for _, i := range a.Imports {
+		Visit(p, i)
+	}
 	Visits(p, a.Root...)
 }
 
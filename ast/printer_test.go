@@ -99,6 +99,7 @@ func TestPrintAST(t *testing.T) {
 								&Int{tok, 200},
 								&Int{tok, 300},
 							},
+							nil,
 						},
 						&Int{tok, 1},
 						&Bool{tok, true},
@@ -246,6 +247,7 @@ func TestPrintAST(t *testing.T) {
 					nil,
 					NewSymbol("bool"),
 				},
+				nil,
 			},
 		},
 		Externals: []*External{
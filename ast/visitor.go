@@ -120,7 +120,9 @@ func Visit(vis Visitor, e Expr) {
 			Visit(v, n.Type)
 		}
 		Visit(v, n.Bound)
-		Visit(v, n.Body)
+		if n.Body != nil {
+			Visit(v, n.Body)
+		}
 	case *ArrayMake:
 		Visit(v, n.Size)
 		Visit(v, n.Elem)
@@ -135,11 +137,69 @@ func Visit(vis Visitor, e Expr) {
 		Visit(v, n.Array)
 		Visit(v, n.Index)
 		Visit(v, n.Assignee)
+	case *RecordPut:
+		Visit(v, n.Record)
+		Visit(v, n.Assignee)
+	case *AddrOf:
+		Visit(v, n.Child)
+	case *Deref:
+		Visit(v, n.Child)
+	case *DerefPut:
+		Visit(v, n.Ref)
+		Visit(v, n.Assignee)
+	case *Propagate:
+		Visit(v, n.Child)
+	case *Throw:
+		Visit(v, n.Child)
+	case *Try:
+		Visits(v, n.Body...)
+		Visit(v, n.CatchType)
+		Visits(v, n.Handler...)
+	case *Handle:
+		Visits(v, n.Body...)
+		for _, c := range n.Clauses {
+			Visit(v, c)
+		}
+	case *OpClause:
+		Visits(v, n.Body...)
+	case *ForIn:
+		Visit(v, n.Src)
+		Visits(v, n.Body...)
+	case *Range:
+		Visit(v, n.Lo)
+		Visit(v, n.Hi)
+	case *Yield:
+		Visit(v, n.Child)
+	case *Impl:
+		for _, t := range n.Types {
+			Visit(v, t)
+		}
+		for _, c := range n.Consts {
+			Visit(v, c)
+		}
+		for _, m := range n.Methods {
+			Visit(v, m)
+		}
+	case *AssocType:
+		if n.Type != nil {
+			Visit(v, n.Type)
+		}
+	case *AssocConst:
+		Visit(v, n.Type)
+		if n.Value != nil {
+			Visit(v, n.Value)
+		}
 	case *Match:
 		Visit(v, n.Target)
 		for _, c := range n.Cases {
 			Visit(v, c)
 		}
+	case *Case:
+		Visit(v, n.Cond)
+		if n.Guard != nil {
+			Visit(v, n.Guard)
+		}
+		Visits(v, n.Body...)
 	case *ArrayLit:
 		for _, e := range n.Elems {
 			Visit(v, e)
@@ -148,6 +208,10 @@ func Visit(vis Visitor, e Expr) {
 		for _, e := range n.ElemTypes {
 			Visit(v, e)
 		}
+	case *Bounds:
+		for _, e := range n.Refs {
+			Visit(v, e)
+		}
 	case *CtorType:
 		for _, e := range n.ParamTypes {
 			Visit(v, e)
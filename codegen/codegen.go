@@ -32,9 +32,17 @@ type phiContext struct {
 }
 
 type buildContext struct {
-	curBlk     *ir.Block
-	blkMap     map[int]llvm.BasicBlock
+	curBlk *ir.Block
+	blkMap map[int]llvm.BasicBlock
+	// tailMap maps block to the llvm block it ends in, if it is split by invoke
+	tailMap    map[int]llvm.BasicBlock
 	phiPending []phiContext
+	// landings maps catch block to landing pad of its try
+	landings map[int]llvm.BasicBlock
+	// exceptions maps catch block to the exception caught by its landing pad
+	exceptions map[int]llvm.Value
+	// thrown blocks ending by throw, which do not branch to their dest
+	thrown map[int]bool
 }
 
 type blockBuilder struct {
@@ -42,7 +50,9 @@ type blockBuilder struct {
 	env       *types.Env
 	builder   llvm.Builder
 	registers map[string]llvm.Value
-	buildCtx  *buildContext
+	// slots maps stack slot ident to its alloca
+	slots    map[string]llvm.Value
+	buildCtx *buildContext
 }
 
 type ExtGlobal struct {
@@ -58,6 +68,10 @@ var context = llvm.GlobalContext()
 var rootModule = llvm.NewModule("root")
 var rootFuncPassMgr = llvm.NewFunctionPassManagerForModule(rootModule)
 var globalTable = map[string]llvm.Value{}
+
+// namedStructs caches struct types of recursive records. Such struct is created opaque and named, then its body is
+// filled, so that a member referring back to the record meets the struct under construction.
+var namedStructs = map[string]llvm.Type{}
 var targetData llvm.TargetData
 
 var (
@@ -97,6 +111,7 @@ func Reset() {
 	intT = context.Int32Type()
 	floatT = context.FloatType()
 	voidPtrT = llvm.PointerType(llvm.Int8Type(), 0)
+	namedStructs = map[string]llvm.Type{}
 }
 
 func BuildFunc(fn *ir.Func, debug bool, globals ...*ExtGlobal) llvm.Value {
@@ -108,7 +123,13 @@ func BuildFunc(fn *ir.Func, debug bool, globals ...*ExtGlobal) llvm.Value {
 }
 
 func BuildModule(mod *ir.Module, debug bool) llvm.Value {
-	for _, fn := range mod.Funcs {
+	funcs := append(append([]*ir.Func{}, mod.Libs...), mod.Funcs...)
+	// declare all funcs ahead, so that a func can call or box methods built after it
+	for _, fn := range funcs {
+		builder := newBlockBuilder(&types.Env{Defs: fn.Defs}, debug)
+		builder.declareFunc(fn.Body.Name, fn)
+	}
+	for _, fn := range funcs {
 		builder := newBlockBuilder(&types.Env{Defs: fn.Defs}, debug)
 		builder.buildFunc(fn.Body.Name, fn)
 	}
@@ -156,6 +177,7 @@ func RunJit(val llvm.Value, globals []*ExtGlobal, args ...llvm.GenericValue) llv
 	for _, global := range globals {
 		execEngine.AddGlobalMapping(global.Reg, global.Data)
 	}
+	mapRuntime(execEngine)
 
 	return execEngine.RunFunction(val, args)
 }
@@ -166,8 +188,13 @@ func newBlockBuilder(env *types.Env, debug bool) *blockBuilder {
 		env:       env,
 		builder:   context.NewBuilder(),
 		registers: map[string]llvm.Value{},
+		slots:     map[string]llvm.Value{},
 		buildCtx: &buildContext{
-			blkMap: make(map[int]llvm.BasicBlock),
+			blkMap:     make(map[int]llvm.BasicBlock),
+			tailMap:    make(map[int]llvm.BasicBlock),
+			landings:   make(map[int]llvm.BasicBlock),
+			exceptions: make(map[int]llvm.Value),
+			thrown:     make(map[int]bool),
 		},
 	}
 }
@@ -219,6 +246,11 @@ func (b *blockBuilder) finalizePhi() {
 		var edgeVars []llvm.Value
 		var edgeBlks []llvm.BasicBlock
 		for i, edge := range phi.ins.Edges {
+			src := phi.blk.Src[i]
+			if b.buildCtx.thrown[src.Id] {
+				// block ending by throw is not a predecessor
+				continue
+			}
 			if ir.IsDangle(edge) {
 				switch phi.ins.Type().Code() {
 				case types.TpBool:
@@ -231,17 +263,27 @@ func (b *blockBuilder) finalizePhi() {
 			} else {
 				edgeVars = append(edgeVars, b.registers[edge])
 			}
-			src := phi.blk.Src[i]
-			edgeBlks = append(edgeBlks, b.buildCtx.blkMap[src.Id])
+			if tail, ok := b.buildCtx.tailMap[src.Id]; ok {
+				edgeBlks = append(edgeBlks, tail)
+			} else {
+				edgeBlks = append(edgeBlks, b.buildCtx.blkMap[src.Id])
+			}
 		}
 		phi.v.AddIncoming(edgeVars, edgeBlks)
 	}
 }
 
+// declareFunc adds prototype of f to module if it is not declared yet
+func (b *blockBuilder) declareFunc(name string, f *ir.Func) llvm.Value {
+	if fn := rootModule.NamedFunction(name); !fn.IsNil() {
+		return fn
+	}
+	funcType := b.buildFuncType(f.Type().(*types.Func), true)
+	return llvm.AddFunction(rootModule, name, funcType)
+}
+
 func (b *blockBuilder) buildFunc(name string, f *ir.Func) llvm.Value {
-	tpDef := f.Type()
-	funcType := b.buildFuncType(tpDef.(*types.Func), true)
-	theFunction := llvm.AddFunction(rootModule, name, funcType)
+	theFunction := b.declareFunc(name, f)
 
 	if theFunction.IsNil() {
 		panic("theFunction.IsNil")
@@ -256,6 +298,7 @@ func (b *blockBuilder) buildFunc(name string, f *ir.Func) llvm.Value {
 		args[i].SetName(paramName)
 		b.registers[paramName] = args[i]
 	}
+	b.allocSlots(f.Body)
 
 	b.buildBlock(f.Body)
 	b.finalizePhi()
@@ -274,6 +317,29 @@ func (b *blockBuilder) buildFunc(name string, f *ir.Func) llvm.Value {
 	return theFunction
 }
 
+// allocSlots allocates stack slots of the func in entry block, so that a slot is allocated once even if it is
+// written in loop
+func (b *blockBuilder) allocSlots(root *ir.Block) {
+	visited := map[int]bool{root.Id: true}
+	stack := []*ir.Block{root}
+	for len(stack) > 0 {
+		top := stack[0]
+		stack = stack[1:]
+		for _, ins := range top.Ins {
+			if _, ok := b.slots[ins.Ident]; ok || !ir.IsSlot(ins.Ident) {
+				continue
+			}
+			b.slots[ins.Ident] = b.builder.CreateAlloca(b.buildTypePtr(b.typeOf(ins.Ident)), ins.Ident)
+		}
+		for _, d := range top.Dest {
+			if !visited[d.Id] {
+				visited[d.Id] = true
+				stack = append(stack, d)
+			}
+		}
+	}
+}
+
 func (b *blockBuilder) buildRet(ident string, v *ir.Ret) llvm.Value {
 	if v.Target == "" {
 		return b.builder.CreateRetVoid()
@@ -289,7 +355,7 @@ func (b *blockBuilder) buildRet(ident string, v *ir.Ret) llvm.Value {
 
 func (b *blockBuilder) buildArrLit(ident string, al *ir.ArrLit) llvm.Value {
 	t := b.env.GetDefTrusted(ident)
-	elemTy := b.buildType(t.(*types.Arr).Ele)
+	elemTy := b.buildType(t)
 	sizeVal := llvm.ConstInt(intT, uint64(len(al.Args)), false /*signed*/)
 	alloca := b.builder.CreateArrayAlloca(elemTy, sizeVal, ident)
 
@@ -319,7 +385,7 @@ func (b *blockBuilder) buildArrPut(ident string, ap *ir.ArrPut) llvm.Value {
 func (b *blockBuilder) buildRecLit(ident string, rl *ir.RecLit) llvm.Value {
 	t := b.env.GetDefTrusted(ident)
 	tp := b.buildType(t)
-	alloca := b.builder.CreateAlloca(tp, ident)
+	alloca := b.buildAlloc(t, tp, ident)
 
 	for i, elem := range rl.Args {
 		elemVal := b.resolve(elem)
@@ -328,11 +394,27 @@ func (b *blockBuilder) buildRecLit(ident string, rl *ir.RecLit) llvm.Value {
 	return alloca
 }
 
+// buildAlloc allocates value of record or enum t. Value of recursive type is allocated on heap, as it may be linked
+// by values outliving the current frame, and so is generator frame.
+func (b *blockBuilder) buildAlloc(t types.ValType, tp llvm.Type, ident string) llvm.Value {
+	if rec, ok := t.(*types.Rec); ok && rec.Frame || types.Recursive(t) {
+		return b.builder.CreateMalloc(tp, ident)
+	}
+	return b.builder.CreateAlloca(tp, ident)
+}
+
 func (b *blockBuilder) buildRecAcs(ident string, ra *ir.RecAcs) llvm.Value {
 	recVal := b.resolve(ra.Target)
 	return b.buildRecLoad(recVal, ra.Idx)
 }
 
+func (b *blockBuilder) buildRecPut(ident string, rp *ir.RecPut) llvm.Value {
+	recVal := b.resolve(rp.Target)
+	rightVal := b.resolve(rp.Right)
+	ptr := b.builder.CreateStructGEP(recVal, rp.Idx, "")
+	return b.builder.CreateStore(rightVal, ptr)
+}
+
 func (b *blockBuilder) buildRecStore(recVal, elemVal llvm.Value, idx int) {
 	ptr := b.builder.CreateStructGEP(recVal, idx, "rec")
 	b.builder.CreateStore(elemVal, ptr)
@@ -350,7 +432,7 @@ func (b *blockBuilder) buildEnumVar(ident string, ev *ir.EnumVar) llvm.Value {
 
 	tp := b.buildType(semantics.EnumBox)
 	idxVal := llvm.ConstInt(intT, uint64(ev.Idx), false)
-	alloca := b.builder.CreateAlloca(tp, ident)
+	alloca := b.buildAlloc(ev.Tp, tp, ident)
 	b.buildRecStore(alloca, idxVal, 0)
 	if ev.Box != "" {
 		elemVal := b.resolve(ev.Box)
@@ -371,6 +453,10 @@ func (b *blockBuilder) buildDiscriminant(ident string, dc *ir.Discriminant) llvm
 func (b *blockBuilder) buildBox(ident string, bx *ir.Box) llvm.Value {
 	v := b.resolve(bx.Target)
 	tp, boxTp := bx.Tp, bx.BoxTp
+	if bx.Heap {
+		// value on stack is copied to heap, as it outlives the frame of caller
+		v = b.buildClone(v, tp)
+	}
 	if boxTp.Code() == types.TpVar {
 		return b.boxWhole(v, tp)
 	}
@@ -494,6 +580,12 @@ func (b *blockBuilder) buildBoxTrait(ident string, tb *ir.BoxTrait) llvm.Value {
 }
 
 func (b *blockBuilder) boxTrait(ident string, tt *types.Trait, target llvm.Value, targetTp types.ValType) llvm.Value {
+	if tv, ok := targetTp.(*types.TypeVar); ok && tv.Lower != nil {
+		targetTp = tv.Lower
+	}
+	if src, ok := targetTp.(*types.Trait); ok {
+		return b.upcastTrait(ident, tt, target, src)
+	}
 	imp := targetTp.Impls()
 
 	tp := b.buildType(tt)
@@ -521,6 +613,25 @@ func (b *blockBuilder) boxTrait(ident string, tt *types.Trait, target llvm.Value
 	return alloca
 }
 
+// upcastTrait boxes trait value target of src as tt, which src inherits. The data part is shared, and vtable of tt is
+// sliced from the one of src by func keys
+func (b *blockBuilder) upcastTrait(ident string, tt *types.Trait, target llvm.Value, src *types.Trait) llvm.Value {
+	alloca := b.builder.CreateAlloca(b.buildType(tt), ident)
+	srcFns := b.builder.CreateStructGEP(target, 1, "")
+	fnPart := b.builder.CreateStructGEP(alloca, 1, "rec")
+	for i, k := range tt.Keys {
+		j := src.KeyIndex(k)
+		if j < 0 {
+			panic("unreachable. upcast fn not found: " + k)
+		}
+		fnptr := b.buildRecLoad(fnPart, i)
+		f := b.builder.CreatePointerCast(b.buildRecLoad(srcFns, j), fnptr.Type(), "fncast")
+		b.buildRecStore(fnPart, f, i)
+	}
+	b.buildRecStore(alloca, b.buildRecLoad(target, 0), 0)
+	return alloca
+}
+
 func (b *blockBuilder) buildCall(c *ir.StaticCall) llvm.Value {
 	args := make([]llvm.Value, len(c.Args))
 	for i, arg := range c.Args {
@@ -529,10 +640,14 @@ func (b *blockBuilder) buildCall(c *ir.StaticCall) llvm.Value {
 	}
 
 	f := rootModule.NamedFunction(c.Name)
+	if _, ok := stdlibFuncType(c.Name); ok && f.C == nil {
+		// runtime func called by stdlib module is declared on first call
+		f = runtimeFunc(c.Name)
+	}
 	if f.C == nil {
 		panic("function " + c.Name + " not found in llvm module")
 	}
-	ret := b.builder.CreateCall(f, args, "")
+	ret := b.buildCallSite(f, args, "", c.Unwind)
 	return ret
 }
 
@@ -556,13 +671,22 @@ func (b *blockBuilder) buildTraitCall(c *ir.TraitCall) llvm.Value {
 
 	fns := b.builder.CreateStructGEP(target, 1, "")
 	fn := b.buildRecLoad(fns, fnIdx)
+	traitFn := c.Trait.Fns[fnIdx]
 	for i, arg := range args {
-		if i == 0 {
-			// load data part of index 0
+		if i == 0 || types.IsSelf(c.Trait, traitFn.Params[i]) {
+			// load data part of index 0, and of Self args which are boxed from the same type var as receiver
 			args[i] = b.buildRecLoad(arg, 0)
 		}
 	}
-	return b.builder.CreateCall(fn, args, "trait call")
+	ret := b.buildCallSite(fn, args, "trait call", c.Unwind)
+	if types.IsSelf(c.Trait, traitFn.Ret) {
+		// box returned Self with the receiver's impls
+		boxed := b.builder.CreateAlloca(b.buildType(c.Trait), "")
+		b.buildRecStore(boxed, ret, 0)
+		b.buildRecStore(boxed, b.buildRecLoad(target, 1), 1)
+		return boxed
+	}
+	return ret
 }
 
 func (b *blockBuilder) buildPhi(it *ir.Phi) llvm.Value {
@@ -611,9 +735,15 @@ func (b *blockBuilder) buildTypePtr(tp types.ValType) llvm.Type {
 	if tp.Code() == types.TpRec || tp.Code() == types.TpArr || tp.Code() == types.TpTrait {
 		return llvm.PointerType(b.buildType(tp), 0)
 	}
+	if t, ok := tp.(*types.Enum); ok && !t.Simple {
+		return llvm.PointerType(b.buildType(tp), 0)
+	}
 	if t, ok := tp.(*types.TypeVar); ok && t.Lower != nil {
 		return b.buildTypePtr(t.Lower)
 	}
+	if tp.Code() == types.TpFix {
+		return b.buildTypePtr(b.unfold(tp))
+	}
 	return b.buildType(tp)
 }
 
@@ -637,22 +767,28 @@ func (b *blockBuilder) buildType(tp types.ValType) llvm.Type {
 		}
 		return voidPtrT
 	case types.TpArr:
-		arrTp := tp.(*types.Arr)
-		return context.StructType([]llvm.Type{
-			llvm.PointerType(b.buildType(arrTp.Ele), 0),
-			intT,
-		}, false)
+		// array value is a pointer to its first element, like a record value is a pointer to its struct. Thus array
+		// type here is the element slot type, aggregate element (record, trait, enum, nested array) occupies a pointer.
+		return b.buildTypePtr(tp.(*types.Arr).Ele)
 	case types.TpRec:
 		recTp := tp.(*types.Rec)
+		if types.Recursive(recTp) {
+			return b.buildNamedStruct(recTp)
+		}
 		tps := []llvm.Type{}
 		for _, tp := range recTp.MemTps {
-			memTp := b.buildType(tp)
-			if tp.Code() == types.TpRec || tp.Code() == types.TpTrait || (tp.Code() == types.TpVar && tp.(*types.TypeVar).Lower != nil) {
-				memTp = llvm.PointerType(memTp, 0)
-			}
-			tps = append(tps, memTp)
+			tps = append(tps, b.buildTypePtr(tp))
 		}
 		return context.StructType(tps, false)
+	case types.TpFix:
+		return b.buildType(b.unfold(tp))
+	case types.TpRef:
+		return llvm.PointerType(b.buildTypePtr(tp.(*types.Ref).Ele), 0)
+	case types.TpEnum:
+		if tp.(*types.Enum).Simple {
+			return intT
+		}
+		return b.buildType(semantics.EnumBox)
 	case types.TpFunc:
 		return b.buildFuncType(tp.(*types.Func), false)
 	case types.TpTrait:
@@ -663,6 +799,31 @@ func (b *blockBuilder) buildType(tp types.ValType) llvm.Type {
 	}
 }
 
+// buildNamedStruct builds struct type of recursive record. The struct is registered before its members are built,
+// thus the record reached again by Fix member is the same struct rather than an endless nesting.
+func (b *blockBuilder) buildNamedStruct(recTp *types.Rec) llvm.Type {
+	name := recTp.String()
+	if st, ok := namedStructs[name]; ok {
+		return st
+	}
+	st := context.StructCreateNamed(name)
+	namedStructs[name] = st
+	tps := []llvm.Type{}
+	for _, tp := range recTp.MemTps {
+		tps = append(tps, b.buildTypePtr(tp))
+	}
+	st.StructSetBody(tps, false)
+	return st
+}
+
+func (b *blockBuilder) unfold(tp types.ValType) types.ValType {
+	t, err := types.Unfold(tp)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
 func (b *blockBuilder) typeOf(ident string) types.ValType {
 	if t, ok := b.env.Defs[ident]; ok {
 		return t
@@ -671,7 +832,15 @@ func (b *blockBuilder) typeOf(ident string) types.ValType {
 }
 
 func (b *blockBuilder) buildFuncType(tp *types.Func, expandTrait bool) llvm.Type {
-	params := make([]llvm.Type, len(tp.Params))
+	var params []llvm.Type
+	// const type params are passed as leading int params
+	for _, tpVar := range tp.TpVars {
+		if tpVar.Const {
+			params = append(params, intT)
+		}
+	}
+	offset := len(params)
+	params = append(params, make([]llvm.Type, len(tp.Params))...)
 	for i, param := range tp.Params {
 		// if param is trait type and expandTrait is false, then give llvm void* type.
 		// there is a paradox if expandTrait set to true for trait function:
@@ -685,9 +854,9 @@ func (b *blockBuilder) buildFuncType(tp *types.Func, expandTrait bool) llvm.Type
 		// Thus `expandTrait` is introduced to disable build trait func's first param, which disable infinite trait type building
 		// process.
 		if param.Code() == types.TpTrait && !expandTrait {
-			params[i] = voidPtrT
+			params[offset+i] = voidPtrT
 		} else {
-			params[i] = b.buildTypePtr(param)
+			params[offset+i] = b.buildTypePtr(param)
 		}
 	}
 	retTp := b.buildTypePtr(tp.Ret)
@@ -697,6 +866,10 @@ func (b *blockBuilder) buildFuncType(tp *types.Func, expandTrait bool) llvm.Type
 func (b *blockBuilder) buildTraitType(tp *types.Trait) llvm.Type {
 	var fnTps []llvm.Type
 	for _, traitFn := range tp.Fns {
+		if types.IsSelf(tp, traitFn.Ret) {
+			// Self is returned unboxed as the data part, same as Self param. see buildTraitCall
+			traitFn = &types.Func{Params: traitFn.Params, Ret: types.VoidP}
+		}
 		fnTp := b.buildFuncType(traitFn, false)
 		fnTps = append(fnTps, llvm.PointerType(fnTp, 0))
 	}
@@ -711,6 +884,9 @@ func (b *blockBuilder) resolve(ident string) llvm.Value {
 	if reg, ok := globalTable[ident]; ok {
 		return reg
 	}
+	if slot, ok := b.slots[ident]; ok {
+		return b.builder.CreateLoad(slot, "")
+	}
 	if reg, ok := b.registers[ident]; ok {
 		return reg
 	}
@@ -723,9 +899,17 @@ func (b *blockBuilder) buildBlock(block *ir.Block) llvm.Value {
 	var v llvm.Value
 	for _, i := range block.Ins {
 		v = b.buildInsn(i)
+		if _, ok := i.Val.(*ir.Throw); ok {
+			// rest of block is dead
+			b.buildCtx.thrown[block.Id] = true
+			return v
+		}
 	}
 	last := block.Ins[len(block.Ins)-1]
-	if _, ok := last.Val.(*ir.If); !ok && len(block.Dest) > 0 {
+	if ir.Branches(last.Val) == nil && len(block.Dest) > 0 {
+		if tail := b.builder.GetInsertBlock(); tail != b.buildCtx.blkMap[block.Id] {
+			b.buildCtx.tailMap[block.Id] = tail
+		}
 		dest := block.Dest[0]
 		destBlk, visited := b.buildCtx.blkMap[dest.Id]
 		if !visited {
@@ -767,6 +951,15 @@ func (b *blockBuilder) buildVal(ident string, v ir.Val) llvm.Value {
 				panic(err)
 			}
 			return llvm.ConstFloat(floatT, fval)
+		case types.Bool:
+			bval, err := strconv.ParseBool(string(expr.Raw()))
+			if err != nil {
+				panic(err)
+			}
+			if bval {
+				return llvm.ConstInt(boolT, 1, false)
+			}
+			return llvm.ConstNull(boolT)
 		default:
 			panic("unsupported")
 		}
@@ -813,6 +1006,17 @@ func (b *blockBuilder) buildVal(ident string, v ir.Val) llvm.Value {
 			case types.Float:
 				return b.builder.CreateFCmp(llvm.FloatOEQ, regs[0], regs[1], "==")
 			}
+		case ir.NEQ:
+			argTp := b.typeOf(expr.Args[0])
+			if argTp.Code() == types.TpEnum && argTp.(*types.Enum).Simple {
+				return b.builder.CreateICmp(llvm.IntNE, regs[0], regs[1], "!=")
+			}
+			switch argTp {
+			case types.Int:
+				return b.builder.CreateICmp(llvm.IntNE, regs[0], regs[1], "!=")
+			case types.Float:
+				return b.builder.CreateFCmp(llvm.FloatONE, regs[0], regs[1], "!=")
+			}
 		case ir.GT:
 			argTp := b.typeOf(expr.Args[0])
 			switch argTp {
@@ -857,6 +1061,12 @@ func (b *blockBuilder) buildVal(ident string, v ir.Val) llvm.Value {
 	case *ir.If:
 		// TODO: a = if ... then to if {}
 		return b.buildIf(ident, expr)
+	case *ir.Try:
+		return b.buildTry(expr)
+	case *ir.Throw:
+		return b.buildThrow(expr)
+	case *ir.Catch:
+		return b.buildCatch(expr)
 	case *ir.ArrLit:
 		return b.buildArrLit(ident, expr)
 	case *ir.ArrGet:
@@ -867,6 +1077,17 @@ func (b *blockBuilder) buildVal(ident string, v ir.Val) llvm.Value {
 		return b.buildRecLit(ident, expr)
 	case *ir.RecAcs:
 		return b.buildRecAcs(ident, expr)
+	case *ir.RecPut:
+		return b.buildRecPut(ident, expr)
+	case *ir.StructCmp:
+		return b.buildStructCmp(ident, expr)
+	case *ir.StructHash:
+		return b.buildHash(b.resolve(expr.Target), expr.Tp)
+	case *ir.StructClone:
+		return b.buildClone(b.resolve(expr.Target), expr.Tp)
+	case *ir.StructDebug:
+		b.buildDebug(b.resolve(expr.Target), expr.Tp)
+		return llvm.ConstInt(intT, 0, false)
 	case *ir.EnumVar:
 		return b.buildEnumVar(ident, expr)
 	case *ir.Discriminant:
@@ -877,6 +1098,12 @@ func (b *blockBuilder) buildVal(ident string, v ir.Val) llvm.Value {
 		return b.buildBoxTrait(ident, expr)
 	case *ir.Unbox:
 		return b.buildUnbox(ident, expr)
+	case *ir.Addr:
+		return b.slots[expr.Target]
+	case *ir.Load:
+		return b.builder.CreateLoad(b.resolve(expr.Target), "")
+	case *ir.Store:
+		return b.builder.CreateStore(b.resolve(expr.Right), b.resolve(expr.Target))
 	case *ir.Func:
 		// TODO: i.Ident应该是需要隐藏的，函数名应该放在ir.Fun里
 		// TODO 到底用ident还是expr.Body.Name
@@ -887,12 +1114,33 @@ func (b *blockBuilder) buildVal(ident string, v ir.Val) llvm.Value {
 		return b.buildTraitCall(expr)
 	case *ir.Phi:
 		return b.buildPhi(expr)
+	case *ir.Perform:
+		return b.buildPerform(expr)
+	case *ir.Handle:
+		return b.buildHandle(expr)
+	case *ir.Resume:
+		return b.buildResume(expr)
+	case *ir.Suspended:
+		return b.buildSuspended(expr)
+	case *ir.Cont:
+		return b.buildCont(expr)
+	case *ir.Send:
+		return b.buildSend(expr)
+	case *ir.Release:
+		return b.buildRelease(expr)
 	}
 	panic(fmt.Sprintf("unsupported val: %s", v.String()))
 }
 
 func (b *blockBuilder) buildInsn(insn *ir.Instr) llvm.Value {
 	v := b.buildVal(insn.Ident, insn.Val)
+	if slot, ok := b.slots[insn.Ident]; ok {
+		// if expr bound to slot is stored by its branches
+		if insn.Kind != ir.IfKind {
+			b.builder.CreateStore(v, slot)
+		}
+		return v
+	}
 	b.registers[insn.Ident] = v
 	return v
 }
@@ -0,0 +1,238 @@
+package codegen
+
+import (
+	"github.com/kingfolk/capybara/ir"
+	"github.com/kingfolk/capybara/types"
+
+	"github.com/llvm/llvm-project/bindings/go/llvm"
+)
+
+// buildStructCmp lowers structural comparison to a call of generated comparison function of the compound type.
+// Comparing compound values needs branches and loops. Generating them in a standalone function keeps llvm blocks
+// of current function one-to-one with ir blocks, which phi building relies on.
+func (b *blockBuilder) buildStructCmp(ident string, sc *ir.StructCmp) llvm.Value {
+	l := b.resolve(sc.Left)
+	r := b.resolve(sc.Right)
+	switch sc.Op {
+	case ir.EQ, ir.NEQ:
+		var eq llvm.Value
+		if sc.Len != "" {
+			eq = b.builder.CreateCall(b.eqFunc(sc.Tp), []llvm.Value{l, r, b.resolve(sc.Len)}, "==")
+		} else {
+			eq = b.buildEq(l, r, sc.Tp)
+		}
+		if sc.Op == ir.NEQ {
+			return b.builder.CreateNot(eq, "!=")
+		}
+		return eq
+	case ir.CMP:
+		return b.buildOrd(l, r, sc.Tp)
+	default:
+		ord := b.buildOrd(l, r, sc.Tp)
+		zero := llvm.ConstInt(intT, 0, false)
+		var pred llvm.IntPredicate
+		switch sc.Op {
+		case ir.LT:
+			pred = llvm.IntSLT
+		case ir.LTE:
+			pred = llvm.IntSLE
+		case ir.GT:
+			pred = llvm.IntSGT
+		case ir.GTE:
+			pred = llvm.IntSGE
+		default:
+			panic("unreachable. unsupported struct compare op: " + ir.OpKindString[sc.Op])
+		}
+		return b.builder.CreateICmp(pred, ord, zero, ir.OpKindString[sc.Op])
+	}
+}
+
+// buildEq tests equality of two values of tp. Primitive is compared in place, compound value is compared by calling
+// its generated equality function.
+func (b *blockBuilder) buildEq(l, r llvm.Value, tp types.ValType) llvm.Value {
+	switch tp.Code() {
+	case types.TpInt, types.TpBool:
+		return b.builder.CreateICmp(llvm.IntEQ, l, r, "")
+	case types.TpFloat:
+		return b.builder.CreateFCmp(llvm.FloatOEQ, l, r, "")
+	case types.TpUnit:
+		return llvm.ConstInt(boolT, 1, false)
+	case types.TpVar:
+		return b.buildEq(l, r, tp.(*types.TypeVar).Lower)
+	case types.TpEnum:
+		if tp.(*types.Enum).Simple {
+			return b.builder.CreateICmp(llvm.IntEQ, l, r, "")
+		}
+	}
+	length := llvm.ConstInt(intT, 0, false)
+	if arr, ok := tp.(*types.Arr); ok {
+		length = llvm.ConstInt(intT, uint64(arr.Size), false)
+	}
+	return b.builder.CreateCall(b.eqFunc(tp), []llvm.Value{l, r, length}, "")
+}
+
+// eqFunc gets or generates function `$eq$<type>(l, r, len): bool` testing structural equality of tp. len is only
+// used by array. Record and tuple compare member-wise, array compare element-wise, enum compare discriminant first
+// and then payload of the variant.
+func (b *blockBuilder) eqFunc(tp types.ValType) llvm.Value {
+	name := "$eq$" + tp.String()
+	if f := rootModule.NamedFunction(name); !f.IsNil() {
+		return f
+	}
+	valTp := b.buildTypePtr(tp)
+	fnTp := llvm.FunctionType(boolT, []llvm.Type{valTp, valTp, intT}, false)
+	f := llvm.AddFunction(rootModule, name, fnTp)
+
+	fb := newBlockBuilder(b.env, b.debug)
+	defer fb.builder.Dispose()
+	entry := llvm.AddBasicBlock(f, "entry")
+	same := llvm.AddBasicBlock(f, "same")
+	diff := llvm.AddBasicBlock(f, "diff")
+	fb.builder.SetInsertPointAtEnd(same)
+	fb.builder.CreateRet(llvm.ConstInt(boolT, 1, false))
+	fb.builder.SetInsertPointAtEnd(diff)
+	fb.builder.CreateRet(llvm.ConstInt(boolT, 0, false))
+
+	fb.builder.SetInsertPointAtEnd(entry)
+	l, r, length := f.Param(0), f.Param(1), f.Param(2)
+	switch t := tp.(type) {
+	case *types.Rec:
+		eq := llvm.ConstInt(boolT, 1, false)
+		for i, memTp := range t.MemTps {
+			memEq := fb.buildEq(fb.buildRecLoad(l, i), fb.buildRecLoad(r, i), memTp)
+			eq = fb.builder.CreateAnd(eq, memEq, "")
+		}
+		fb.builder.CreateRet(eq)
+	case *types.Arr:
+		loop := llvm.AddBasicBlock(f, "loop")
+		body := llvm.AddBasicBlock(f, "body")
+		fb.builder.CreateBr(loop)
+
+		fb.builder.SetInsertPointAtEnd(loop)
+		idx := fb.builder.CreatePHI(intT, "i")
+		fb.builder.CreateCondBr(fb.builder.CreateICmp(llvm.IntSLT, idx, length, ""), body, same)
+
+		fb.builder.SetInsertPointAtEnd(body)
+		le := fb.builder.CreateLoad(fb.builder.CreateInBoundsGEP(l, []llvm.Value{idx}, ""), "")
+		re := fb.builder.CreateLoad(fb.builder.CreateInBoundsGEP(r, []llvm.Value{idx}, ""), "")
+		eq := fb.buildEq(le, re, t.Ele)
+		next := fb.builder.CreateAdd(idx, llvm.ConstInt(intT, 1, false), "")
+		fb.builder.CreateCondBr(eq, loop, diff)
+		idx.AddIncoming([]llvm.Value{llvm.ConstInt(intT, 0, false), next}, []llvm.BasicBlock{entry, body})
+	case *types.Enum:
+		payload := llvm.AddBasicBlock(f, "payload")
+		ld := fb.buildRecLoad(l, 0)
+		rd := fb.buildRecLoad(r, 0)
+		fb.builder.CreateCondBr(fb.builder.CreateICmp(llvm.IntEQ, ld, rd, ""), payload, diff)
+
+		fb.builder.SetInsertPointAtEnd(payload)
+		sw := fb.builder.CreateSwitch(ld, same, len(t.Tps))
+		for i, variant := range t.Tps {
+			if variant.Code() == types.TpSym {
+				continue
+			}
+			blk := llvm.AddBasicBlock(f, t.Tokens[i])
+			sw.AddCase(llvm.ConstInt(intT, uint64(i), false), blk)
+			fb.builder.SetInsertPointAtEnd(blk)
+			lp, rp := fb.buildPayload(l, variant), fb.buildPayload(r, variant)
+			fb.builder.CreateRet(fb.buildEq(lp, rp, variant))
+		}
+	default:
+		panic("unreachable. unsupported struct equality of " + tp.String())
+	}
+	return f
+}
+
+// buildOrd gives three way comparison of two values of tp, -1 for less, 0 for equal and 1 for greater.
+func (b *blockBuilder) buildOrd(l, r llvm.Value, tp types.ValType) llvm.Value {
+	var lt, gt llvm.Value
+	switch tp.Code() {
+	case types.TpInt:
+		lt = b.builder.CreateICmp(llvm.IntSLT, l, r, "")
+		gt = b.builder.CreateICmp(llvm.IntSGT, l, r, "")
+	case types.TpFloat:
+		lt = b.builder.CreateFCmp(llvm.FloatOLT, l, r, "")
+		gt = b.builder.CreateFCmp(llvm.FloatOGT, l, r, "")
+	case types.TpVar:
+		return b.buildOrd(l, r, tp.(*types.TypeVar).Lower)
+	case types.TpEnum:
+		if !tp.(*types.Enum).Simple {
+			return b.builder.CreateCall(b.ordFunc(tp), []llvm.Value{l, r}, "")
+		}
+		lt = b.builder.CreateICmp(llvm.IntSLT, l, r, "")
+		gt = b.builder.CreateICmp(llvm.IntSGT, l, r, "")
+	default:
+		return b.builder.CreateCall(b.ordFunc(tp), []llvm.Value{l, r}, "")
+	}
+	minus := llvm.ConstInt(intT, ^uint64(0), true)
+	one := llvm.ConstInt(intT, 1, false)
+	zero := llvm.ConstInt(intT, 0, false)
+	return b.builder.CreateSelect(lt, minus, b.builder.CreateSelect(gt, one, zero, ""), "")
+}
+
+// ordFunc gets or generates function `$ord$<type>(l, r): int` ordering records and tuples lexicographically, that
+// the first unequal member decides the order. Enum is ordered by discriminant first, then by payload.
+func (b *blockBuilder) ordFunc(tp types.ValType) llvm.Value {
+	name := "$ord$" + tp.String()
+	if f := rootModule.NamedFunction(name); !f.IsNil() {
+		return f
+	}
+	valTp := b.buildTypePtr(tp)
+	fnTp := llvm.FunctionType(intT, []llvm.Type{valTp, valTp}, false)
+	f := llvm.AddFunction(rootModule, name, fnTp)
+
+	fb := newBlockBuilder(b.env, b.debug)
+	defer fb.builder.Dispose()
+	fb.builder.SetInsertPointAtEnd(llvm.AddBasicBlock(f, "entry"))
+	l, r := f.Param(0), f.Param(1)
+	zero := llvm.ConstInt(intT, 0, false)
+	switch t := tp.(type) {
+	case *types.Rec:
+		if len(t.MemTps) == 0 {
+			fb.builder.CreateRet(zero)
+			break
+		}
+		ords := make([]llvm.Value, len(t.MemTps))
+		for i, memTp := range t.MemTps {
+			ords[i] = fb.buildOrd(fb.buildRecLoad(l, i), fb.buildRecLoad(r, i), memTp)
+		}
+		res := ords[len(ords)-1]
+		for i := len(ords) - 2; i >= 0; i-- {
+			decided := fb.builder.CreateICmp(llvm.IntNE, ords[i], zero, "")
+			res = fb.builder.CreateSelect(decided, ords[i], res, "")
+		}
+		fb.builder.CreateRet(res)
+	case *types.Enum:
+		payload := llvm.AddBasicBlock(f, "payload")
+		decided := llvm.AddBasicBlock(f, "decided")
+		same := llvm.AddBasicBlock(f, "same")
+		ld := fb.buildRecLoad(l, 0)
+		dOrd := fb.buildOrd(ld, fb.buildRecLoad(r, 0), types.Int)
+		fb.builder.CreateCondBr(fb.builder.CreateICmp(llvm.IntEQ, dOrd, zero, ""), payload, decided)
+		fb.builder.SetInsertPointAtEnd(decided)
+		fb.builder.CreateRet(dOrd)
+		fb.builder.SetInsertPointAtEnd(same)
+		fb.builder.CreateRet(zero)
+
+		fb.builder.SetInsertPointAtEnd(payload)
+		sw := fb.builder.CreateSwitch(ld, same, len(t.Tps))
+		for i, variant := range t.Tps {
+			if variant.Code() == types.TpSym {
+				continue
+			}
+			blk := llvm.AddBasicBlock(f, t.Tokens[i])
+			sw.AddCase(llvm.ConstInt(intT, uint64(i), false), blk)
+			fb.builder.SetInsertPointAtEnd(blk)
+			lp, rp := fb.buildPayload(l, variant), fb.buildPayload(r, variant)
+			fb.builder.CreateRet(fb.buildOrd(lp, rp, variant))
+		}
+	default:
+		panic("unreachable. unsupported struct ordering of " + tp.String())
+	}
+	return f
+}
+
+// buildPayload loads payload of enum box v as variant
+func (b *blockBuilder) buildPayload(v llvm.Value, variant types.ValType) llvm.Value {
+	return b.builder.CreateBitCast(b.buildRecLoad(v, 1), b.buildTypePtr(variant), "")
+}
@@ -0,0 +1,297 @@
+package codegen
+
+import (
+	"github.com/kingfolk/capybara/types"
+
+	"github.com/llvm/llvm-project/bindings/go/llvm"
+)
+
+// buildHash hashes value of tp. Primitive is hashed in place, compound value is hashed by calling its generated hash
+// function.
+func (b *blockBuilder) buildHash(v llvm.Value, tp types.ValType) llvm.Value {
+	switch tp.Code() {
+	case types.TpInt:
+		return v
+	case types.TpBool:
+		return b.builder.CreateZExt(v, intT, "")
+	case types.TpFloat:
+		return b.builder.CreateBitCast(v, intT, "")
+	case types.TpUnit:
+		return llvm.ConstInt(intT, 0, false)
+	case types.TpVar:
+		return b.buildHash(v, tp.(*types.TypeVar).Lower)
+	case types.TpEnum:
+		if tp.(*types.Enum).Simple {
+			return v
+		}
+	}
+	return b.builder.CreateCall(b.hashFunc(tp), []llvm.Value{v}, "")
+}
+
+// hashFunc gets or generates function `$hash$<type>(v): int`. Hash of members is folded by `h * 31 + m`, enum
+// starts from its discriminant.
+func (b *blockBuilder) hashFunc(tp types.ValType) llvm.Value {
+	name := "$hash$" + tp.String()
+	if f := rootModule.NamedFunction(name); !f.IsNil() {
+		return f
+	}
+	fnTp := llvm.FunctionType(intT, []llvm.Type{b.buildTypePtr(tp)}, false)
+	f := llvm.AddFunction(rootModule, name, fnTp)
+
+	fb := newBlockBuilder(b.env, b.debug)
+	defer fb.builder.Dispose()
+	entry := llvm.AddBasicBlock(f, "entry")
+	fb.builder.SetInsertPointAtEnd(entry)
+	v := f.Param(0)
+	prime := llvm.ConstInt(intT, 31, false)
+	fold := func(h, m llvm.Value) llvm.Value {
+		return fb.builder.CreateAdd(fb.builder.CreateMul(h, prime, ""), m, "")
+	}
+	switch t := tp.(type) {
+	case *types.Rec:
+		h := llvm.ConstInt(intT, 0, false)
+		for i, memTp := range t.MemTps {
+			h = fold(h, fb.buildHash(fb.buildRecLoad(v, i), memTp))
+		}
+		fb.builder.CreateRet(h)
+	case *types.Arr:
+		loop := llvm.AddBasicBlock(f, "loop")
+		body := llvm.AddBasicBlock(f, "body")
+		done := llvm.AddBasicBlock(f, "done")
+		fb.builder.CreateBr(loop)
+
+		fb.builder.SetInsertPointAtEnd(loop)
+		idx := fb.builder.CreatePHI(intT, "i")
+		h := fb.builder.CreatePHI(intT, "h")
+		size := llvm.ConstInt(intT, uint64(t.Size), false)
+		fb.builder.CreateCondBr(fb.builder.CreateICmp(llvm.IntSLT, idx, size, ""), body, done)
+
+		fb.builder.SetInsertPointAtEnd(body)
+		ele := fb.builder.CreateLoad(fb.builder.CreateInBoundsGEP(v, []llvm.Value{idx}, ""), "")
+		nextH := fold(h, fb.buildHash(ele, t.Ele))
+		next := fb.builder.CreateAdd(idx, llvm.ConstInt(intT, 1, false), "")
+		fb.builder.CreateBr(loop)
+		zero := llvm.ConstInt(intT, 0, false)
+		idx.AddIncoming([]llvm.Value{zero, next}, []llvm.BasicBlock{entry, body})
+		h.AddIncoming([]llvm.Value{zero, nextH}, []llvm.BasicBlock{entry, body})
+
+		fb.builder.SetInsertPointAtEnd(done)
+		fb.builder.CreateRet(h)
+	case *types.Enum:
+		disc := fb.buildRecLoad(v, 0)
+		plain := llvm.AddBasicBlock(f, "plain")
+		fb.builder.SetInsertPointAtEnd(plain)
+		fb.builder.CreateRet(disc)
+
+		fb.builder.SetInsertPointAtEnd(entry)
+		sw := fb.builder.CreateSwitch(disc, plain, len(t.Tps))
+		for i, variant := range t.Tps {
+			if variant.Code() == types.TpSym {
+				continue
+			}
+			blk := llvm.AddBasicBlock(f, t.Tokens[i])
+			sw.AddCase(llvm.ConstInt(intT, uint64(i), false), blk)
+			fb.builder.SetInsertPointAtEnd(blk)
+			fb.builder.CreateRet(fold(disc, fb.buildHash(fb.buildPayload(v, variant), variant)))
+		}
+	default:
+		panic("unreachable. unsupported struct hash of " + tp.String())
+	}
+	return f
+}
+
+// buildClone deeply copies value of tp. Primitive and trait are copied as is. Compound value is copied by calling
+// its generated clone function, which allocates the copy on heap so that it outlives the cloning frame.
+func (b *blockBuilder) buildClone(v llvm.Value, tp types.ValType) llvm.Value {
+	switch tp.Code() {
+	case types.TpInt, types.TpBool, types.TpFloat, types.TpUnit, types.TpTrait, types.TpFunc:
+		return v
+	case types.TpVar:
+		return b.buildClone(v, tp.(*types.TypeVar).Lower)
+	case types.TpEnum:
+		if tp.(*types.Enum).Simple {
+			return v
+		}
+	}
+	return b.builder.CreateCall(b.cloneFunc(tp), []llvm.Value{v}, "")
+}
+
+// cloneFunc gets or generates function `$clone$<type>(v): type`
+func (b *blockBuilder) cloneFunc(tp types.ValType) llvm.Value {
+	name := "$clone$" + tp.String()
+	if f := rootModule.NamedFunction(name); !f.IsNil() {
+		return f
+	}
+	valTp := b.buildTypePtr(tp)
+	fnTp := llvm.FunctionType(valTp, []llvm.Type{valTp}, false)
+	f := llvm.AddFunction(rootModule, name, fnTp)
+
+	fb := newBlockBuilder(b.env, b.debug)
+	defer fb.builder.Dispose()
+	entry := llvm.AddBasicBlock(f, "entry")
+	fb.builder.SetInsertPointAtEnd(entry)
+	v := f.Param(0)
+	switch t := tp.(type) {
+	case *types.Rec:
+		c := fb.builder.CreateMalloc(fb.buildType(t), "clone")
+		for i, memTp := range t.MemTps {
+			fb.buildRecStore(c, fb.buildClone(fb.buildRecLoad(v, i), memTp), i)
+		}
+		fb.builder.CreateRet(c)
+	case *types.Arr:
+		size := llvm.ConstInt(intT, uint64(t.Size), false)
+		c := fb.builder.CreateArrayMalloc(fb.buildType(t), size, "clone")
+		loop := llvm.AddBasicBlock(f, "loop")
+		body := llvm.AddBasicBlock(f, "body")
+		done := llvm.AddBasicBlock(f, "done")
+		fb.builder.CreateBr(loop)
+
+		fb.builder.SetInsertPointAtEnd(loop)
+		idx := fb.builder.CreatePHI(intT, "i")
+		fb.builder.CreateCondBr(fb.builder.CreateICmp(llvm.IntSLT, idx, size, ""), body, done)
+
+		fb.builder.SetInsertPointAtEnd(body)
+		ele := fb.builder.CreateLoad(fb.builder.CreateInBoundsGEP(v, []llvm.Value{idx}, ""), "")
+		fb.builder.CreateStore(fb.buildClone(ele, t.Ele), fb.builder.CreateInBoundsGEP(c, []llvm.Value{idx}, ""))
+		next := fb.builder.CreateAdd(idx, llvm.ConstInt(intT, 1, false), "")
+		fb.builder.CreateBr(loop)
+		idx.AddIncoming([]llvm.Value{llvm.ConstInt(intT, 0, false), next}, []llvm.BasicBlock{entry, body})
+
+		fb.builder.SetInsertPointAtEnd(done)
+		fb.builder.CreateRet(c)
+	case *types.Enum:
+		c := fb.builder.CreateMalloc(fb.buildType(t), "clone")
+		disc := fb.buildRecLoad(v, 0)
+		fb.buildRecStore(c, disc, 0)
+		fb.buildRecStore(c, fb.buildRecLoad(v, 1), 1)
+		done := llvm.AddBasicBlock(f, "done")
+		fb.builder.SetInsertPointAtEnd(done)
+		fb.builder.CreateRet(c)
+
+		fb.builder.SetInsertPointAtEnd(entry)
+		sw := fb.builder.CreateSwitch(disc, done, len(t.Tps))
+		for i, variant := range t.Tps {
+			if variant.Code() == types.TpSym {
+				continue
+			}
+			blk := llvm.AddBasicBlock(f, t.Tokens[i])
+			sw.AddCase(llvm.ConstInt(intT, uint64(i), false), blk)
+			fb.builder.SetInsertPointAtEnd(blk)
+			payload := fb.buildClone(fb.buildPayload(v, variant), variant)
+			fb.buildRecStore(c, fb.builder.CreateBitCast(payload, voidPtrT, ""), 1)
+			fb.builder.CreateBr(done)
+		}
+	default:
+		panic("unreachable. unsupported struct clone of " + tp.String())
+	}
+	return f
+}
+
+// buildDebug prints value of tp to stdout in the form of its literal, e.g. `{age: 1, height: 1.5}`, `(1, 2)`,
+// `[1, 2]` and `two((1, 2))`
+func (b *blockBuilder) buildDebug(v llvm.Value, tp types.ValType) {
+	switch tp.Code() {
+	case types.TpInt:
+		b.buildPrintf("%d", v)
+	case types.TpBool:
+		b.buildPrintf("%d", b.builder.CreateZExt(v, intT, ""))
+	case types.TpFloat:
+		b.buildPrintf("%g", b.builder.CreateFPExt(v, context.DoubleType(), ""))
+	case types.TpUnit:
+		b.buildPrintf("()")
+	case types.TpVar:
+		b.buildDebug(v, tp.(*types.TypeVar).Lower)
+	case types.TpRec, types.TpArr, types.TpEnum:
+		if t, ok := tp.(*types.Enum); ok && t.Simple {
+			b.buildPrintf("%d", v)
+			return
+		}
+		b.builder.CreateCall(b.debugFunc(tp), []llvm.Value{v}, "")
+	default:
+		b.buildPrintf("<" + tp.String() + ">")
+	}
+}
+
+// debugFunc gets or generates function `$debug$<type>(v)` printing compound value
+func (b *blockBuilder) debugFunc(tp types.ValType) llvm.Value {
+	name := "$debug$" + tp.String()
+	if f := rootModule.NamedFunction(name); !f.IsNil() {
+		return f
+	}
+	fnTp := llvm.FunctionType(unitT, []llvm.Type{b.buildTypePtr(tp)}, false)
+	f := llvm.AddFunction(rootModule, name, fnTp)
+
+	fb := newBlockBuilder(b.env, b.debug)
+	defer fb.builder.Dispose()
+	entry := llvm.AddBasicBlock(f, "entry")
+	fb.builder.SetInsertPointAtEnd(entry)
+	v := f.Param(0)
+	switch t := tp.(type) {
+	case *types.Rec:
+		tuple := t.Anon || (len(t.Keys) > 0 && t.Keys[0] == "0")
+		if tuple {
+			fb.buildPrintf("(")
+		} else {
+			fb.buildPrintf("{")
+		}
+		for i, memTp := range t.MemTps {
+			if i > 0 {
+				fb.buildPrintf(", ")
+			}
+			if !tuple {
+				fb.buildPrintf(t.Keys[i] + ": ")
+			}
+			fb.buildDebug(fb.buildRecLoad(v, i), memTp)
+		}
+		if tuple {
+			fb.buildPrintf(")")
+		} else {
+			fb.buildPrintf("}")
+		}
+		fb.builder.CreateRetVoid()
+	case *types.Arr:
+		fb.buildPrintf("[")
+		for i := 0; i < t.Size; i++ {
+			if i > 0 {
+				fb.buildPrintf(", ")
+			}
+			idx := llvm.ConstInt(intT, uint64(i), false)
+			fb.buildDebug(fb.builder.CreateLoad(fb.builder.CreateInBoundsGEP(v, []llvm.Value{idx}, ""), ""), t.Ele)
+		}
+		fb.buildPrintf("]")
+		fb.builder.CreateRetVoid()
+	case *types.Enum:
+		done := llvm.AddBasicBlock(f, "done")
+		fb.builder.SetInsertPointAtEnd(done)
+		fb.builder.CreateRetVoid()
+
+		fb.builder.SetInsertPointAtEnd(entry)
+		sw := fb.builder.CreateSwitch(fb.buildRecLoad(v, 0), done, len(t.Tps))
+		for i, variant := range t.Tps {
+			blk := llvm.AddBasicBlock(f, t.Tokens[i])
+			sw.AddCase(llvm.ConstInt(intT, uint64(i), false), blk)
+			fb.builder.SetInsertPointAtEnd(blk)
+			fb.buildPrintf(t.Tokens[i])
+			if variant.Code() != types.TpSym {
+				fb.buildPrintf("(")
+				fb.buildDebug(fb.buildPayload(v, variant), variant)
+				fb.buildPrintf(")")
+			}
+			fb.builder.CreateBr(done)
+		}
+	default:
+		panic("unreachable. unsupported struct debug of " + tp.String())
+	}
+	return f
+}
+
+// buildPrintf calls libc printf, which is declared on first use
+func (b *blockBuilder) buildPrintf(format string, args ...llvm.Value) {
+	printf := rootModule.NamedFunction("printf")
+	if printf.IsNil() {
+		fnTp := llvm.FunctionType(context.Int32Type(), []llvm.Type{voidPtrT}, true)
+		printf = llvm.AddFunction(rootModule, "printf", fnTp)
+	}
+	fmt := b.builder.CreateGlobalStringPtr(format, "fmt")
+	b.builder.CreateCall(printf, append([]llvm.Value{fmt}, args...), "")
+}
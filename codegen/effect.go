@@ -0,0 +1,129 @@
+package codegen
+
+import (
+	"github.com/kingfolk/capybara/ir"
+	"github.com/kingfolk/capybara/types"
+	"github.com/llvm/llvm-project/bindings/go/llvm"
+)
+
+// boxValue boxes v of tp as void*, which is how values cross the stack of fiber. Value is copied to heap, as the
+// frame it lives in may be gone before it is read.
+func (b *blockBuilder) boxValue(v llvm.Value, tp types.ValType) llvm.Value {
+	switch tp.Code() {
+	case types.TpUnit:
+		return llvm.ConstNull(voidPtrT)
+	case types.TpBool:
+		v = b.builder.CreateZExt(v, intT, "")
+		return b.boxWhole(v, types.Int)
+	case types.TpRef:
+		return b.builder.CreateBitCast(v, voidPtrT, "")
+	}
+	return b.boxWhole(b.buildClone(v, tp), boxTpOf(tp))
+}
+
+// unboxValue is the reverse of boxValue
+func (b *blockBuilder) unboxValue(v llvm.Value, tp types.ValType) llvm.Value {
+	switch tp.Code() {
+	case types.TpUnit:
+		return llvm.ConstNull(intT)
+	case types.TpBool:
+		v = b.unboxWhole(v, types.Int)
+		return b.builder.CreateTrunc(v, boolT, "")
+	case types.TpRef:
+		return b.builder.CreateBitCast(v, b.buildType(tp), "")
+	}
+	return b.unboxWhole(v, boxTpOf(tp))
+}
+
+// buildPerform boxes args of operation into an array on stack of the performer, which lives while the operation is
+// handled
+func (b *blockBuilder) buildPerform(p *ir.Perform) llvm.Value {
+	op := p.Effect.Ops[p.Op]
+	args := llvm.ConstNull(llvm.PointerType(voidPtrT, 0))
+	if len(p.Args) > 0 {
+		size := llvm.ConstInt(intT, uint64(len(p.Args)), false)
+		args = b.builder.CreateArrayAlloca(voidPtrT, size, "args")
+		for i, arg := range p.Args {
+			ptr := b.builder.CreateInBoundsGEP(args, []llvm.Value{llvm.ConstInt(intT, uint64(i), false)}, "")
+			b.builder.CreateStore(b.boxValue(b.resolve(arg), op.Params[i]), ptr)
+		}
+	}
+	effect := llvm.ConstInt(llvm.Int64Type(), p.Effect.Uid, false)
+	idx := llvm.ConstInt(intT, uint64(p.Op), false)
+	ret := b.builder.CreateCall(runtimeFunc("cb_perform"), []llvm.Value{effect, idx, args}, "")
+	return b.unboxValue(ret, p.Tp)
+}
+
+// buildHandle creates the fiber of handle. Captured args of body are packed in env on stack of handle, which lives
+// until the fiber starts by the first resume.
+func (b *blockBuilder) buildHandle(h *ir.Handle) llvm.Value {
+	env := llvm.ConstNull(voidPtrT)
+	var envTp llvm.Type
+	if len(h.Args) > 0 {
+		vals := make([]llvm.Value, len(h.Args))
+		tps := make([]llvm.Type, len(h.Args))
+		for i, arg := range h.Args {
+			vals[i] = b.resolve(arg)
+			tps[i] = vals[i].Type()
+		}
+		envTp = context.StructType(tps, false)
+		alloca := b.builder.CreateAlloca(envTp, "env")
+		for i, v := range vals {
+			b.buildRecStore(alloca, v, i)
+		}
+		env = b.builder.CreateBitCast(alloca, voidPtrT, "")
+	}
+	effect := llvm.ConstInt(llvm.Int64Type(), h.Effect.Uid, false)
+	entry := b.fiberEntry(h, envTp)
+	return b.builder.CreateCall(runtimeFunc("cb_handle"), []llvm.Value{effect, entry, env}, "fiber")
+}
+
+// fiberEntry gets or generates function `<body>$entry(env): void*` the fiber starts by. It calls body by args packed
+// in env, and boxes what body returns
+func (b *blockBuilder) fiberEntry(h *ir.Handle, envTp llvm.Type) llvm.Value {
+	name := h.Body + "$entry"
+	if f := rootModule.NamedFunction(name); !f.IsNil() {
+		return f
+	}
+	f := llvm.AddFunction(rootModule, name, llvm.FunctionType(voidPtrT, []llvm.Type{voidPtrT}, false))
+
+	fb := newBlockBuilder(b.env, b.debug)
+	defer fb.builder.Dispose()
+	entry := llvm.AddBasicBlock(f, "entry")
+	fb.builder.SetInsertPointAtEnd(entry)
+	args := make([]llvm.Value, len(h.Args))
+	if len(h.Args) > 0 {
+		env := fb.builder.CreateBitCast(f.Param(0), llvm.PointerType(envTp, 0), "")
+		for i := range h.Args {
+			args[i] = fb.buildRecLoad(env, i)
+		}
+	}
+	ret := fb.builder.CreateCall(rootModule.NamedFunction(h.Body), args, "")
+	fb.builder.CreateRet(fb.boxValue(ret, h.Ret))
+	return f
+}
+
+func (b *blockBuilder) buildResume(r *ir.Resume) llvm.Value {
+	return b.builder.CreateCall(runtimeFunc("cb_resume"), []llvm.Value{b.resolve(r.Fiber)}, "")
+}
+
+func (b *blockBuilder) buildSuspended(s *ir.Suspended) llvm.Value {
+	idx := llvm.ConstInt(intT, uint64(s.Idx), true)
+	v := b.builder.CreateCall(runtimeFunc("cb_suspended"), []llvm.Value{b.resolve(s.Fiber), idx}, "")
+	return b.unboxValue(v, s.Tp)
+}
+
+func (b *blockBuilder) buildCont(c *ir.Cont) llvm.Value {
+	return b.builder.CreateCall(runtimeFunc("cb_cont"), []llvm.Value{b.resolve(c.Fiber)}, "")
+}
+
+func (b *blockBuilder) buildSend(s *ir.Send) llvm.Value {
+	v := b.boxValue(b.resolve(s.Value), s.Tp)
+	b.builder.CreateCall(runtimeFunc("cb_send"), []llvm.Value{b.resolve(s.Fiber), b.resolve(s.Seq), v}, "")
+	return llvm.ConstNull(intT)
+}
+
+func (b *blockBuilder) buildRelease(r *ir.Release) llvm.Value {
+	b.builder.CreateCall(runtimeFunc("cb_release"), []llvm.Value{b.resolve(r.Fiber)}, "")
+	return llvm.ConstNull(intT)
+}
@@ -0,0 +1,154 @@
+package codegen
+
+/*
+#include "runtime.h"
+*/
+import "C"
+
+import (
+	"unsafe"
+
+	"github.com/kingfolk/capybara/ir"
+	"github.com/kingfolk/capybara/types"
+	"github.com/llvm/llvm-project/bindings/go/llvm"
+)
+
+// runtimeAddrs maps funcs of C runtime to their address, which are mapped into jit module when declared
+var runtimeAddrs = map[string]unsafe.Pointer{
+	"cb_throw":             unsafe.Pointer(C.cb_throw),
+	"cb_rethrow":           unsafe.Pointer(C.cb_rethrow),
+	"cb_exception_type":    unsafe.Pointer(C.cb_exception_type),
+	"cb_exception_payload": unsafe.Pointer(C.cb_exception_payload),
+	"cb_personality":       unsafe.Pointer(C.cb_personality),
+	"cb_handle":            unsafe.Pointer(C.cb_handle),
+	"cb_perform":           unsafe.Pointer(C.cb_perform),
+	"cb_resume":            unsafe.Pointer(C.cb_resume),
+	"cb_suspended":         unsafe.Pointer(C.cb_suspended),
+	"cb_cont":              unsafe.Pointer(C.cb_cont),
+	"cb_send":              unsafe.Pointer(C.cb_send),
+	"cb_release":           unsafe.Pointer(C.cb_release),
+}
+
+// runtimeFunc gives func of C runtime, which is declared on first use
+func runtimeFunc(name string) llvm.Value {
+	if fn := rootModule.NamedFunction(name); !fn.IsNil() {
+		return fn
+	}
+	i64 := llvm.Int64Type()
+	i32 := context.Int32Type()
+	var fnTp llvm.Type
+	switch name {
+	case "cb_throw":
+		fnTp = llvm.FunctionType(unitT, []llvm.Type{i64, voidPtrT}, false)
+	case "cb_rethrow":
+		fnTp = llvm.FunctionType(unitT, []llvm.Type{voidPtrT}, false)
+	case "cb_exception_type":
+		fnTp = llvm.FunctionType(i64, []llvm.Type{voidPtrT}, false)
+	case "cb_exception_payload":
+		fnTp = llvm.FunctionType(voidPtrT, []llvm.Type{voidPtrT}, false)
+	case "cb_personality":
+		fnTp = llvm.FunctionType(i32, nil, true)
+	case "cb_handle":
+		entryTp := llvm.PointerType(llvm.FunctionType(voidPtrT, []llvm.Type{voidPtrT}, false), 0)
+		fnTp = llvm.FunctionType(voidPtrT, []llvm.Type{i64, entryTp, voidPtrT}, false)
+	case "cb_perform":
+		fnTp = llvm.FunctionType(voidPtrT, []llvm.Type{i64, i32, llvm.PointerType(voidPtrT, 0)}, false)
+	case "cb_resume", "cb_cont":
+		fnTp = llvm.FunctionType(i32, []llvm.Type{voidPtrT}, false)
+	case "cb_suspended":
+		fnTp = llvm.FunctionType(voidPtrT, []llvm.Type{voidPtrT, i32}, false)
+	case "cb_send":
+		fnTp = llvm.FunctionType(unitT, []llvm.Type{voidPtrT, i32, voidPtrT}, false)
+	case "cb_release":
+		fnTp = llvm.FunctionType(unitT, []llvm.Type{voidPtrT}, false)
+	default:
+		tp, ok := stdlibFuncType(name)
+		if !ok {
+			panic("unreachable. runtime func not found: " + name)
+		}
+		fnTp = tp
+	}
+	return llvm.AddFunction(rootModule, name, fnTp)
+}
+
+// mapRuntime maps runtime funcs declared by module to the C runtime
+func mapRuntime(execEngine llvm.ExecutionEngine) {
+	for name, addr := range runtimeAddrs {
+		if fn := rootModule.NamedFunction(name); !fn.IsNil() {
+			execEngine.AddGlobalMapping(fn, addr)
+		}
+	}
+}
+
+// buildCallSite calls fn. Call in try body is an invoke, so that exception raised by fn unwinds to the landing pad of
+// the try, and code after call continues in a new block.
+func (b *blockBuilder) buildCallSite(fn llvm.Value, args []llvm.Value, name string, unwind *ir.Block) llvm.Value {
+	if unwind == nil {
+		return b.builder.CreateCall(fn, args, name)
+	}
+	parentFunc := b.builder.GetInsertBlock().Parent()
+	cont := llvm.AddBasicBlock(parentFunc, "invoke cont")
+	ret := b.builder.CreateInvoke(fn, args, cont, b.buildCtx.landings[unwind.Id], name)
+	b.builder.SetInsertPointAtEnd(cont)
+	return ret
+}
+
+func (b *blockBuilder) buildThrow(t *ir.Throw) llvm.Value {
+	// value on stack is copied to heap, as it outlives the frames unwound
+	v := b.buildClone(b.resolve(t.Target), t.Tp)
+	payload := b.boxWhole(v, boxTpOf(t.Tp))
+	typeId := llvm.ConstInt(llvm.Int64Type(), t.TypeId, false)
+	b.buildCallSite(runtimeFunc("cb_throw"), []llvm.Value{typeId, payload}, "", t.Unwind)
+	return b.builder.CreateUnreachable()
+}
+
+// buildTry builds body, then the landing pad which every call in body unwinds to. Landing pad catches all capybara
+// exceptions, and branches to catch block if type id of exception is the one caught, otherwise rethrows it to the
+// enclosing try.
+func (b *blockBuilder) buildTry(t *ir.Try) llvm.Value {
+	parentFunc := b.builder.GetInsertBlock().Parent()
+	parentFunc.SetPersonality(runtimeFunc("cb_personality"))
+	bodyBlk := llvm.AddBasicBlock(parentFunc, "try")
+	landingBlk := llvm.AddBasicBlock(parentFunc, "landing")
+	catchBlk := llvm.AddBasicBlock(parentFunc, "catch")
+	rethrowBlk := llvm.AddBasicBlock(parentFunc, "rethrow")
+	b.builder.CreateBr(bodyBlk)
+	b.buildCtx.blkMap[t.Body.Id] = bodyBlk
+	b.buildCtx.blkMap[t.Catch.Id] = catchBlk
+	b.buildCtx.landings[t.Catch.Id] = landingBlk
+
+	b.builder.SetInsertPointAtEnd(bodyBlk)
+	b.buildBlock(t.Body)
+
+	b.builder.SetInsertPointAtEnd(landingBlk)
+	lpTp := llvm.StructType([]llvm.Type{voidPtrT, context.Int32Type()}, false)
+	lp := b.builder.CreateLandingPad(lpTp, 1, "lp")
+	lp.AddClause(llvm.ConstNull(voidPtrT))
+	ex := b.builder.CreateExtractValue(lp, 0, "ex")
+	typeId := b.builder.CreateCall(runtimeFunc("cb_exception_type"), []llvm.Value{ex}, "")
+	caught := b.builder.CreateICmp(llvm.IntEQ, typeId, llvm.ConstInt(llvm.Int64Type(), t.TypeId, false), "")
+	b.builder.CreateCondBr(caught, catchBlk, rethrowBlk)
+
+	b.builder.SetInsertPointAtEnd(rethrowBlk)
+	b.buildCallSite(runtimeFunc("cb_rethrow"), []llvm.Value{ex}, "", t.Unwind)
+	b.builder.CreateUnreachable()
+
+	b.buildCtx.exceptions[t.Catch.Id] = ex
+	b.builder.SetInsertPointAtEnd(catchBlk)
+	b.buildBlock(t.Catch)
+	return llvm.ConstNull(intT)
+}
+
+func (b *blockBuilder) buildCatch(c *ir.Catch) llvm.Value {
+	ex := b.buildCtx.exceptions[b.buildCtx.curBlk.Id]
+	payload := b.builder.CreateCall(runtimeFunc("cb_exception_payload"), []llvm.Value{ex}, "")
+	return b.unboxWhole(payload, boxTpOf(c.Tp))
+}
+
+// exceptionBoxTp gives the type exception of tp is boxed as. Simple enum is boxed as its discriminant
+func boxTpOf(tp types.ValType) types.ValType {
+	if e, ok := tp.(*types.Enum); ok && e.Simple {
+		return types.Int
+	}
+	return tp
+}
@@ -0,0 +1,335 @@
+#include <stdio.h>
+#include <stdlib.h>
+#include <sys/mman.h>
+#include <ucontext.h>
+#include <unistd.h>
+
+#include "runtime.h"
+
+// "CAPYBARA" in big endian, which tells capybara exception from foreign ones
+#define CB_EXCEPTION_CLASS 0x4341505942415241ULL
+
+#define DW_EH_PE_omit 0xff
+#define DW_EH_PE_absptr 0x00
+#define DW_EH_PE_uleb128 0x01
+#define DW_EH_PE_udata2 0x02
+#define DW_EH_PE_udata4 0x03
+#define DW_EH_PE_udata8 0x04
+#define DW_EH_PE_sleb128 0x09
+#define DW_EH_PE_sdata2 0x0a
+#define DW_EH_PE_sdata4 0x0b
+#define DW_EH_PE_sdata8 0x0c
+#define DW_EH_PE_pcrel 0x10
+#define DW_EH_PE_indirect 0x80
+
+typedef struct {
+    struct _Unwind_Exception unwind;
+    int64_t type_id;
+    void *payload;
+} cb_exception;
+
+static void cb_cleanup(_Unwind_Reason_Code reason, struct _Unwind_Exception *ue) {
+    free(ue);
+}
+
+static void cb_raise(cb_exception *e) {
+    _Unwind_RaiseException(&e->unwind);
+    // raise returns only if no frame catches the exception
+    fprintf(stderr, "uncaught exception of type id %lld\n", (long long)e->type_id);
+    abort();
+}
+
+void cb_throw(int64_t type_id, void *payload) {
+    cb_exception *e = calloc(1, sizeof(cb_exception));
+    e->unwind.exception_class = CB_EXCEPTION_CLASS;
+    e->unwind.exception_cleanup = cb_cleanup;
+    e->type_id = type_id;
+    e->payload = payload;
+    cb_raise(e);
+}
+
+// cb_rethrow raises again the exception a landing pad does not catch, which searches from the frame of landing pad
+void cb_rethrow(void *ex) {
+    cb_raise((cb_exception *)ex);
+}
+
+int64_t cb_exception_type(void *ex) {
+    return ((cb_exception *)ex)->type_id;
+}
+
+// cb_exception_payload gives the thrown value, and releases the caught exception
+void *cb_exception_payload(void *ex) {
+    cb_exception *e = (cb_exception *)ex;
+    void *payload = e->payload;
+    _Unwind_DeleteException(&e->unwind);
+    return payload;
+}
+
+static uintptr_t read_uleb128(const uint8_t **p) {
+    uintptr_t result = 0;
+    unsigned shift = 0;
+    uint8_t byte;
+    do {
+        byte = *(*p)++;
+        result |= (uintptr_t)(byte & 0x7f) << shift;
+        shift += 7;
+    } while (byte & 0x80);
+    return result;
+}
+
+static intptr_t read_sleb128(const uint8_t **p) {
+    intptr_t result = 0;
+    unsigned shift = 0;
+    uint8_t byte;
+    do {
+        byte = *(*p)++;
+        result |= (intptr_t)(byte & 0x7f) << shift;
+        shift += 7;
+    } while (byte & 0x80);
+    if (shift < 8 * sizeof(result) && (byte & 0x40)) {
+        result |= -((intptr_t)1 << shift);
+    }
+    return result;
+}
+
+static uintptr_t read_encoded(const uint8_t **p, uint8_t encoding) {
+    const uint8_t *start = *p;
+    uintptr_t result;
+    switch (encoding & 0x0f) {
+    case DW_EH_PE_absptr:
+        result = *(const uintptr_t *)*p;
+        *p += sizeof(uintptr_t);
+        break;
+    case DW_EH_PE_uleb128:
+        result = read_uleb128(p);
+        break;
+    case DW_EH_PE_sleb128:
+        result = (uintptr_t)read_sleb128(p);
+        break;
+    case DW_EH_PE_udata2:
+        result = *(const uint16_t *)*p;
+        *p += 2;
+        break;
+    case DW_EH_PE_udata4:
+        result = *(const uint32_t *)*p;
+        *p += 4;
+        break;
+    case DW_EH_PE_udata8:
+        result = (uintptr_t)*(const uint64_t *)*p;
+        *p += 8;
+        break;
+    case DW_EH_PE_sdata2:
+        result = (uintptr_t)*(const int16_t *)*p;
+        *p += 2;
+        break;
+    case DW_EH_PE_sdata4:
+        result = (uintptr_t)*(const int32_t *)*p;
+        *p += 4;
+        break;
+    case DW_EH_PE_sdata8:
+        result = (uintptr_t)*(const int64_t *)*p;
+        *p += 8;
+        break;
+    default:
+        abort();
+    }
+    if (result != 0 && (encoding & 0x70) == DW_EH_PE_pcrel) {
+        result += (uintptr_t)start;
+    }
+    if (result != 0 && (encoding & DW_EH_PE_indirect)) {
+        result = *(const uintptr_t *)result;
+    }
+    return result;
+}
+
+// cb_personality finds the landing pad of the call site raising exception. Generated code catches every capybara
+// exception by its landing pad, which compares type id then handles or rethrows it. Thus a call site having landing
+// pad with action is a handler in search phase, and any landing pad, including cleanup, is installed in cleanup phase.
+_Unwind_Reason_Code cb_personality(int version, _Unwind_Action actions, uint64_t exception_class,
+                                   struct _Unwind_Exception *ue, struct _Unwind_Context *ctx) {
+    if (version != 1) {
+        return _URC_FATAL_PHASE1_ERROR;
+    }
+    if (exception_class != CB_EXCEPTION_CLASS) {
+        return _URC_CONTINUE_UNWIND;
+    }
+    const uint8_t *lsda = (const uint8_t *)_Unwind_GetLanguageSpecificData(ctx);
+    if (lsda == NULL) {
+        return _URC_CONTINUE_UNWIND;
+    }
+    uintptr_t func = _Unwind_GetRegionStart(ctx);
+    uintptr_t ip = _Unwind_GetIP(ctx) - 1;
+
+    uint8_t lpstart_enc = *lsda++;
+    uintptr_t lpstart = func;
+    if (lpstart_enc != DW_EH_PE_omit) {
+        lpstart = read_encoded(&lsda, lpstart_enc);
+    }
+    uint8_t ttype_enc = *lsda++;
+    if (ttype_enc != DW_EH_PE_omit) {
+        read_uleb128(&lsda);
+    }
+    uint8_t cs_enc = *lsda++;
+    uintptr_t cs_len = read_uleb128(&lsda);
+    const uint8_t *cs_end = lsda + cs_len;
+    while (lsda < cs_end) {
+        uintptr_t start = read_encoded(&lsda, cs_enc);
+        uintptr_t len = read_encoded(&lsda, cs_enc);
+        uintptr_t lp = read_encoded(&lsda, cs_enc);
+        uintptr_t action = read_uleb128(&lsda);
+        // call sites are sorted by start
+        if (ip < func + start) {
+            break;
+        }
+        if (ip >= func + start + len) {
+            continue;
+        }
+        if (lp == 0) {
+            return _URC_CONTINUE_UNWIND;
+        }
+        if (actions & _UA_SEARCH_PHASE) {
+            return action != 0 ? _URC_HANDLER_FOUND : _URC_CONTINUE_UNWIND;
+        }
+        _Unwind_SetGR(ctx, __builtin_eh_return_data_regno(0), (uintptr_t)ue);
+        _Unwind_SetGR(ctx, __builtin_eh_return_data_regno(1), 1);
+        _Unwind_SetIP(ctx, lpstart + lp);
+        return _URC_INSTALL_CONTEXT;
+    }
+    return _URC_CONTINUE_UNWIND;
+}
+
+// fiber runs body of handle on its own stack. Exception does not cross the stack, that is one thrown by body and not
+// caught in it is uncaught, so the compiler rejects handle body which may throw in try. Stack is mapped with a guard
+// page below it, which overflow of body faults on instead of writing over heap.
+#define CB_FIBER_STACK (1 << 20)
+
+enum {
+    CB_FIBER_READY,     // created, not started yet
+    CB_FIBER_RUNNING,   // resumed, body or code it calls is running
+    CB_FIBER_SUSPENDED, // suspended in operation, waits for the value of it
+    CB_FIBER_SENT,      // value of operation sent, waits to be resumed
+    CB_FIBER_RETURNED,  // body returned
+};
+
+typedef struct cb_fiber {
+    int64_t effect;
+    void *(*entry)(void *);
+    void *env;
+    int state;
+    // seq counts operations the fiber suspended in, which tells a continuation from the ones of earlier operations
+    int32_t seq;
+    int32_t op;
+    void **args;
+    // value the operation returns when fiber is resumed, or the value body returned
+    void *value;
+    // parent the fiber running when this one is resumed, to which operations not handled by this one go
+    struct cb_fiber *parent;
+    // top the innermost fiber running when an operation suspends this one, which is running again on resume
+    struct cb_fiber *top;
+    ucontext_t handler;
+    ucontext_t suspended;
+    // stack the mapping of stack, led by its guard page
+    char *stack;
+    size_t guard;
+} cb_fiber;
+
+// cb_current the innermost fiber running, NULL out of any handle
+static cb_fiber *cb_current;
+
+static void cb_fiber_start(void) {
+    cb_fiber *f = cb_current;
+    f->value = f->entry(f->env);
+    f->state = CB_FIBER_RETURNED;
+    cb_current = f->parent;
+    setcontext(&f->handler);
+}
+
+void *cb_handle(int64_t effect, void *(*entry)(void *), void *env) {
+    cb_fiber *f = calloc(1, sizeof(cb_fiber));
+    f->effect = effect;
+    f->entry = entry;
+    f->env = env;
+    f->state = CB_FIBER_READY;
+    f->top = f;
+    f->guard = (size_t)sysconf(_SC_PAGESIZE);
+    f->stack = mmap(NULL, f->guard + CB_FIBER_STACK, PROT_READ | PROT_WRITE, MAP_PRIVATE | MAP_ANONYMOUS, -1, 0);
+    if (f->stack == MAP_FAILED || mprotect(f->stack, f->guard, PROT_NONE) != 0) {
+        fprintf(stderr, "cannot allocate stack of fiber\n");
+        abort();
+    }
+    getcontext(&f->suspended);
+    f->suspended.uc_stack.ss_sp = f->stack + f->guard;
+    f->suspended.uc_stack.ss_size = CB_FIBER_STACK;
+    f->suspended.uc_link = NULL;
+    makecontext(&f->suspended, cb_fiber_start, 0);
+    return f;
+}
+
+// cb_perform suspends the innermost fiber handling effect, and switches to where it was resumed. Fibers nested in it
+// are suspended along, and run again when it is resumed.
+void *cb_perform(int64_t effect, int32_t op, void **args) {
+    cb_fiber *f = cb_current;
+    while (f != NULL && f->effect != effect) {
+        f = f->parent;
+    }
+    if (f == NULL) {
+        fprintf(stderr, "unhandled operation %d of effect %lld\n", op, (long long)effect);
+        abort();
+    }
+    f->top = cb_current;
+    f->op = op;
+    f->args = args;
+    f->seq++;
+    f->state = CB_FIBER_SUSPENDED;
+    cb_current = f->parent;
+    swapcontext(&f->suspended, &f->handler);
+    return f->value;
+}
+
+// cb_resume runs fiber until it suspends in an operation or its body returns. It gives index of the operation, or -1
+// once body returned
+int32_t cb_resume(void *fiber) {
+    cb_fiber *f = (cb_fiber *)fiber;
+    if (f->state != CB_FIBER_READY && f->state != CB_FIBER_SENT) {
+        fprintf(stderr, "fiber resumed in state %d\n", f->state);
+        abort();
+    }
+    f->state = CB_FIBER_RUNNING;
+    f->parent = cb_current;
+    cb_current = f->top;
+    swapcontext(&f->handler, &f->suspended);
+    return f->state == CB_FIBER_RETURNED ? -1 : f->op;
+}
+
+// cb_suspended gives the idx-th arg of the operation fiber is suspended in, or the value body returned if idx is -1
+void *cb_suspended(void *fiber, int32_t idx) {
+    cb_fiber *f = (cb_fiber *)fiber;
+    if (idx < 0) {
+        return f->value;
+    }
+    return f->args[idx];
+}
+
+int32_t cb_cont(void *fiber) {
+    return ((cb_fiber *)fiber)->seq;
+}
+
+// cb_send sets value of the operation of continuation seq. Continuation is one-shot, it cannot resume fiber again
+// once fiber goes on from the operation.
+void cb_send(void *fiber, int32_t seq, void *value) {
+    cb_fiber *f = (cb_fiber *)fiber;
+    if (f->state != CB_FIBER_SUSPENDED || f->seq != seq) {
+        fprintf(stderr, "continuation resumed more than once\n");
+        abort();
+    }
+    f->value = value;
+    f->state = CB_FIBER_SENT;
+}
+
+// cb_release frees fiber once its handle ends. Frames left on the stack of fiber abandoned in an operation are gone
+// without unwinding.
+void cb_release(void *fiber) {
+    cb_fiber *f = (cb_fiber *)fiber;
+    munmap(f->stack, f->guard + CB_FIBER_STACK);
+    free(f);
+}
@@ -0,0 +1,43 @@
+#ifndef CAPYBARA_RUNTIME_H
+#define CAPYBARA_RUNTIME_H
+
+#include <stdint.h>
+#include <unwind.h>
+
+// exception. thrown value is boxed in payload, and told apart by type_id given by compiler
+void cb_throw(int64_t type_id, void *payload);
+void cb_rethrow(void *ex);
+int64_t cb_exception_type(void *ex);
+void *cb_exception_payload(void *ex);
+_Unwind_Reason_Code cb_personality(int version, _Unwind_Action actions, uint64_t exception_class,
+                                   struct _Unwind_Exception *ue, struct _Unwind_Context *ctx);
+
+// effect. handle runs its body on a fiber of its own stack, and operation performed in the body switches back to the
+// handle. Value crossing the fiber is boxed
+void *cb_handle(int64_t effect, void *(*entry)(void *), void *env);
+void *cb_perform(int64_t effect, int32_t op, void **args);
+int32_t cb_resume(void *fiber);
+void *cb_suspended(void *fiber, int32_t idx);
+int32_t cb_cont(void *fiber);
+void cb_send(void *fiber, int32_t seq, void *value);
+void cb_release(void *fiber);
+
+// stdlib. vec and hashmap are referred by handle, whose elements are boxed values
+void cb_print_int(int32_t x);
+void cb_print_float(float x);
+void cb_print_char(int32_t c);
+int32_t cb_read_int(void);
+void *cb_vec_new(void);
+int32_t cb_vec_len(void *h);
+void cb_vec_push(void *h, void *x);
+void *cb_vec_get(void *h, int32_t i);
+void cb_vec_set(void *h, int32_t i, void *x);
+void *cb_vec_pop(void *h);
+void *cb_map_new(void);
+int32_t cb_map_len(void *h);
+int32_t cb_map_has(void *h, int32_t key);
+void *cb_map_get(void *h, int32_t key);
+void cb_map_put(void *h, int32_t key, void *value);
+int32_t cb_map_remove(void *h, int32_t key);
+
+#endif
@@ -0,0 +1,191 @@
+#include <stdio.h>
+#include <stdlib.h>
+
+#include "runtime.h"
+
+void cb_print_int(int32_t x) {
+    printf("%d", x);
+    fflush(stdout);
+}
+
+void cb_print_float(float x) {
+    printf("%g", x);
+    fflush(stdout);
+}
+
+void cb_print_char(int32_t c) {
+    putchar(c);
+    fflush(stdout);
+}
+
+int32_t cb_read_int(void) {
+    int32_t x = 0;
+    if (scanf("%d", &x) != 1) {
+        return 0;
+    }
+    return x;
+}
+
+static void cb_abort(const char *msg) {
+    fprintf(stderr, "capybara: %s\n", msg);
+    abort();
+}
+
+typedef struct {
+    int32_t len;
+    int32_t cap;
+    void **items;
+} cb_vec;
+
+void *cb_vec_new(void) {
+    return calloc(1, sizeof(cb_vec));
+}
+
+int32_t cb_vec_len(void *h) {
+    return ((cb_vec *)h)->len;
+}
+
+void cb_vec_push(void *h, void *x) {
+    cb_vec *v = h;
+    if (v->len == v->cap) {
+        v->cap = v->cap == 0 ? 8 : v->cap * 2;
+        v->items = realloc(v->items, sizeof(void *) * v->cap);
+    }
+    v->items[v->len++] = x;
+}
+
+void *cb_vec_get(void *h, int32_t i) {
+    cb_vec *v = h;
+    if (i < 0 || i >= v->len) {
+        cb_abort("vec index out of range");
+    }
+    return v->items[i];
+}
+
+void cb_vec_set(void *h, int32_t i, void *x) {
+    cb_vec *v = h;
+    if (i < 0 || i >= v->len) {
+        cb_abort("vec index out of range");
+    }
+    v->items[i] = x;
+}
+
+void *cb_vec_pop(void *h) {
+    cb_vec *v = h;
+    if (v->len == 0) {
+        cb_abort("pop from empty vec");
+    }
+    return v->items[--v->len];
+}
+
+// hashmap of open addressing with linear probing. Removed slot is a tombstone, which is reused by put
+enum { CB_SLOT_EMPTY, CB_SLOT_USED, CB_SLOT_REMOVED };
+
+typedef struct {
+    int32_t key;
+    int32_t state;
+    void *value;
+} cb_slot;
+
+typedef struct {
+    int32_t len;
+    int32_t used;
+    int32_t cap;
+    cb_slot *slots;
+} cb_map;
+
+void *cb_map_new(void) {
+    cb_map *m = calloc(1, sizeof(cb_map));
+    m->cap = 16;
+    m->slots = calloc(m->cap, sizeof(cb_slot));
+    return m;
+}
+
+static uint32_t cb_hash(int32_t key) {
+    uint32_t h = (uint32_t)key;
+    h ^= h >> 16;
+    h *= 0x45d9f3b;
+    h ^= h >> 16;
+    return h;
+}
+
+// cb_map_find gives slot of key, NULL if key is not mapped
+static cb_slot *cb_map_find(cb_map *m, int32_t key) {
+    uint32_t i = cb_hash(key) & (m->cap - 1);
+    for (;;) {
+        cb_slot *s = &m->slots[i];
+        if (s->state == CB_SLOT_EMPTY) {
+            return NULL;
+        }
+        if (s->state == CB_SLOT_USED && s->key == key) {
+            return s;
+        }
+        i = (i + 1) & (m->cap - 1);
+    }
+}
+
+static void cb_map_grow(cb_map *m) {
+    cb_slot *old = m->slots;
+    int32_t cap = m->cap;
+    m->cap = cap * 2;
+    m->slots = calloc(m->cap, sizeof(cb_slot));
+    m->len = 0;
+    m->used = 0;
+    for (int32_t i = 0; i < cap; i++) {
+        if (old[i].state == CB_SLOT_USED) {
+            cb_map_put(m, old[i].key, old[i].value);
+        }
+    }
+    free(old);
+}
+
+int32_t cb_map_len(void *h) {
+    return ((cb_map *)h)->len;
+}
+
+int32_t cb_map_has(void *h, int32_t key) {
+    return cb_map_find(h, key) != NULL;
+}
+
+void *cb_map_get(void *h, int32_t key) {
+    cb_slot *s = cb_map_find(h, key);
+    if (s == NULL) {
+        cb_abort("key not found in hashmap");
+    }
+    return s->value;
+}
+
+void cb_map_put(void *h, int32_t key, void *value) {
+    cb_map *m = h;
+    cb_slot *s = cb_map_find(m, key);
+    if (s != NULL) {
+        s->value = value;
+        return;
+    }
+    if ((m->used + 1) * 4 > m->cap * 3) {
+        cb_map_grow(m);
+    }
+    uint32_t i = cb_hash(key) & (m->cap - 1);
+    while (m->slots[i].state == CB_SLOT_USED) {
+        i = (i + 1) & (m->cap - 1);
+    }
+    if (m->slots[i].state == CB_SLOT_EMPTY) {
+        m->used++;
+    }
+    m->slots[i].key = key;
+    m->slots[i].state = CB_SLOT_USED;
+    m->slots[i].value = value;
+    m->len++;
+}
+
+int32_t cb_map_remove(void *h, int32_t key) {
+    cb_map *m = h;
+    cb_slot *s = cb_map_find(m, key);
+    if (s == NULL) {
+        return 0;
+    }
+    s->state = CB_SLOT_REMOVED;
+    s->value = NULL;
+    m->len--;
+    return 1;
+}
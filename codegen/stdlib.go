@@ -0,0 +1,72 @@
+package codegen
+
+/*
+#include "runtime.h"
+*/
+import "C"
+
+import (
+	"unsafe"
+
+	"github.com/llvm/llvm-project/bindings/go/llvm"
+)
+
+func init() {
+	for name, addr := range map[string]unsafe.Pointer{
+		"cb_print_int":   unsafe.Pointer(C.cb_print_int),
+		"cb_print_float": unsafe.Pointer(C.cb_print_float),
+		"cb_print_char":  unsafe.Pointer(C.cb_print_char),
+		"cb_read_int":    unsafe.Pointer(C.cb_read_int),
+		"cb_vec_new":     unsafe.Pointer(C.cb_vec_new),
+		"cb_vec_len":     unsafe.Pointer(C.cb_vec_len),
+		"cb_vec_push":    unsafe.Pointer(C.cb_vec_push),
+		"cb_vec_get":     unsafe.Pointer(C.cb_vec_get),
+		"cb_vec_set":     unsafe.Pointer(C.cb_vec_set),
+		"cb_vec_pop":     unsafe.Pointer(C.cb_vec_pop),
+		"cb_map_new":     unsafe.Pointer(C.cb_map_new),
+		"cb_map_len":     unsafe.Pointer(C.cb_map_len),
+		"cb_map_has":     unsafe.Pointer(C.cb_map_has),
+		"cb_map_get":     unsafe.Pointer(C.cb_map_get),
+		"cb_map_put":     unsafe.Pointer(C.cb_map_put),
+		"cb_map_remove":  unsafe.Pointer(C.cb_map_remove),
+	} {
+		runtimeAddrs[name] = addr
+	}
+}
+
+// stdlibFuncType gives type of runtime func name which stdlib modules call, false if there is no such func. Handle
+// is typed as `ptr[int]` by stdlib, and boxed element as type param.
+func stdlibFuncType(name string) (llvm.Type, bool) {
+	handleT := llvm.PointerType(intT, 0)
+	var ret llvm.Type
+	var params []llvm.Type
+	switch name {
+	case "cb_print_int", "cb_print_char":
+		ret, params = unitT, []llvm.Type{intT}
+	case "cb_print_float":
+		ret, params = unitT, []llvm.Type{floatT}
+	case "cb_read_int":
+		ret = intT
+	case "cb_vec_new", "cb_map_new":
+		ret = handleT
+	case "cb_vec_len", "cb_map_len":
+		ret, params = intT, []llvm.Type{handleT}
+	case "cb_vec_push":
+		ret, params = unitT, []llvm.Type{handleT, voidPtrT}
+	case "cb_vec_get":
+		ret, params = voidPtrT, []llvm.Type{handleT, intT}
+	case "cb_vec_set":
+		ret, params = unitT, []llvm.Type{handleT, intT, voidPtrT}
+	case "cb_vec_pop":
+		ret, params = voidPtrT, []llvm.Type{handleT}
+	case "cb_map_has", "cb_map_remove":
+		ret, params = intT, []llvm.Type{handleT, intT}
+	case "cb_map_get":
+		ret, params = voidPtrT, []llvm.Type{handleT, intT}
+	case "cb_map_put":
+		ret, params = unitT, []llvm.Type{handleT, intT, voidPtrT}
+	default:
+		return llvm.Type{}, false
+	}
+	return llvm.FunctionType(ret, params, false), true
+}
@@ -31,6 +31,39 @@ const (
 	TYPE_PARAM_COUNT_WRONG
 	TYPE_BOUND_LOWER_TRAIT
 	TYPE_METHOD_ILLEGAL
+	TYPE_INCOMPATIBLE_ARRAY
+	TYPE_ARRAY_ACS_ILLEGAL
+	TYPE_CONST_PARAM_ILLEGAL
+	TYPE_TUPLE_DESTRUCT_ILLEGAL
+	TYPE_INCOMPARABLE
+	TYPE_DERIVE_ILLEGAL
+	TYPE_IMPL_ILLEGAL
+	TYPE_SUPERTRAIT_ILLEGAL
+	TYPE_BOUND_AMBIGUOUS
+	TYPE_ASSOC_ILLEGAL
+	TYPE_OVERLOAD_ILLEGAL
+	TYPE_OVERLOAD_AMBIGUOUS
+	TYPE_OPERATOR_ILLEGAL
+	TYPE_RECURSIVE_ILLEGAL
+	TYPE_INCOMPATIBLE_REF
+	TYPE_REF_ILLEGAL
+	TYPE_REF_ESCAPE
+	TYPE_PROPAGATE_ILLEGAL
+	TYPE_EXCEPTION_ILLEGAL
+	TYPE_EFFECT_ILLEGAL
+	TYPE_EFFECT_UNHANDLED
+	TYPE_GENERATOR_ILLEGAL
+	TYPE_ITER_ILLEGAL
+
+	// SCOPE ERROR
+	SCOPE_VAR_UNDEFINED
+	SCOPE_VAR_REDECLARED
+	SCOPE_MODULE_UNDEFINED
+
+	// MUTATE ERROR
+	MUTATE_IMMUTABLE_VAR
+	MUTATE_IMMUTABLE_PARAM
+	MUTATE_READONLY_FIELD
 )
 
 var ErrorCodeMap = map[string]ErrorCode{
@@ -54,6 +87,35 @@ var ErrorCodeMap = map[string]ErrorCode{
 	"TYPE_PARAM_COUNT_WRONG":        TYPE_PARAM_COUNT_WRONG,
 	"TYPE_BOUND_LOWER_TRAIT":        TYPE_BOUND_LOWER_TRAIT,
 	"TYPE_METHOD_ILLEGAL":           TYPE_METHOD_ILLEGAL,
+	"TYPE_INCOMPATIBLE_ARRAY":       TYPE_INCOMPATIBLE_ARRAY,
+	"TYPE_ARRAY_ACS_ILLEGAL":        TYPE_ARRAY_ACS_ILLEGAL,
+	"TYPE_CONST_PARAM_ILLEGAL":      TYPE_CONST_PARAM_ILLEGAL,
+	"TYPE_TUPLE_DESTRUCT_ILLEGAL":   TYPE_TUPLE_DESTRUCT_ILLEGAL,
+	"TYPE_INCOMPARABLE":             TYPE_INCOMPARABLE,
+	"TYPE_DERIVE_ILLEGAL":           TYPE_DERIVE_ILLEGAL,
+	"TYPE_IMPL_ILLEGAL":             TYPE_IMPL_ILLEGAL,
+	"TYPE_SUPERTRAIT_ILLEGAL":       TYPE_SUPERTRAIT_ILLEGAL,
+	"TYPE_BOUND_AMBIGUOUS":          TYPE_BOUND_AMBIGUOUS,
+	"TYPE_ASSOC_ILLEGAL":            TYPE_ASSOC_ILLEGAL,
+	"TYPE_OVERLOAD_ILLEGAL":         TYPE_OVERLOAD_ILLEGAL,
+	"TYPE_OVERLOAD_AMBIGUOUS":       TYPE_OVERLOAD_AMBIGUOUS,
+	"TYPE_OPERATOR_ILLEGAL":         TYPE_OPERATOR_ILLEGAL,
+	"TYPE_RECURSIVE_ILLEGAL":        TYPE_RECURSIVE_ILLEGAL,
+	"TYPE_INCOMPATIBLE_REF":         TYPE_INCOMPATIBLE_REF,
+	"TYPE_REF_ILLEGAL":              TYPE_REF_ILLEGAL,
+	"TYPE_REF_ESCAPE":               TYPE_REF_ESCAPE,
+	"TYPE_PROPAGATE_ILLEGAL":        TYPE_PROPAGATE_ILLEGAL,
+	"TYPE_EXCEPTION_ILLEGAL":        TYPE_EXCEPTION_ILLEGAL,
+	"TYPE_EFFECT_ILLEGAL":           TYPE_EFFECT_ILLEGAL,
+	"TYPE_EFFECT_UNHANDLED":         TYPE_EFFECT_UNHANDLED,
+	"TYPE_GENERATOR_ILLEGAL":        TYPE_GENERATOR_ILLEGAL,
+	"TYPE_ITER_ILLEGAL":             TYPE_ITER_ILLEGAL,
+	"SCOPE_VAR_UNDEFINED":           SCOPE_VAR_UNDEFINED,
+	"SCOPE_VAR_REDECLARED":          SCOPE_VAR_REDECLARED,
+	"SCOPE_MODULE_UNDEFINED":        SCOPE_MODULE_UNDEFINED,
+	"MUTATE_IMMUTABLE_VAR":          MUTATE_IMMUTABLE_VAR,
+	"MUTATE_IMMUTABLE_PARAM":        MUTATE_IMMUTABLE_PARAM,
+	"MUTATE_READONLY_FIELD":         MUTATE_READONLY_FIELD,
 }
 
 type LangError struct {
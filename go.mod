@@ -1,6 +1,6 @@
 module github.com/kingfolk/capybara
 
-go 1.15
+go 1.16
 
 require (
 	github.com/fatih/color v1.12.0 // indirect
@@ -246,7 +246,7 @@ func (m *DominatorMaker) placePhi(df domFrontier) {
 	allocPhis := map[int]map[string]bool{}
 	for _, block := range m.allBlocks {
 		for _, ir := range block.Ins {
-			if arrayHasInt(defsitesBySymbol[ir.Ident], block.Id) {
+			if IsSlot(ir.Ident) || arrayHasInt(defsitesBySymbol[ir.Ident], block.Id) {
 				continue
 			}
 			defsitesBySymbol[ir.Ident] = append(defsitesBySymbol[ir.Ident], block.Id)
@@ -336,6 +336,10 @@ func (r *renamingStack) stackSymbol(symbol string) string {
 	if IsDangle(symbol) {
 		return symbol
 	}
+	if IsSlot(symbol) {
+		r.declTable[symbol] = r.origDecls[symbol]
+		return symbol
+	}
 	if i, ok := r.stack[symbol]; ok {
 		newIdent := GenVarIdent(i)
 		r.declTable[newIdent] = r.origDecls[symbol]
@@ -366,6 +370,16 @@ func DestructVarId(ident string) int {
 
 var dangleIdent = "$v_dangle"
 
+// SlotIdent gives ident of stack slot for variable ident
+func SlotIdent(ident string) string {
+	return "$s" + ident[2:]
+}
+
+// IsSlot tests if ident is a stack slot. Slot lives in memory, every def of it is a store and every use a load
+func IsSlot(ident string) bool {
+	return len(ident) > 2 && ident[:2] == "$s"
+}
+
 func IsDangle(ident string) bool {
 	return ident == dangleIdent
 }
@@ -380,6 +394,115 @@ func (r *renamingStack) push(symbol string) string {
 	return GenVarIdent(r.index)
 }
 
+// Operands gives idents ins reads
+func Operands(ins *Instr) []string {
+	var idents []string
+	mapOperands(ins, func(ident string) string {
+		idents = append(idents, ident)
+		return ident
+	})
+	return idents
+}
+
+// mapOperands replaces each operand of ins by f
+func mapOperands(ins *Instr, f func(string) string) {
+	switch i := ins.Val.(type) {
+	case *If:
+		i.Cond = f(i.Cond)
+	case *Expr:
+		for idx, arg := range i.Args {
+			i.Args[idx] = f(arg)
+		}
+	case *Ref:
+		i.Ident = f(i.Ident)
+	case *Ret:
+		if i.Target != "" {
+			i.Target = f(i.Target)
+		}
+	case *ArrLit:
+		for idx, arg := range i.Args {
+			i.Args[idx] = f(arg)
+		}
+	case *ArrGet:
+		i.Arr = f(i.Arr)
+		i.Index = f(i.Index)
+	case *ArrPut:
+		i.Arr = f(i.Arr)
+		i.Index = f(i.Index)
+		i.Right = f(i.Right)
+	case *RecPut:
+		i.Target = f(i.Target)
+		i.Right = f(i.Right)
+	case *StructCmp:
+		i.Left = f(i.Left)
+		i.Right = f(i.Right)
+		if i.Len != "" {
+			i.Len = f(i.Len)
+		}
+	case *StructHash:
+		i.Target = f(i.Target)
+	case *StructClone:
+		i.Target = f(i.Target)
+	case *StructDebug:
+		i.Target = f(i.Target)
+	case *StaticCall:
+		for idx, arg := range i.Args {
+			i.Args[idx] = f(arg)
+		}
+	case *TraitCall:
+		for idx, arg := range i.Args {
+			i.Args[idx] = f(arg)
+		}
+	case *RecLit:
+		for idx, arg := range i.Args {
+			i.Args[idx] = f(arg)
+		}
+	case *RecAcs:
+		i.Target = f(i.Target)
+	case *EnumVar:
+		if i.Box != "" {
+			i.Box = f(i.Box)
+		}
+	case *Discriminant:
+		i.Target = f(i.Target)
+	case *Box:
+		i.Target = f(i.Target)
+	case *BoxTrait:
+		i.Target = f(i.Target)
+	case *Unbox:
+		i.Target = f(i.Target)
+	case *Addr:
+		i.Target = f(i.Target)
+	case *Load:
+		i.Target = f(i.Target)
+	case *Store:
+		i.Target = f(i.Target)
+		i.Right = f(i.Right)
+	case *Throw:
+		i.Target = f(i.Target)
+	case *Perform:
+		for idx, arg := range i.Args {
+			i.Args[idx] = f(arg)
+		}
+	case *Handle:
+		for idx, arg := range i.Args {
+			i.Args[idx] = f(arg)
+		}
+	case *Resume:
+		i.Fiber = f(i.Fiber)
+	case *Suspended:
+		i.Fiber = f(i.Fiber)
+	case *Cont:
+		i.Fiber = f(i.Fiber)
+	case *Send:
+		i.Fiber = f(i.Fiber)
+		i.Seq = f(i.Seq)
+		i.Value = f(i.Value)
+	case *Release:
+		i.Fiber = f(i.Fiber)
+	}
+}
+
 func (m *DominatorMaker) renameBlock(block *Block, renaming *renamingStack) {
 	irs := []*Instr{}
 	var renameIr = func(ir *Instr) {
@@ -387,54 +510,10 @@ func (m *DominatorMaker) renameBlock(block *Block, renaming *renamingStack) {
 			renaming.push(ir.Ident)
 			ir.Ident = renaming.stackSymbol(ir.Ident)
 		} else {
-			switch i := ir.Val.(type) {
-			case *If:
-				i.Cond = renaming.stackSymbol(i.Cond)
-			case *Expr:
-				for idx, arg := range i.Args {
-					i.Args[idx] = renaming.stackSymbol(arg)
-				}
-			case *Ref:
-				i.Ident = renaming.stackSymbol(i.Ident)
-			case *Ret:
-				if i.Target != "" {
-					i.Target = renaming.stackSymbol(i.Target)
-				}
-			case *ArrGet:
-				i.Arr = renaming.stackSymbol(i.Arr)
-				i.Index = renaming.stackSymbol(i.Index)
-			case *ArrPut:
-				i.Arr = renaming.stackSymbol(i.Arr)
-				i.Index = renaming.stackSymbol(i.Index)
-				i.Right = renaming.stackSymbol(i.Right)
-			case *StaticCall:
-				for idx, arg := range i.Args {
-					i.Args[idx] = renaming.stackSymbol(arg)
-				}
-			case *TraitCall:
-				for idx, arg := range i.Args {
-					i.Args[idx] = renaming.stackSymbol(arg)
-				}
-			case *RecLit:
-				for idx, arg := range i.Args {
-					i.Args[idx] = renaming.stackSymbol(arg)
-				}
-			case *RecAcs:
-				i.Target = renaming.stackSymbol(i.Target)
-			case *EnumVar:
-				if i.Box != "" {
-					i.Box = renaming.stackSymbol(i.Box)
-				}
-			case *Discriminant:
-				i.Target = renaming.stackSymbol(i.Target)
-			case *Box:
-				i.Target = renaming.stackSymbol(i.Target)
-			case *BoxTrait:
-				i.Target = renaming.stackSymbol(i.Target)
-			case *Unbox:
-				i.Target = renaming.stackSymbol(i.Target)
+			mapOperands(ir, renaming.stackSymbol)
+			if !IsSlot(ir.Ident) {
+				renaming.push(ir.Ident)
 			}
-			renaming.push(ir.Ident)
 			ir.Ident = renaming.stackSymbol(ir.Ident)
 		}
 	}
@@ -497,43 +576,130 @@ func (m *DominatorMaker) rename(declTable map[string]types.ValType) map[string]t
 // 以下处理遇到这样的PHI，直接删去这个这个指令。这样的删去对目前的case可以pass
 //
 // 空值在现代语言里经常和some/none，match等语法连在一起处理。
+//
+// A removed phi may be an edge of another phi, e.g. a join reached by a guard failed in match, so removal is repeated
+// with such edges taken as dangle until no more phi is removed.
 func (m *DominatorMaker) removeIneffective() {
-	for _, blk := range m.allBlocks {
-		var newIns []*Instr
-		for _, ins := range blk.Ins {
-			left := ins.Ident
-			switch v := ins.Val.(type) {
-			case *Ref:
-				right := v.Ident
-				// 等号左右相同
-				if left == right {
-					continue
-				}
-			case *Phi:
-				var effectCount int
-				// var effectIdent string
-				for _, edge := range v.Edges {
-					if !IsDangle(edge) {
-						effectCount++
-						// effectIdent = edge
+	removed := map[string]bool{}
+	for changed := true; changed; {
+		changed = false
+		for _, blk := range m.allBlocks {
+			var newIns []*Instr
+			for _, ins := range blk.Ins {
+				left := ins.Ident
+				switch v := ins.Val.(type) {
+				case *Ref:
+					right := v.Ident
+					// 等号左右相同
+					if left == right {
+						continue
+					}
+				case *Phi:
+					var effectCount int
+					// var effectIdent string
+					for _, edge := range v.Edges {
+						if !IsDangle(edge) && !removed[edge] {
+							effectCount++
+							// effectIdent = edge
+						}
+					}
+					if effectCount <= 1 {
+						// Only one edge carries a def. The symbol is a block scoped variable which is already out of
+						// scope at this join, any use after is rejected by emitter. So the phi is never used.
+						// ins.Val = NewRef(v.Tp, effectIdent)
+						removed[left] = true
+						changed = true
+						continue
 					}
 				}
-				if effectCount == 0 {
-					continue
+				newIns = append(newIns, ins)
+			}
+			blk.Ins = newIns
+		}
+	}
+}
+
+// spillSlots turns variables whose address is taken into stack slots. A slot stays out of SSA, so it is neither
+// renamed nor joined by phi, and a write through reference is seen by later reads of the variable.
+func (m *DominatorMaker) spillSlots(declTable map[string]types.ValType) {
+	slots := map[string]string{}
+	for _, block := range m.allBlocks {
+		for _, ins := range block.Ins {
+			if a, ok := ins.Val.(*Addr); ok && !IsSlot(a.Target) {
+				slots[a.Target] = SlotIdent(a.Target)
+			}
+		}
+	}
+	for ident := range m.tryMutations() {
+		slots[ident] = SlotIdent(ident)
+	}
+	if len(slots) == 0 {
+		return
+	}
+	for ident, slot := range slots {
+		declTable[slot] = declTable[ident]
+	}
+	spill := func(ident string) string {
+		if slot, ok := slots[ident]; ok {
+			return slot
+		}
+		return ident
+	}
+	for _, block := range m.allBlocks {
+		for _, ins := range block.Ins {
+			mapOperands(ins, spill)
+			ins.Ident = spill(ins.Ident)
+		}
+	}
+}
+
+// tryMutations gives variables assigned in a try body and defined out of it. Catch block is entered from any call or
+// throw of the body, while SSA joins the body only at its end. So such variables are kept in slots, that catch and
+// the blocks after try see the writes made before unwinding.
+func (m *DominatorMaker) tryMutations() map[string]bool {
+	mutated := map[string]bool{}
+	for _, block := range m.allBlocks {
+		for _, tryIns := range block.Ins {
+			t, ok := tryIns.Val.(*Try)
+			if !ok {
+				continue
+			}
+			// body is entered only from the try, so blocks it dominates are the body
+			body := map[int]bool{}
+			stack := []*Block{t.Body}
+			for len(stack) > 0 {
+				top := stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+				body[top.Id] = true
+				stack = append(stack, top.dom.children...)
+			}
+			inside, outside := map[string]bool{}, map[string]bool{}
+			for _, b := range m.allBlocks {
+				for _, ins := range b.Ins {
+					// value of try itself is joined by phi after try
+					if ins.Ident == tryIns.Ident || IsDangle(ins.Ident) || IsSlot(ins.Ident) {
+						continue
+					}
+					if body[b.Id] {
+						inside[ins.Ident] = true
+					} else {
+						outside[ins.Ident] = true
+					}
 				}
-				if effectCount == 1 {
-					// ins.Val = NewRef(v.Tp, effectIdent)
-					continue
+			}
+			for ident := range inside {
+				if outside[ident] {
+					mutated[ident] = true
 				}
 			}
-			newIns = append(newIns, ins)
 		}
-		blk.Ins = newIns
 	}
+	return mutated
 }
 
 func (m *DominatorMaker) Lift(declTable map[string]types.ValType) map[string]types.ValType {
 	m.buildDomTree()
+	m.spillSlots(declTable)
 
 	if m.debug {
 		fmt.Println("--- dominator tree ---")
@@ -23,6 +23,8 @@ const (
 	OR
 	EQ
 	NEQ
+	// CMP three way comparison, gives -1, 0 or 1
+	CMP
 )
 
 var OpKindString = map[OperatorKind]string{
@@ -39,6 +41,7 @@ var OpKindString = map[OperatorKind]string{
 	OR:  "||",
 	EQ:  "==",
 	NEQ: "!=",
+	CMP: "<=>",
 }
 
 type (
@@ -47,6 +50,8 @@ type (
 		// Env root scope env
 		Env   *types.Env
 		Funcs []*Func
+		// Libs funcs of prelude and stdlib modules imported, which are compiled with the module
+		Libs []*Func
 	}
 
 	Block struct {
@@ -105,6 +110,8 @@ type (
 		Tp   types.ValType
 		Args []string
 		// Boxes []types.ValType
+		// Unwind is catch block of the try enclosing the call, nil if the call is not in try
+		Unwind *Block
 	}
 
 	TraitCall struct {
@@ -112,6 +119,8 @@ type (
 		Trait *types.Trait
 		Tp    types.ValType
 		Args  []string
+		// Unwind is catch block of the try enclosing the call, nil if the call is not in try
+		Unwind *Block
 	}
 
 	Phi struct {
@@ -140,6 +149,12 @@ type (
 		Arr, Index, Right string
 	}
 
+	RecPut struct {
+		Target string
+		Idx    int
+		Right  string
+	}
+
 	RecLit struct {
 		Tp   *types.Rec
 		Args []string
@@ -162,6 +177,8 @@ type (
 		Tp     types.ValType
 		BoxTp  types.ValType
 		Target string
+		// Heap tells value is copied to heap before boxed, as the callee keeps it past the call
+		Heap bool
 	}
 
 	BoxTrait struct {
@@ -179,6 +196,126 @@ type (
 		Simple bool
 		Target string
 	}
+
+	// Addr takes address of local variable Target. Target is kept in a stack slot rather than lifted to SSA
+	Addr struct {
+		Tp     *types.Ref
+		Target string
+	}
+
+	// Load reads value reference Target refers to
+	Load struct {
+		Tp     types.ValType
+		Target string
+	}
+
+	// Store writes Right to value reference Target refers to
+	Store struct {
+		Target string
+		Right  string
+	}
+
+	// Throw raises Target as exception of type id TypeId. It ends its block, the rest of block is dead
+	Throw struct {
+		Tp     types.ValType
+		TypeId uint64
+		Target string
+		// Unwind is catch block of the try enclosing the throw, nil if the throw is not in try
+		Unwind *Block
+	}
+
+	// Try runs Body. Exception of type id TypeId thrown in Body transfers control to Catch
+	Try struct {
+		Body   *Block
+		Catch  *Block
+		TypeId uint64
+		// Unwind is catch block of the try enclosing this one, which exception of other type is rethrown to. nil if
+		// the try is not in try
+		Unwind *Block
+	}
+
+	// Catch gives the exception caught by the try of its block, as value of type Tp. It leads the catch block
+	Catch struct {
+		Tp types.ValType
+	}
+
+	// Perform performs the Op-th operation of Effect with Args. Control is passed to the innermost handle of Effect,
+	// and comes back with the value the operation is resumed by
+	Perform struct {
+		Tp     types.ValType
+		Effect *types.Effect
+		Op     int
+		Args   []string
+	}
+
+	// Handle starts a fiber running func Body with Args, which handles operations of Effect performed in it. Ret is
+	// type of the value Body returns
+	Handle struct {
+		Effect *types.Effect
+		Body   string
+		Ret    types.ValType
+		Args   []string
+	}
+
+	// Resume runs Fiber until it performs an operation or returns. It gives index of the operation performed, or -1
+	// once the body returns
+	Resume struct {
+		Fiber string
+	}
+
+	// Suspended gives the Idx-th arg of the operation Fiber performed, or the value its body returns if Idx is -1
+	Suspended struct {
+		Tp    types.ValType
+		Fiber string
+		Idx   int
+	}
+
+	// Cont gives the continuation of the operation Fiber is suspended in. It is told apart from continuations of the
+	// operations Fiber performs later, so that each one resumes Fiber at most once
+	Cont struct {
+		Fiber string
+	}
+
+	// Send sets Value as what the operation performed by Fiber returns when Fiber is resumed. Seq is the continuation
+	// of the operation, which is aborted at runtime if it is not the one Fiber is suspended in
+	Send struct {
+		Tp    types.ValType
+		Fiber string
+		Seq   string
+		Value string
+	}
+
+	// Release frees Fiber once its handle ends, whether it has returned or is abandoned in an operation
+	Release struct {
+		Fiber string
+	}
+
+	// StructCmp compares two compound values structurally. Len is the runtime length of an array sized by a const
+	// type param, empty otherwise.
+	StructCmp struct {
+		Op          OperatorKind
+		Tp          types.ValType
+		Left, Right string
+		Len         string
+	}
+
+	// StructHash hashes a value by its whole shape
+	StructHash struct {
+		Tp     types.ValType
+		Target string
+	}
+
+	// StructClone deep copies a value, compound members are copied as well
+	StructClone struct {
+		Tp     types.ValType
+		Target string
+	}
+
+	// StructDebug prints a value by its whole shape
+	StructDebug struct {
+		Tp     types.ValType
+		Target string
+	}
 )
 
 const (
@@ -236,8 +373,25 @@ func (e *Block) Kind() int {
 	return BlockKind
 }
 
+// Type gives type of value of block. Block ending with control flow takes value of its first branch not left by return
+// or throw, e.g. the one `?` goes on with.
 func (e *Block) Type() types.ValType {
-	return e.Ins[len(e.Ins)-1].Type()
+	last := e.Last()
+	for _, b := range Branches(last.Val) {
+		if !b.Terminated() {
+			return b.Type()
+		}
+	}
+	return last.Type()
+}
+
+// Terminated tells whether block ends by return or throw, after which control does not go on
+func (e *Block) Terminated() bool {
+	switch e.Last().Val.(type) {
+	case *Ret, *Throw:
+		return true
+	}
+	return false
 }
 
 func (e *Block) String() string {
@@ -328,7 +482,7 @@ func (e *StaticCall) Type() types.ValType {
 }
 
 func (e *StaticCall) String() string {
-	return e.Name + "(" + strings.Join(e.Args, ", ") + ") "
+	return e.Name + "(" + strings.Join(e.Args, ", ") + ") " + unwindString(e.Unwind)
 }
 
 func (e *TraitCall) Kind() int {
@@ -340,7 +494,14 @@ func (e *TraitCall) Type() types.ValType {
 }
 
 func (e *TraitCall) String() string {
-	return "TraitCall" + "(" + e.Name + ", " + strings.Join(e.Args, ", ") + ") "
+	return "TraitCall" + "(" + e.Name + ", " + strings.Join(e.Args, ", ") + ") " + unwindString(e.Unwind)
+}
+
+func unwindString(unwind *Block) string {
+	if unwind == nil {
+		return ""
+	}
+	return "Unwind #bb" + strconv.Itoa(unwind.Id)
 }
 
 func (e *ArrLit) Kind() int {
@@ -398,6 +559,18 @@ func (e *RecLit) String() string {
 	return "Rec<" + tp + ">(" + strings.Join(e.Args, ", ") + ") "
 }
 
+func (e *RecPut) Kind() int {
+	return CallKind
+}
+
+func (e *RecPut) Type() types.ValType {
+	return nil
+}
+
+func (e *RecPut) String() string {
+	return e.Target + "." + strconv.Itoa(e.Idx) + " <- " + e.Right
+}
+
 func (e *RecAcs) Kind() int {
 	return CallKind
 }
@@ -443,6 +616,9 @@ func (e *Box) Type() types.ValType {
 }
 
 func (e *Box) String() string {
+	if e.Heap {
+		return "HeapBox(" + e.Target + ")"
+	}
 	return "Box(" + e.Target + ")"
 }
 
@@ -458,6 +634,42 @@ func (e *BoxTrait) String() string {
 	return "BoxTrait(" + e.Target + ")"
 }
 
+func (e *Addr) Kind() int {
+	return RValKind
+}
+
+func (e *Addr) Type() types.ValType {
+	return e.Tp
+}
+
+func (e *Addr) String() string {
+	return "&" + e.Target
+}
+
+func (e *Load) Kind() int {
+	return CallKind
+}
+
+func (e *Load) Type() types.ValType {
+	return e.Tp
+}
+
+func (e *Load) String() string {
+	return "*" + e.Target
+}
+
+func (e *Store) Kind() int {
+	return CallKind
+}
+
+func (e *Store) Type() types.ValType {
+	return nil
+}
+
+func (e *Store) String() string {
+	return "*" + e.Target + " <- " + e.Right
+}
+
 func (e *Unbox) Kind() int {
 	return CallKind
 }
@@ -565,3 +777,192 @@ func CFGString(bb *Block) string {
 
 	return res
 }
+
+func (e *StructCmp) Kind() int {
+	return RValKind
+}
+
+func (e *StructCmp) Type() types.ValType {
+	if e.Op == CMP {
+		return types.Int
+	}
+	return types.Bool
+}
+
+func (e *StructCmp) String() string {
+	return "Cmp<" + e.Tp.String() + ">(" + e.Left + " " + OpKindString[e.Op] + " " + e.Right + ")"
+}
+
+func (e *StructHash) Kind() int {
+	return RValKind
+}
+
+func (e *StructHash) Type() types.ValType {
+	return types.Int
+}
+
+func (e *StructHash) String() string {
+	return "Hash<" + e.Tp.String() + ">(" + e.Target + ")"
+}
+
+func (e *StructClone) Kind() int {
+	return RValKind
+}
+
+func (e *StructClone) Type() types.ValType {
+	return e.Tp
+}
+
+func (e *StructClone) String() string {
+	return "Clone<" + e.Tp.String() + ">(" + e.Target + ")"
+}
+
+func (e *StructDebug) Kind() int {
+	return CallKind
+}
+
+func (e *StructDebug) Type() types.ValType {
+	return types.Int
+}
+
+func (e *StructDebug) String() string {
+	return "Debug<" + e.Tp.String() + ">(" + e.Target + ")"
+}
+
+func (e *Throw) Kind() int {
+	return CallKind
+}
+
+func (e *Throw) Type() types.ValType {
+	return types.Unit
+}
+
+func (e *Throw) String() string {
+	return "Throw " + e.Target + " " + unwindString(e.Unwind)
+}
+
+func (e *Try) Kind() int {
+	return IfKind
+}
+
+func (e *Try) Type() types.ValType {
+	return e.Body.Type()
+}
+
+func (e *Try) String() string {
+	s := "Try #bb" + strconv.Itoa(e.Body.Id) + " Catch #bb" + strconv.Itoa(e.Catch.Id)
+	if e.Unwind != nil {
+		s += " " + unwindString(e.Unwind)
+	}
+	return s
+}
+
+func (e *Catch) Kind() int {
+	return RValKind
+}
+
+func (e *Catch) Type() types.ValType {
+	return e.Tp
+}
+
+func (e *Catch) String() string {
+	return "Catch<" + e.Tp.String() + ">"
+}
+
+func (e *Perform) Kind() int {
+	return CallKind
+}
+
+func (e *Perform) Type() types.ValType {
+	return e.Tp
+}
+
+func (e *Perform) String() string {
+	return "Perform " + e.Effect.Keys[e.Op] + "(" + strings.Join(e.Args, ", ") + ")"
+}
+
+func (e *Handle) Kind() int {
+	return CallKind
+}
+
+func (e *Handle) Type() types.ValType {
+	return types.VoidP
+}
+
+func (e *Handle) String() string {
+	return "Handle " + e.Body + "(" + strings.Join(e.Args, ", ") + ")"
+}
+
+func (e *Resume) Kind() int {
+	return CallKind
+}
+
+func (e *Resume) Type() types.ValType {
+	return types.Int
+}
+
+func (e *Resume) String() string {
+	return "Resume " + e.Fiber
+}
+
+func (e *Suspended) Kind() int {
+	return RValKind
+}
+
+func (e *Suspended) Type() types.ValType {
+	return e.Tp
+}
+
+func (e *Suspended) String() string {
+	if e.Idx < 0 {
+		return "Suspended<" + e.Tp.String() + ">(" + e.Fiber + ")"
+	}
+	return "Suspended<" + e.Tp.String() + ">(" + e.Fiber + "." + strconv.Itoa(e.Idx) + ")"
+}
+
+func (e *Cont) Kind() int {
+	return RValKind
+}
+
+func (e *Cont) Type() types.ValType {
+	return types.Int
+}
+
+func (e *Cont) String() string {
+	return "Cont " + e.Fiber
+}
+
+func (e *Send) Kind() int {
+	return CallKind
+}
+
+func (e *Send) Type() types.ValType {
+	return types.Unit
+}
+
+func (e *Send) String() string {
+	return "Send " + e.Fiber + "(" + e.Seq + ") " + e.Value
+}
+
+func (e *Release) Kind() int {
+	return CallKind
+}
+
+func (e *Release) Type() types.ValType {
+	return types.Unit
+}
+
+func (e *Release) String() string {
+	return "Release " + e.Fiber
+}
+
+// Branches gives the blocks branched to by v, which ends its block. nil is given if v does not branch
+func Branches(v Val) []*Block {
+	switch i := v.(type) {
+	case *If:
+		return []*Block{i.Then, i.Else}
+	case *Try:
+		return []*Block{i.Body, i.Catch}
+	}
+	return nil
+}
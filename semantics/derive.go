@@ -0,0 +1,146 @@
+package semantics
+
+import (
+	"github.com/kingfolk/capybara/ast"
+	"github.com/kingfolk/capybara/errors"
+	"github.com/kingfolk/capybara/ir"
+	"github.com/kingfolk/capybara/types"
+)
+
+// deriveTraits builtin traits which can be derived by `derive(...)` of type declaration. Each has a single func.
+// A trait func referring to the trait itself stands for Self, see types.IsSelf.
+var deriveTraits = map[string]*types.Trait{
+	"Eq":    builtinTrait("eq", true, false, types.Bool),
+	"Ord":   builtinTrait("cmp", true, false, types.Int),
+	"Hash":  builtinTrait("hash", false, false, types.Int),
+	"Debug": builtinTrait("debug", false, false, types.Int),
+	"Clone": builtinTrait("clone", false, true, nil),
+}
+
+// deriveFns maps builtin trait to the name of its func
+var deriveFns = map[string]string{
+	"Eq":    "eq",
+	"Ord":   "cmp",
+	"Hash":  "hash",
+	"Debug": "debug",
+	"Clone": "clone",
+}
+
+func builtinTrait(fnName string, selfParam, selfRet bool, ret types.ValType) *types.Trait {
+	types.TpUidCounter++
+	tt := &types.Trait{
+		Uid:  types.TpUidCounter,
+		Keys: []string{fnName},
+	}
+	params := []types.ValType{tt}
+	if selfParam {
+		params = append(params, tt)
+	}
+	if selfRet {
+		ret = tt
+	}
+	types.TpUidCounter++
+	tt.Fns = []*types.Func{{
+		Uid:    types.TpUidCounter,
+		Params: params,
+		Ret:    ret,
+	}}
+	return tt
+}
+
+// emitDerive synthesizes methods of derived traits from the shape of declared record or enum. Each method body is
+// a single structural instruction, which codegen expands to a generated function walking the type.
+func (e *Emitter) emitDerive(decl *ast.TypeDecl) {
+	name := decl.Ident.Name
+	tp := e.env.Types[name]
+	switch t := tp.(type) {
+	case *types.Rec:
+		if len(t.TpVars) > 0 {
+			panic(errors.NewErrorWithTk(errors.TYPE_DERIVE_ILLEGAL, "generic type cannot derive: "+name, decl.Token))
+		}
+	case *types.Enum:
+		if len(t.TpVars) > 0 {
+			panic(errors.NewErrorWithTk(errors.TYPE_DERIVE_ILLEGAL, "generic type cannot derive: "+name, decl.Token))
+		}
+	default:
+		panic(errors.NewErrorWithTk(errors.TYPE_DERIVE_ILLEGAL, "only record and enum can derive: "+name, decl.Token))
+	}
+
+	for _, d := range decl.Derives {
+		if _, ok := deriveTraits[d.Name]; !ok {
+			panic(errors.NewErrorWithTk(errors.TYPE_DERIVE_ILLEGAL, "trait is not derivable: "+d.Name, decl.Token))
+		}
+		if err := types.Derivable(tp, d.Name == "Ord"); err != nil {
+			panic(err)
+		}
+		e.module.Funcs = append(e.module.Funcs, e.emitDerivedFunc(name, tp, d.Name))
+	}
+}
+
+// emitDerivedFunc emits method `<type>$<fn>` of derived trait and registers it to impls of tp
+func (e *Emitter) emitDerivedFunc(tpName string, tp types.ValType, trait string) *ir.Func {
+	origScope := e.scope
+	e.scope = NewScope()
+	defer func() {
+		e.scope = origScope
+	}()
+
+	fnName := deriveFns[trait]
+	name := tpName + "$" + fnName
+	impl := tp.Impls()
+	if _, ok := impl.Fns[fnName]; ok {
+		panic(errors.NewError(errors.TYPE_DERIVE_ILLEGAL, "method derived twice: "+name))
+	}
+
+	self := e.genID()
+	e.env.Defs[self] = tp
+	params := []string{self}
+	paramTps := []types.ValType{tp}
+	blk := ir.NewBlock(&e.scope.blockId, name)
+	e.scope.blk = blk
+
+	var val ir.Val
+	switch trait {
+	case "Eq", "Ord":
+		other := e.genID()
+		e.env.Defs[other] = tp
+		params = append(params, other)
+		paramTps = append(paramTps, tp)
+		op := ir.EQ
+		if trait == "Ord" {
+			op = ir.CMP
+		}
+		val = &ir.StructCmp{
+			Op:    op,
+			Tp:    tp,
+			Left:  self,
+			Right: other,
+		}
+	case "Hash":
+		val = &ir.StructHash{Tp: tp, Target: self}
+	case "Debug":
+		val = &ir.StructDebug{Tp: tp, Target: self}
+	case "Clone":
+		val = &ir.StructClone{Tp: tp, Target: self}
+	}
+	ret := e.instr(val, e.genID(), val.Kind()).Type()
+	e.insertReturn(blk, ret)
+
+	types.TpUidCounter++
+	funTp := &types.Func{
+		Uid:    types.TpUidCounter,
+		Params: paramTps,
+		Ret:    ret,
+	}
+	impl.Prefix = tpName
+	impl.Fns[fnName] = funTp
+
+	maker := ir.NewDominatorMaker(blk, e.debug, params...)
+	defs := maker.Lift(e.env.Defs)
+	return &ir.Func{
+		Params: maker.LiftParams,
+		Body:   blk,
+		Tp:     funTp,
+		Defs:   defs,
+	}
+}
@@ -0,0 +1,521 @@
+package semantics
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/kingfolk/capybara/ast"
+	"github.com/kingfolk/capybara/errors"
+	"github.com/kingfolk/capybara/ir"
+	"github.com/kingfolk/capybara/token"
+	"github.com/kingfolk/capybara/types"
+)
+
+// lift is the state of emitting code of handle as a func of its own, which are the handled body and the dispatch
+// of operations. Var of the enclosing scope used by the code is captured on its first use as a param of the func, and
+// the handle passes the var as arg.
+type lift struct {
+	outer *Scope
+	// params idents of captured params of the func
+	params []string
+	// args idents of captured vars in the enclosing scope, in the order of params
+	args []string
+	// captured maps ident in the enclosing scope to its param
+	captured map[string]string
+}
+
+// dispatch is the func running the fiber of a handle until its body returns. It performs the clause of every
+// operation the fiber suspends in, and continuation of the operation runs the fiber by calling dispatch again.
+type dispatch struct {
+	name  string
+	fiber string
+	// tp type of the value handle gives
+	tp types.ValType
+	// calls by continuations, whose args are filled once captures of dispatch are known
+	calls []*ir.StaticCall
+}
+
+// cont is the continuation bound by the last param of operation clause. It can only be called, by the value the
+// operation returns.
+type cont struct {
+	d   *dispatch
+	ret types.ValType
+}
+
+// emitEffectType emits `effect{ ops }`. Operation is declared like trait func, whose return type defaults to unit.
+// Args and returns of operation cross the stack of fiber boxed, so type params are not supported.
+func (e *Emitter) emitEffectType(n *ast.CtorType) *types.Effect {
+	if len(n.TpParams) > 0 {
+		panic(errors.NewErrorWithTk(errors.TYPE_EFFECT_ILLEGAL, "generic effect is not supported", n.StartToken))
+	}
+	types.TpUidCounter++
+	eff := &types.Effect{
+		Uid: types.TpUidCounter,
+	}
+	for _, p := range n.ParamTypes {
+		op, ok := p.(ast.Param)
+		if !ok {
+			panic(errors.NewErrorWithTk(errors.TYPE_EFFECT_ILLEGAL, "effect can only declare operations", n.StartToken))
+		}
+		name := op.Ident.Name
+		fnTp, ok := op.Type.(*ast.FuncType)
+		if !ok {
+			panic(errors.NewErrorWithTk(errors.TYPE_EFFECT_ILLEGAL, "operation "+name+" cannot have body", op.Token))
+		}
+		if len(fnTp.TpParams) > 0 {
+			panic(errors.NewErrorWithTk(errors.TYPE_EFFECT_ILLEGAL, "operation "+name+" cannot have type parameter", op.Token))
+		}
+		if name == "return" {
+			panic(errors.NewErrorWithTk(errors.TYPE_EFFECT_ILLEGAL, "operation cannot be named return, which is the return clause of handle", op.Token))
+		}
+		if eff.KeyIndex(name) >= 0 {
+			panic(errors.NewErrorWithTk(errors.TYPE_EFFECT_ILLEGAL, "operation "+name+" redeclared", op.Token))
+		}
+		var params []types.ValType
+		for _, param := range fnTp.Params {
+			params = append(params, e.emitType(param.Type))
+		}
+		var ret types.ValType = types.Unit
+		if fnTp.RetType != nil {
+			ret = e.emitType(fnTp.RetType)
+		}
+		types.TpUidCounter++
+		fn := &types.Func{
+			Uid:    types.TpUidCounter,
+			Params: params,
+			Ret:    ret,
+		}
+		if types.HasTpVar(fn) {
+			panic(errors.NewErrorWithTk(errors.TYPE_EFFECT_ILLEGAL, "operation "+name+" refers to undefined type", op.Token))
+		}
+		eff.Keys = append(eff.Keys, name)
+		eff.Ops = append(eff.Ops, fn)
+	}
+	return eff
+}
+
+// emitEffectRow resolves effect row `with e1, e2` of func
+func (e *Emitter) emitEffectRow(syms []*ast.Symbol, tk *token.Token) []*types.Effect {
+	var row []*types.Effect
+	for _, sym := range syms {
+		eff, ok := e.env.Types[sym.Name].(*types.Effect)
+		if !ok {
+			panic(errors.NewErrorWithTk(errors.TYPE_EFFECT_ILLEGAL, "effect not found: "+sym.Name, tk))
+		}
+		if types.HasEffect(row, eff) {
+			panic(errors.NewErrorWithTk(errors.TYPE_EFFECT_ILLEGAL, "effect "+sym.Name+" listed twice", tk))
+		}
+		row = append(row, eff)
+	}
+	return row
+}
+
+// checkEffects panics if call to fname performs effects out of the row of current code
+func (e *Emitter) checkEffects(tFun *types.Func, fname string) {
+	for _, eff := range tFun.Effects {
+		if !types.HasEffect(e.scope.effects, eff) {
+			panic(errors.NewError(errors.TYPE_EFFECT_UNHANDLED, "call to "+fname+" performs effect "+eff.String()+", which is neither handled nor in effect row"))
+		}
+	}
+}
+
+// resolveEffect tells if node is operation call like `state.get()`
+func (e *Emitter) resolveEffect(node *ast.DotAcs) (*types.Effect, bool) {
+	v, ok := node.Expr.(*ast.VarRef)
+	if !ok {
+		return nil, false
+	}
+	eff, ok := e.env.Types[v.Symbol.Name].(*types.Effect)
+	return eff, ok
+}
+
+// emitPerformInsn emits operation call of effect eff
+func (e *Emitter) emitPerformInsn(eff *types.Effect, node *ast.DotAcs) *ir.Instr {
+	ap, ok := node.Dot.(*ast.Apply)
+	if !ok {
+		panic(errors.NewErrorWithTk(errors.TYPE_EFFECT_ILLEGAL, "operation of effect "+eff.String()+" can only be called", node.EndToken))
+	}
+	vr, ok := ap.Callee.(*ast.VarRef)
+	if !ok {
+		panic("unreachable. Apply after dot can only be VarRef")
+	}
+	idx := eff.KeyIndex(vr.Symbol.Name)
+	if idx < 0 {
+		panic(errors.NewErrorWithTk(errors.TYPE_EFFECT_ILLEGAL, "operation "+vr.Symbol.Name+" undefined by effect "+eff.String(), vr.Token))
+	}
+	if !types.HasEffect(e.scope.effects, eff) {
+		panic(errors.NewErrorWithTk(errors.TYPE_EFFECT_UNHANDLED, "operation "+eff.String()+"."+vr.Symbol.Name+" is performed out of handle of the effect", vr.Token))
+	}
+	op := eff.Ops[idx]
+	if len(ap.Args) != len(op.Params) {
+		panic(errors.NewErrorWithTk(errors.TYPE_PARAM_COUNT_WRONG, "call arg count not aligned", vr.Token))
+	}
+	args := make([]string, len(ap.Args))
+	for i, arg := range ap.Args {
+		args[i] = e.emitArg(e.emitInsn(arg), op.Params[i])
+	}
+	val := &ir.Perform{
+		Tp:     op.Ret,
+		Effect: eff,
+		Op:     idx,
+		Args:   args,
+	}
+	return e.instr(val, e.genID(), ir.CallKind)
+}
+
+// emitArg converts arg to be passed as value of tp, which is not a type param
+func (e *Emitter) emitArg(arg *ir.Instr, tp types.ValType) string {
+	ident, _ := e.emitCoerce(arg.Ident, tp)
+	if err := types.TypeCompatible(tp, e.env.GetDefTrusted(ident)); err != nil {
+		panic(err)
+	}
+	ident, _ = e.emitBoxTrait(ident, tp)
+	return ident
+}
+
+// enterLift starts emitting code lifted to a func of its own, which may perform effects of row. The returned func
+// goes back to the enclosing scope
+func (e *Emitter) enterLift(row []*types.Effect) func() {
+	outer := e.scope
+	e.scope = NewScope()
+	for k := range e.globals {
+		e.scope.vars.names[k] = k
+	}
+	e.scope.effects = row
+	e.scope.lift = &lift{
+		outer:    outer,
+		captured: map[string]string{},
+	}
+	return func() {
+		e.scope = outer
+	}
+}
+
+// lookupVar finds ident of var name like VarScope.Lookup. In lifted code, var of enclosing scope is captured.
+func (e *Emitter) lookupVar(name string) (string, bool) {
+	return e.capture(e.scope, name)
+}
+
+// capture finds ident of var name in scope s, or captures it from the enclosing scope if s is lifted. Mutable var is
+// captured by reference to it, so that mutation by either side is seen by the other. Such param is read and written
+// through the reference, see derefs.
+func (e *Emitter) capture(s *Scope, name string) (string, bool) {
+	if ident, ok := s.vars.Lookup(name); ok {
+		return ident, true
+	}
+	if s.lift == nil {
+		return "", false
+	}
+	l := s.lift
+	arg, ok := e.capture(l.outer, name)
+	if !ok {
+		return "", false
+	}
+	if e.conts[arg] != nil {
+		panic(errors.NewError(errors.TYPE_EFFECT_ILLEGAL, "continuation "+name+" cannot be used by nested handle"))
+	}
+	if param, ok := l.captured[arg]; ok {
+		return param, true
+	}
+	param := e.genID()
+	tp := e.env.GetDefTrusted(arg)
+	code, immutable := e.immutables[arg]
+	switch {
+	case e.derefs[arg]:
+		e.derefs[param] = true
+	case immutable:
+		e.immutables[param] = code
+	default:
+		reserved := e.scope
+		e.scope = l.outer
+		addr := e.rvalInstr(&ir.Addr{
+			Tp:     refType(tp, false, nil),
+			Target: arg,
+		})
+		e.scope = reserved
+		arg = addr.Ident
+		tp = addr.Type()
+		e.derefs[param] = true
+	}
+	e.env.Defs[param] = tp
+	l.params = append(l.params, param)
+	l.args = append(l.args, arg)
+	l.captured[arg] = param
+	return param, true
+}
+
+// liftFunc makes func of lifted code blk with params, which returns ret
+func (e *Emitter) liftFunc(blk *ir.Block, params []string, ret types.ValType) *ir.Func {
+	paramTps := make([]types.ValType, len(params))
+	for i, p := range params {
+		paramTps[i] = e.env.GetDefTrusted(p)
+	}
+	e.checkReturns(blk, ret)
+	types.TpUidCounter++
+	tp := &types.Func{
+		Uid:     types.TpUidCounter,
+		Params:  paramTps,
+		Ret:     ret,
+		Effects: e.scope.effects,
+	}
+	e.env.Defs[blk.Name] = tp
+	val := &ir.Func{
+		Params: params,
+		Body:   blk,
+		Tp:     tp,
+	}
+	e.insertReturn(blk, ret)
+
+	maker := ir.NewDominatorMaker(blk, e.debug, params...)
+	val.Defs = maker.Lift(e.env.Defs)
+	val.Params = maker.LiftParams
+	e.module.Funcs = append(e.module.Funcs, val)
+	return val
+}
+
+// resolveHandled finds the effect handled by clauses of n, which is the one declaring every operation of them. The
+// operation clauses are given in the order of operations, followed by the return clause, nil if absent.
+func (e *Emitter) resolveHandled(n *ast.Handle) (*types.Effect, []*ast.OpClause, *ast.OpClause) {
+	var ret *ast.OpClause
+	var ops []string
+	for _, c := range n.Clauses {
+		if c.Op.Name != "return" {
+			ops = append(ops, c.Op.Name)
+			continue
+		}
+		if ret != nil {
+			panic(errors.NewErrorWithTk(errors.TYPE_EFFECT_ILLEGAL, "return clause redeclared", c.Token))
+		}
+		if len(c.Params) != 1 {
+			panic(errors.NewErrorWithTk(errors.TYPE_EFFECT_ILLEGAL, "return clause takes exactly one param", c.Token))
+		}
+		ret = c
+	}
+	if len(ops) == 0 {
+		panic(errors.NewErrorWithTk(errors.TYPE_EFFECT_ILLEGAL, "handle has no operation clause", n.HandleToken))
+	}
+
+	var names []string
+	var eff *types.Effect
+	for name, t := range e.env.Types {
+		cand, ok := t.(*types.Effect)
+		if !ok {
+			continue
+		}
+		declares := true
+		for _, op := range ops {
+			if cand.KeyIndex(op) < 0 {
+				declares = false
+				break
+			}
+		}
+		if declares {
+			names = append(names, name)
+			eff = cand
+		}
+	}
+	switch len(names) {
+	case 0:
+		panic(errors.NewErrorWithTk(errors.TYPE_EFFECT_ILLEGAL, "no effect declares operations "+strings.Join(ops, ", "), n.HandleToken))
+	case 1:
+	default:
+		sort.Strings(names)
+		panic(errors.NewErrorWithTk(errors.TYPE_EFFECT_ILLEGAL, "handled effect is ambiguous among "+strings.Join(names, ", "), n.HandleToken))
+	}
+
+	clauses := make([]*ast.OpClause, len(eff.Keys))
+	for _, c := range n.Clauses {
+		if c == ret {
+			continue
+		}
+		idx := eff.KeyIndex(c.Op.Name)
+		if clauses[idx] != nil {
+			panic(errors.NewErrorWithTk(errors.TYPE_EFFECT_ILLEGAL, "clause of operation "+c.Op.Name+" redeclared", c.Token))
+		}
+		if len(c.Params) != len(eff.Ops[idx].Params)+1 {
+			msg := "clause of operation " + c.Op.Name + " takes " + strconv.Itoa(len(eff.Ops[idx].Params)) + " params and continuation"
+			panic(errors.NewErrorWithTk(errors.TYPE_EFFECT_ILLEGAL, msg, c.Token))
+		}
+		clauses[idx] = c
+	}
+	for i, c := range clauses {
+		if c == nil {
+			panic(errors.NewErrorWithTk(errors.TYPE_EFFECT_ILLEGAL, "handle of "+eff.String()+" missing clause of operation "+eff.Keys[i], n.HandleToken))
+		}
+	}
+	return eff, clauses, ret
+}
+
+// emitHandleInsn emits handle. The body is lifted to a func run by a fiber, which is a stack of its own. Operation
+// performed by the body suspends the fiber, and the dispatch func of the handle runs the clause of the operation.
+// Continuation of the operation sends its value to the fiber and calls dispatch again, which gives the value of the
+// rest of the handle. Thus handle is deep, and the value of handle is what dispatch finally gives.
+func (e *Emitter) emitHandleInsn(n *ast.Handle) *ir.Instr {
+	if len(e.scope.tpVars) > 0 {
+		panic(errors.NewErrorWithTk(errors.TYPE_EFFECT_ILLEGAL, "handle in generic func is not supported", n.HandleToken))
+	}
+	eff, clauses, retClause := e.resolveHandled(n)
+	e.count++
+	name := "handle$" + strconv.Itoa(e.count)
+
+	row := append(append([]*types.Effect{}, e.scope.effects...), eff)
+	leave := e.enterLift(row)
+	bodyBlk, bodyTail := e.emitBranch(name+"$body", n.Body...)
+	bodyTp := e.env.GetDefTrusted(bodyTail.Last().Ident)
+	body := e.liftFunc(bodyBlk, e.scope.lift.params, bodyTp)
+	bodyArgs := e.scope.lift.args
+	throws := e.scope.throws
+	leave()
+	if throws && e.scope.unwind != nil {
+		// body runs on stack of its fiber, which exception does not cross
+		panic(errors.NewErrorWithTk(errors.TYPE_EFFECT_ILLEGAL, "handle body which may throw cannot be in try", n.HandleToken))
+	}
+
+	leave = e.enterLift(e.scope.effects)
+	d := &dispatch{
+		name:  name,
+		fiber: e.genID(),
+	}
+	e.env.Defs[d.fiber] = types.VoidP
+	e.immutables[d.fiber] = errors.MUTATE_IMMUTABLE_PARAM
+	entry := ir.NewBlock(&e.scope.blockId, name)
+	e.scope.blk = entry
+	st := e.instr(&ir.Resume{Fiber: d.fiber}, e.genID(), ir.CallKind)
+	zero := e.rvalInstr(ir.NewConst(types.Int, []byte("0")))
+	returned := e.rvalInstr(ir.NewBinary(ir.LT, st.Ident, zero.Ident, types.Bool))
+
+	// body returned, which is the value of handle unless return clause maps it
+	retBlk := ir.NewBlock(&e.scope.blockId, name+" return")
+	e.scope.blk = retBlk
+	leaveVars := e.enterVarScope()
+	x := e.rvalInstr(&ir.Suspended{Tp: bodyTp, Fiber: d.fiber, Idx: -1})
+	if retClause != nil {
+		e.bindClauseParam(retClause.Params[0], x.Ident)
+		for _, node := range retClause.Body {
+			e.emitInsn(node)
+		}
+	}
+	leaveVars()
+	d.tp = e.env.GetDefTrusted(e.scope.blk.Last().Ident)
+
+	clauseBlks := make([]*ir.Block, len(clauses))
+	for i, c := range clauses {
+		op := eff.Ops[i]
+		clauseBlks[i] = ir.NewBlock(&e.scope.blockId, name+" "+eff.Keys[i])
+		e.scope.blk = clauseBlks[i]
+		leaveVars := e.enterVarScope()
+		for j, p := range c.Params[:len(op.Params)] {
+			arg := e.rvalInstr(&ir.Suspended{Tp: op.Params[j], Fiber: d.fiber, Idx: j})
+			e.bindClauseParam(p, arg.Ident)
+		}
+		k := e.rvalInstr(&ir.Cont{Fiber: d.fiber})
+		e.bindClauseParam(c.Params[len(op.Params)], k.Ident)
+		e.conts[k.Ident] = &cont{d: d, ret: op.Ret}
+		for _, node := range c.Body {
+			e.emitInsn(node)
+		}
+		leaveVars()
+	}
+
+	// operation is told by index the fiber is suspended in, the last one needs no test
+	next := clauseBlks[len(clauseBlks)-1]
+	for i := len(clauseBlks) - 2; i >= 0; i-- {
+		test := ir.NewBlock(&e.scope.blockId, name+" test "+eff.Keys[i])
+		e.scope.blk = test
+		c := e.rvalInstr(ir.NewConst(types.Int, []byte(strconv.Itoa(i))))
+		cond := e.rvalInstr(ir.NewBinary(ir.EQ, st.Ident, c.Ident, types.Bool))
+		linkBB(test, clauseBlks[i])
+		linkBB(test, next)
+		e.instr(&ir.If{Cond: cond.Ident, Then: clauseBlks[i], Else: next}, e.genID(), ir.IfKind)
+		next = test
+	}
+	e.scope.blk = entry
+	linkBB(entry, retBlk)
+	linkBB(entry, next)
+	e.instr(&ir.If{Cond: returned.Ident, Then: retBlk, Else: next}, e.genID(), ir.IfKind)
+
+	params := append([]string{d.fiber}, e.scope.lift.params...)
+	for _, call := range d.calls {
+		call.Args = params
+	}
+	e.liftFunc(entry, params, d.tp)
+	dispatchArgs := e.scope.lift.args
+	// clauses run on the stack of current code, so what they throw goes on from here
+	clauseThrows := e.scope.throws
+	leave()
+	e.scope.throws = e.scope.throws || clauseThrows
+
+	h := &ir.Handle{
+		Effect: eff,
+		Body:   body.Body.Name,
+		Ret:    bodyTp,
+		Args:   bodyArgs,
+	}
+	fiber := e.instr(h, e.genID(), ir.CallKind)
+	call := &ir.StaticCall{
+		Name:   name,
+		Tp:     d.tp,
+		Args:   append([]string{fiber.Ident}, dispatchArgs...),
+		Unwind: e.scope.unwind,
+	}
+	r := e.rvalInstr(call)
+	e.instr(&ir.Release{Fiber: fiber.Ident}, e.genID(), ir.CallKind)
+	return e.rvalInstr(ir.NewRef(d.tp, r.Ident))
+}
+
+// bindClauseParam binds param of clause to ident, which is immutable
+func (e *Emitter) bindClauseParam(sym *ast.Symbol, ident string) {
+	if sym.IsIgnored() {
+		return
+	}
+	e.registerDecl(sym.Name, ident)
+	e.immutables[ident] = errors.MUTATE_IMMUTABLE_PARAM
+}
+
+// emitResumeInsn emits call to continuation c bound to ident. The fiber is resumed by the value, and what the rest of
+// handle gives is the value of the call.
+func (e *Emitter) emitResumeInsn(c *cont, ident string, node *ast.Apply) *ir.Instr {
+	ref := node.Callee.(*ast.VarRef)
+	var value string
+	switch {
+	case len(node.Args) == 1:
+		value = e.emitArg(e.emitInsn(node.Args[0]), c.ret)
+	case len(node.Args) == 0 && c.ret == types.Unit:
+		value = e.rvalInstr(ir.NewUnit()).Ident
+	default:
+		panic(errors.NewErrorWithTk(errors.TYPE_PARAM_COUNT_WRONG, "continuation "+ref.Symbol.Name+" takes one arg", ref.Token))
+	}
+	send := &ir.Send{
+		Tp:    c.ret,
+		Fiber: c.d.fiber,
+		Seq:   ident,
+		Value: value,
+	}
+	e.instr(send, e.genID(), ir.CallKind)
+	call := &ir.StaticCall{
+		Name:   c.d.name,
+		Tp:     c.d.tp,
+		Unwind: e.scope.unwind,
+	}
+	c.d.calls = append(c.d.calls, call)
+	return e.rvalInstr(call)
+}
+
+// contOf finds continuation called by name. Continuation of enclosing dispatch is not captured by nested handle,
+// since it resumes the fiber of that dispatch only.
+func (e *Emitter) contOf(name string) (*cont, string) {
+	for s := e.scope; s != nil; s = s.lift.outer {
+		if ident, ok := s.vars.Lookup(name); ok {
+			c := e.conts[ident]
+			if c != nil && s != e.scope {
+				panic(errors.NewError(errors.TYPE_EFFECT_ILLEGAL, "continuation "+name+" cannot be used by nested handle"))
+			}
+			return c, ident
+		}
+		if s.lift == nil {
+			break
+		}
+	}
+	return nil, ""
+}
@@ -3,6 +3,7 @@ package semantics
 import (
 	"fmt"
 	"runtime/debug"
+	"sort"
 	"strconv"
 
 	"github.com/kingfolk/capybara/ast"
@@ -11,12 +12,37 @@ import (
 	"github.com/kingfolk/capybara/types"
 )
 
+// Scope is the emitting state of a function, or of the root block
 type Scope struct {
-	// TODO nested scope
-	// parent *Scope
 	blockId int
-	vars    map[string]string
+	vars    *VarScope
 	blk     *ir.Block
+	// tpVars type params of the enclosing function
+	tpVars []*types.TypeVar
+	// ret declared return type of the enclosing function, nil at root
+	ret types.ValType
+	// unwind catch block of the innermost try enclosing current code, nil out of try
+	unwind *ir.Block
+	// effects effect row of current code, which are the effects it may perform
+	effects []*types.Effect
+	// lift the state of capturing vars if current code is lifted from the enclosing one, nil otherwise
+	lift *lift
+	// gen the generator whose body is being emitted, nil out of generator
+	gen *generator
+	// params maps ident of param of the enclosing function to its index
+	params map[string]int
+	// kept tells which params the enclosing function keeps past the call, see Emitter.kept
+	kept []bool
+	// throws tells current code may throw, see Emitter.throwing
+	throws bool
+}
+
+// VarScope is a lexical scope which maps variable name to its IR ident. Each block, like function body, if branch,
+// loop body and match case, opens a new VarScope linked to its parent. Inner declaration shadows the outer one with
+// a fresh ident, and becomes invisible when the block ends.
+type VarScope struct {
+	parent *VarScope
+	names  map[string]string
 }
 
 type Emitter struct {
@@ -26,6 +52,34 @@ type Emitter struct {
 	globals map[string]types.ValType
 	scope   *Scope
 	module  *ir.Module
+	// immutables maps ident of immutable binding to the error raised on its mutation
+	immutables map[string]errors.ErrorCode
+	// traitDefaults maps trait uid to its funcs having default body
+	traitDefaults map[uint64]map[string]*ast.LetRec
+	// overloads maps func name to its overload set in order of declaration
+	overloads map[string][]*overload
+	// pendingTypes maps name of record or enum declaration to it until it is emitted
+	pendingTypes map[string]*ast.TypeDecl
+	// startedTypes type declarations whose emit has begun
+	startedTypes map[*ast.TypeDecl]bool
+	// fixDecls maps name of pending declaration to the one shared by Fix referring to it
+	fixDecls map[string]*types.FixDecl
+	// stackRefs idents holding reference to a stack local of current function
+	stackRefs map[string]bool
+	// resultTp builtin generic enum result
+	resultTp *types.Enum
+	// derefs idents of params holding reference to the var they capture
+	derefs map[string]bool
+	// conts maps ident of continuation to it
+	conts map[string]*cont
+	// iterTp builtin generic trait iter
+	iterTp *types.Trait
+	// kept maps func name to which of its params it keeps past the call, e.g. pushed to a vec. Aggregate boxed as
+	// such param is copied to heap, as the stack of caller may be gone when it is read
+	kept map[string][]bool
+	// throwing funcs which may throw, by throw or by call of a throwing func in body whether in try or not. Trait
+	// call is taken as throwing, as the implementing func is not known
+	throwing map[string]bool
 }
 
 const (
@@ -34,10 +88,27 @@ const (
 
 func NewScope() *Scope {
 	return &Scope{
-		vars: map[string]string{},
+		vars: NewVarScope(nil),
 	}
 }
 
+func NewVarScope(parent *VarScope) *VarScope {
+	return &VarScope{
+		parent: parent,
+		names:  map[string]string{},
+	}
+}
+
+// Lookup finds ident of name from innermost scope to outermost
+func (s *VarScope) Lookup(name string) (string, bool) {
+	for ; s != nil; s = s.parent {
+		if ident, ok := s.names[name]; ok {
+			return ident, true
+		}
+	}
+	return "", false
+}
+
 type GlobalDef struct {
 	Name string
 	Tp   types.ValType
@@ -52,9 +123,20 @@ func EmitIR(mod *ast.AST, debugMode bool, globals ...GlobalDef) (root *ir.Module
 			Types: map[string]types.ValType{},
 			Defs:  map[string]types.ValType{},
 		},
-		globals: map[string]types.ValType{},
-		scope:   NewScope(),
-		module:  &ir.Module{},
+		globals:       map[string]types.ValType{},
+		scope:         NewScope(),
+		module:        &ir.Module{},
+		immutables:    map[string]errors.ErrorCode{},
+		traitDefaults: map[uint64]map[string]*ast.LetRec{},
+		overloads:     map[string][]*overload{},
+		pendingTypes:  map[string]*ast.TypeDecl{},
+		startedTypes:  map[*ast.TypeDecl]bool{},
+		fixDecls:      map[string]*types.FixDecl{},
+		stackRefs:     map[string]bool{},
+		derefs:        map[string]bool{},
+		conts:         map[string]*cont{},
+		kept:          map[string][]bool{},
+		throwing:      map[string]bool{},
 	}
 
 	defer func() {
@@ -71,12 +153,28 @@ func EmitIR(mod *ast.AST, debugMode bool, globals ...GlobalDef) (root *ir.Module
 	for _, g := range globals {
 		e.globals[g.Name] = g.Tp
 		e.env.Defs[g.Name] = g.Tp
-		e.scope.vars[g.Name] = g.Name
+		e.scope.vars.names[g.Name] = g.Name
 	}
 
+	for name, tt := range deriveTraits {
+		e.env.Types[name] = tt
+	}
+	for name, tt := range opTraits {
+		e.env.Types[name] = tt
+	}
+	e.declareResult()
+	e.declareIter()
+	e.emitLibs(mod)
+	e.declareTypes(mod)
+	for _, tDecl := range mod.TypeDecls {
+		if !e.startedTypes[tDecl] {
+			e.emitTypeDecl(tDecl)
+		}
+	}
 	for _, tDecl := range mod.TypeDecls {
-		tp := e.emitType(tDecl.Type)
-		e.env.Types[tDecl.Ident.Name] = tp
+		if len(tDecl.Derives) > 0 {
+			e.emitDerive(tDecl)
+		}
 	}
 
 	blk := e.emitBlock(rootBlock, mod.Root...)
@@ -127,33 +225,64 @@ func EmitIRWithGlobal(mod *ast.AST, globalVars map[string]types.ValType) (*ir.Bl
 		env: &types.Env{
 			Defs: map[string]types.ValType{},
 		},
-		scope: NewScope(),
+		scope:         NewScope(),
+		immutables:    map[string]errors.ErrorCode{},
+		traitDefaults: map[uint64]map[string]*ast.LetRec{},
+		overloads:     map[string][]*overload{},
+		stackRefs:     map[string]bool{},
+		derefs:        map[string]bool{},
+		conts:         map[string]*cont{},
+		kept:          map[string][]bool{},
+		throwing:      map[string]bool{},
 	}
 	for k, t := range globalVars {
 		e.env.Defs[k] = t
-		e.scope.vars[k] = k
+		e.scope.vars.names[k] = k
 	}
 	return e.emitBlock(rootBlock, mod.Root...), e.env
 }
 
 func (e *Emitter) emitBlock(name string, nodes ...ast.Expr) *ir.Block {
+	blk, _ := e.emitBranch(name, nodes...)
+	return blk
+}
+
+// emitBranch emits nodes in a new block like emitBlock. It gives the block control leaves nodes from as well, which
+// is another one if nodes contain control flow, so that the branch is linked to its successor from there.
+func (e *Emitter) emitBranch(name string, nodes ...ast.Expr) (blk, tail *ir.Block) {
 	reserved := e.scope.blk
+	if name != rootBlock {
+		leave := e.enterVarScope()
+		defer leave()
+	}
 	defer func() {
 		if name != rootBlock {
 			e.scope.blk = reserved
 		}
 	}()
 
-	blk := ir.NewBlock(&e.scope.blockId, name)
+	blk = ir.NewBlock(&e.scope.blockId, name)
 	e.scope.blk = blk
 	for _, node := range nodes {
 		e.emitInsn(node)
 	}
-	return blk
+	if e.scope.blk != blk && len(e.scope.blk.Ins) == 0 {
+		// block after control flow may be left empty
+		e.emitInsn(&ast.Unit{})
+	}
+	return blk, e.scope.blk
+}
+
+// enterVarScope opens a nested lexical scope. The returned func closes it
+func (e *Emitter) enterVarScope() func() {
+	e.scope.vars = NewVarScope(e.scope.vars)
+	return func() {
+		e.scope.vars = e.scope.vars.parent
+	}
 }
 
 func (e *Emitter) GetDeclVars() map[string]string {
-	return e.scope.vars
+	return e.scope.vars.names
 }
 
 func (e *Emitter) emitInsn(node ast.Expr) *ir.Instr {
@@ -169,13 +298,19 @@ func (e *Emitter) emitInsn(node ast.Expr) *ir.Instr {
 		c := ir.NewConst(types.Float, []byte(strconv.FormatFloat(n.Value, 'g', -1, 64)))
 		return e.rvalInstr(c)
 	case *ast.VarRef:
-		// TODO NESTED SCOPE
-		if ident, ok := e.scope.vars[n.Symbol.Name]; ok {
+		if ident, ok := e.lookupVar(n.Symbol.Name); ok {
+			if e.conts[ident] != nil {
+				panic(errors.NewErrorWithTk(errors.TYPE_EFFECT_ILLEGAL, "continuation "+n.Symbol.Name+" can only be called", n.Token))
+			}
 			tp := e.env.GetDefTrusted(ident)
+			if e.derefs[ident] {
+				return e.rvalInstr(&ir.Load{Tp: tp.(*types.Ref).Ele, Target: ident})
+			}
 			insn := e.rvalInstr(ir.NewRef(tp, ident))
+			e.stackRefs[insn.Ident] = e.stackRefs[ident]
 			return insn
 		}
-		panic("undefined identifiers: " + n.Symbol.Name)
+		panic(errors.NewErrorWithTk(errors.SCOPE_VAR_UNDEFINED, "undefined identifiers: "+n.Symbol.Name, n.Token))
 	case *ast.Add:
 		return e.emitArithInsn(ir.ADD, n.Left, n.Right, node)
 	case *ast.Sub:
@@ -206,8 +341,32 @@ func (e *Emitter) emitInsn(node ast.Expr) *ir.Instr {
 		return e.emitArrGetInsn(n)
 	case *ast.ArrayPut:
 		return e.emitArrPutInsn(n)
+	case *ast.RecordPut:
+		return e.emitRecPutInsn(n)
+	case *ast.AddrOf:
+		return e.emitAddrInsn(n)
+	case *ast.Deref:
+		return e.emitDerefInsn(n)
+	case *ast.DerefPut:
+		return e.emitDerefPutInsn(n)
+	case *ast.Propagate:
+		return e.emitPropagateInsn(n)
+	case *ast.Throw:
+		return e.emitThrowInsn(n)
+	case *ast.Try:
+		return e.emitTryInsn(n)
+	case *ast.Handle:
+		return e.emitHandleInsn(n)
+	case *ast.Yield:
+		return e.emitYieldInsn(n)
+	case *ast.ForIn:
+		return e.emitForInInsn(n)
+	case *ast.Range:
+		panic(errors.NewError(errors.TYPE_ITER_ILLEGAL, "range can only be iterated by for in"))
 	case *ast.RecLit:
 		return e.emitRecLitInsn(n)
+	case *ast.Tuple:
+		return e.emitTupleInsn(n)
 	case *ast.DotAcs:
 		return e.emitDotAcsInsn(n)
 	case *ast.Apply:
@@ -220,10 +379,14 @@ func (e *Emitter) emitInsn(node ast.Expr) *ir.Instr {
 		return e.emitMatchInsn(n)
 	case *ast.Let:
 		return e.emitLetInsn(n)
+	case *ast.LetTuple:
+		return e.emitLetTupleInsn(n)
 	case *ast.Mutate:
 		return e.emitMutateInsn(n)
 	case *ast.LetRec:
 		return e.emitFuncInsn(n)
+	case *ast.Impl:
+		return e.emitImplInsn(n)
 	default:
 		panic(fmt.Sprintf("unsupported instr %s: %+v", node.Name(), node))
 	}
@@ -232,6 +395,12 @@ func (e *Emitter) emitInsn(node ast.Expr) *ir.Instr {
 func (e *Emitter) emitArithInsn(op ir.OperatorKind, lhs, rhs, node ast.Expr) *ir.Instr {
 	l := e.emitInsn(lhs)
 	r := e.emitInsn(rhs)
+	if res := e.emitOperatorCall(op, l, r); res != nil {
+		return res
+	}
+	if name, ok := opTraitNames[op]; ok && l.Type().Impls() != nil {
+		panic(errors.NewError(errors.TYPE_OPERATOR_ILLEGAL, "operator "+ir.OpKindString[op]+" undefined for "+e.typeName(l.Type())+" not implementing "+name))
+	}
 	TypeCheckEqual(l.Type(), r.Type())
 	TypeCheckNumeric(l.Type())
 	TypeCheckNumeric(r.Type())
@@ -241,10 +410,47 @@ func (e *Emitter) emitArithInsn(op ir.OperatorKind, lhs, rhs, node ast.Expr) *ir
 func (e *Emitter) emitCompareInsn(op ir.OperatorKind, lhs, rhs, node ast.Expr) *ir.Instr {
 	l := e.emitInsn(lhs)
 	r := e.emitInsn(rhs)
+	if res := e.emitOperatorCall(op, l, r); res != nil {
+		return res
+	}
+	switch l.Type().Code() {
+	case types.TpRec, types.TpArr, types.TpTrait, types.TpFunc:
+		return e.emitStructCmpInsn(op, l, r)
+	case types.TpEnum:
+		if !l.Type().(*types.Enum).Simple {
+			return e.emitStructCmpInsn(op, l, r)
+		}
+	}
 	TypeCheckEqual(l.Type(), r.Type())
 	return e.rvalInstr(ir.NewBinary(op, l.Ident, r.Ident, types.Bool))
 }
 
+// emitStructCmpInsn compares compound values structurally. For array sized by a const param, the param is passed
+// along as runtime length.
+func (e *Emitter) emitStructCmpInsn(op ir.OperatorKind, l, r *ir.Instr) *ir.Instr {
+	tp := l.Type()
+	if err := types.Comparable(tp, op != ir.EQ && op != ir.NEQ); err != nil {
+		panic(err)
+	}
+	if err := types.TypeCompatible(tp, r.Type()); err != nil {
+		panic(err)
+	}
+	val := &ir.StructCmp{
+		Op:    op,
+		Tp:    tp,
+		Left:  l.Ident,
+		Right: r.Ident,
+	}
+	if arr, ok := tp.(*types.Arr); ok && arr.SizeVar != nil {
+		ident, ok := e.scope.vars.Lookup(arr.SizeVar.Name)
+		if !ok {
+			panic("unreachable. const param not found: " + arr.SizeVar.Name)
+		}
+		val.Len = ident
+	}
+	return e.rvalInstr(val)
+}
+
 func (e *Emitter) emitLogicalInsn(op ir.OperatorKind, lhs, rhs, node ast.Expr) *ir.Instr {
 	l := e.emitInsn(lhs)
 	r := e.emitInsn(rhs)
@@ -266,11 +472,10 @@ func TypeCheckNumeric(t types.ValType) {
 }
 
 func (e *Emitter) registerDecl(name, bound string) {
-	_, ok := e.scope.vars[name]
-	if ok {
-		panic("TypeError: re-declaration of " + name)
+	if _, ok := e.scope.vars.names[name]; ok {
+		panic(errors.NewError(errors.SCOPE_VAR_REDECLARED, "re-declaration of "+name+" in the same scope"))
 	}
-	e.scope.vars[name] = bound
+	e.scope.vars.names[name] = bound
 }
 
 func (e *Emitter) emitLetInsn(node *ast.Let) *ir.Instr {
@@ -283,13 +488,14 @@ func (e *Emitter) emitLetInsn(node *ast.Let) *ir.Instr {
 		return bound
 	}
 	bound := e.emitInsn(node.Bound)
-	if i, ok := bound.Val.(*ir.If); ok {
-		e.mutateIdentEndOfBlock(bound.Ident, i.Then, i.Else)
-	}
+	e.mutateIdentEndOfBlock(bound.Ident, ir.Branches(bound.Val)...)
 
 	if node.Type != nil {
-		tp := e.emitType(node.Type)
+		tp := e.emitTypeExtra(node.Type, e.scope.tpVars)
 		e.env.Defs[node.Symbol.Name] = tp
+		if _, bound1 := e.emitCoerce(bound.Ident, tp); bound1 != nil {
+			bound = bound1
+		}
 		rightTp := e.env.GetDefTrusted(bound.Ident)
 		if err := types.TypeCompatible(tp, rightTp); err != nil {
 			panic(err)
@@ -300,6 +506,46 @@ func (e *Emitter) emitLetInsn(node *ast.Let) *ir.Instr {
 		}
 	}
 	e.registerDecl(node.Symbol.Name, bound.Ident)
+	if node.Immutable() {
+		e.immutables[bound.Ident] = errors.MUTATE_IMMUTABLE_VAR
+	}
+	return bound
+}
+
+// emitLetTupleInsn destructs tuple like `let (a, b) = t`. Each symbol is bound to access of corresponding member
+func (e *Emitter) emitLetTupleInsn(node *ast.LetTuple) *ir.Instr {
+	bound := e.emitInsn(node.Bound)
+	e.mutateIdentEndOfBlock(bound.Ident, ir.Branches(bound.Val)...)
+	tp := e.env.GetDefTrusted(bound.Ident)
+	if node.Type != nil {
+		declTp := e.emitTypeExtra(node.Type, e.scope.tpVars)
+		if err := types.TypeCompatible(declTp, tp); err != nil {
+			panic(err)
+		}
+		tp = declTp
+	}
+	tRec, ok := tp.(*types.Rec)
+	if !ok || len(tRec.Keys) == 0 || tRec.Keys[0] != "0" {
+		panic(errors.NewErrorWithTk(errors.TYPE_TUPLE_DESTRUCT_ILLEGAL, "cannot destruct non tuple type "+tp.String(), node.LetToken))
+	}
+	if len(node.Symbols) != len(tRec.MemTps) {
+		panic(errors.NewErrorWithTk(errors.TYPE_TUPLE_DESTRUCT_ILLEGAL, "tuple "+tp.String()+" destructed by "+strconv.Itoa(len(node.Symbols))+" symbols", node.LetToken))
+	}
+	for i, sym := range node.Symbols {
+		if sym.IsIgnored() {
+			continue
+		}
+		val := &ir.RecAcs{
+			Tp:     unfold(tRec.MemTps[i]),
+			Target: bound.Ident,
+			Idx:    i,
+		}
+		mem := e.rvalInstr(val)
+		e.registerDecl(sym.Name, mem.Ident)
+		if node.Immutable() {
+			e.immutables[mem.Ident] = errors.MUTATE_IMMUTABLE_VAR
+		}
+	}
 	return bound
 }
 
@@ -318,10 +564,19 @@ func (e *Emitter) emitBoxTrait(target string, tp types.ValType) (string, *ir.Ins
 		return target, nil
 	}
 	targetTp := e.env.GetDefTrusted(target)
+	if tv, ok := targetTp.(*types.TypeVar); ok && tv.Lower != nil && tv.Lower.Code() == types.TpTrait {
+		// bounded type var is physically boxed as its bound
+		targetTp = tv.Lower
+	}
 	if targetTp.Code() == types.TpTrait {
-		// If right is also trait, then return instantly. Two traits reach here means they are compatible.
-		// Type compatible check should be placed before this emit.
-		return target, nil
+		// Two traits reach here means they are compatible. Type compatible check should be placed before this emit.
+		// If vtable of tp is the same as the one of right, right is used as is. Otherwise codegen slices the vtable for
+		// tp, as box of a supertrait is of another llvm type.
+		if tp.(*types.Trait).SameVtable(targetTp.(*types.Trait)) {
+			return target, nil
+		}
+	} else {
+		e.emitDefaultMethods(tp.(*types.Trait), targetTp)
 	}
 	val := &ir.BoxTrait{
 		Tp:     tp.(*types.Trait),
@@ -331,6 +586,121 @@ func (e *Emitter) emitBoxTrait(target string, tp types.ValType) (string, *ir.Ins
 	return i.Ident, i
 }
 
+// emitCoerce append projection IR if target is a record of width subtype of record tp, and stay as is otherwise. The
+// projection is a new record of the fields of tp, so it does not share mutation with target.
+func (e *Emitter) emitCoerce(target string, tp types.ValType) (string, *ir.Instr) {
+	srcTp := e.env.GetDefTrusted(target)
+	if types.WidthSubtype(tp, srcTp) != nil {
+		return target, nil
+	}
+	src, dst := srcTp.(*types.Rec), tp.(*types.Rec)
+	args := make([]string, len(dst.Keys))
+	for i, k := range dst.Keys {
+		idx := src.KeyIndex(k)
+		val := &ir.RecAcs{
+			Tp:     unfold(src.MemTps[idx]),
+			Target: target,
+			Idx:    idx,
+		}
+		args[i] = e.rvalInstr(val).Ident
+	}
+	val := &ir.RecLit{
+		Tp:   dst,
+		Args: args,
+	}
+	i := e.rvalInstr(val)
+	return i.Ident, i
+}
+
+// emitDefaultMethods gives tp the default funcs of trait tt which tp does not implement. Default body is emitted once
+// per implementor as its own method with receiver `self`, so trait funcs called via the receiver are resolved
+// statically and vtable of boxed tp is filled as usual
+func (e *Emitter) emitDefaultMethods(tt *types.Trait, tp types.ValType) {
+	impl := tp.Impls()
+	defaults := e.traitDefaults[tt.Uid]
+	if impl == nil || len(defaults) == 0 {
+		return
+	}
+	// default body relies on the rest of funcs, which has to be checked ahead
+	if err := types.TypeCompatible(tt, tp); err != nil {
+		panic(err)
+	}
+	for _, k := range tt.Keys {
+		def, ok := defaults[k]
+		if !ok {
+			continue
+		}
+		if _, ok := impl.Fns[k]; ok {
+			continue
+		}
+		if tRec, ok := tp.(*types.Rec); ok && len(tRec.TpVars) > 0 {
+			panic(errors.NewErrorWithTk(errors.TYPE_METHOD_ILLEGAL, "default func "+k+" cannot be applied to generic type", def.LetToken))
+		}
+		tpName := e.typeName(tp)
+		rcvTp := &ast.CtorType{EndToken: def.LetToken, Ctor: ast.NewSymbol(tpName)}
+		fn := *def.Func
+		fn.Rcv = &ast.Param{Token: def.LetToken, Ident: ast.NewSymbol("self"), Type: rcvTp}
+		method := &ast.LetRec{LetToken: def.LetToken, Func: &fn, Body: def.Body}
+
+		// method is emitted aside, as boxing may happen inside body of another func
+		reserved := e.scope.blk
+		e.scope.blk = &ir.Block{Name: "default " + tpName + "$" + k}
+		it := e.emitFuncInsn(method)
+		e.scope.blk = reserved
+		e.module.Funcs = append(e.module.Funcs, it.Val.(*ir.Func))
+	}
+}
+
+// methodOf finds method name of record or enum tp. Conformance is structural, so a type may call default func of a
+// trait it conforms to without being boxed as the trait or named in impl before. Such default is given to tp on
+// first call.
+func (e *Emitter) methodOf(tp types.ValType, name string) (*types.Func, bool) {
+	if fn, ok := tp.Impls().Fns[name]; ok {
+		return fn, true
+	}
+	var traits []string
+	for tName, t := range e.env.Types {
+		tt, ok := t.(*types.Trait)
+		if !ok || len(tt.TpVars) > 0 || e.traitDefaults[tt.Uid][name] == nil {
+			continue
+		}
+		if types.TypeCompatible(tt, tp) == nil {
+			traits = append(traits, tName)
+		}
+	}
+	if len(traits) == 0 {
+		return nil, false
+	}
+	sort.Strings(traits)
+	if len(traits) > 1 {
+		panic(errors.NewError(errors.TYPE_METHOD_ILLEGAL, "default func "+name+" is ambiguous among traits "+fmt.Sprint(traits)))
+	}
+	e.emitDefaultMethods(e.env.Types[traits[0]].(*types.Trait), tp)
+	fn, ok := tp.Impls().Fns[name]
+	return fn, ok
+}
+
+// typeName finds the declared name of record, enum or trait tp
+func (e *Emitter) typeName(tp types.ValType) string {
+	for name, t := range e.env.Types {
+		switch t := t.(type) {
+		case *types.Rec:
+			if r, ok := tp.(*types.Rec); ok && r.Uid == t.Uid {
+				return name
+			}
+		case *types.Enum:
+			if r, ok := tp.(*types.Enum); ok && r.Uid == t.Uid {
+				return name
+			}
+		case *types.Trait:
+			if r, ok := tp.(*types.Trait); ok && r.Uid == t.Uid {
+				return name
+			}
+		}
+	}
+	panic("unreachable. type is not declared: " + tp.String())
+}
+
 func (e *Emitter) emitUnbox(target string, tp, boxTp types.ValType) *ir.Instr {
 	unbox := &ir.Unbox{
 		Tp:     tp,
@@ -357,18 +727,31 @@ func (e *Emitter) makeBox(targetTp types.ValType, src string) (string, *ir.Box,
 
 func (e *Emitter) emitMutateInsn(node *ast.Mutate) *ir.Instr {
 	right := e.emitInsn(node.Right)
-	ident, ok := e.scope.vars[node.Ref.Symbol.Name]
+	ident, ok := e.lookupVar(node.Ref.Symbol.Name)
 	if !ok {
-		panic("TypeError: undeclared of " + node.Ref.Symbol.Name)
+		panic(errors.NewErrorWithTk(errors.SCOPE_VAR_UNDEFINED, "undeclared of "+node.Ref.Symbol.Name, node.Ref.Token))
+	}
+	if code, ok := e.immutables[ident]; ok {
+		panic(errors.NewErrorWithTk(code, "cannot assign to immutable "+node.Ref.Symbol.Name, node.Ref.Token))
 	}
 	tp := e.env.GetDefTrusted(ident)
+	if e.derefs[ident] {
+		// captured var is written through the reference to it
+		e.checkStoreEscape(ident, right.Ident, tp.(*types.Ref).Ele, node.Ref.Token)
+		val := &ir.Store{
+			Target: ident,
+			Right:  e.emitArg(right, tp.(*types.Ref).Ele),
+		}
+		return e.instr(val, e.genID(), ir.CallKind)
+	}
+	e.mutateIdentEndOfBlock(right.Ident, ir.Branches(right.Val)...)
+	if _, coerced := e.emitCoerce(right.Ident, tp); coerced != nil {
+		right = coerced
+	}
 	rightTp := e.env.GetDefTrusted(right.Ident)
 	if err := types.TypeCompatible(tp, rightTp); err != nil {
 		panic(err)
 	}
-	if i, ok := right.Val.(*ir.If); ok {
-		e.mutateIdentEndOfBlock(right.Ident, i.Then, i.Else)
-	}
 	bound, _ := e.emitBoxTrait(right.Ident, tp)
 	it := &ir.Instr{
 		Ident: ident,
@@ -376,14 +759,17 @@ func (e *Emitter) emitMutateInsn(node *ast.Mutate) *ir.Instr {
 		Val:   ir.NewRef(right.Type(), bound),
 	}
 	e.scope.blk.Ins = append(e.scope.blk.Ins, it)
+	if e.stackRefs[bound] {
+		e.stackRefs[ident] = true
+	}
 	return it
 }
 
 func (e *Emitter) emitIfInsn(n *ast.If) *ir.Instr {
 	// TODO: prev muse be bool type
 	prev := e.emitInsn(n.Cond)
-	thenBlk := e.emitBlock("if "+prev.Ident+" then", n.Then...)
-	elseBlk := e.emitBlock("if "+prev.Ident+" else", n.Else...)
+	thenBlk, thenTail := e.emitBranch("if "+prev.Ident+" then", n.Then...)
+	elseBlk, elseTail := e.emitBranch("if "+prev.Ident+" else", n.Else...)
 	linkBB(e.scope.blk, thenBlk)
 	linkBB(e.scope.blk, elseBlk)
 	val := &ir.If{
@@ -394,8 +780,8 @@ func (e *Emitter) emitIfInsn(n *ast.If) *ir.Instr {
 	i := e.instr(val, e.genID(), ir.IfKind)
 
 	e.scope.blk = ir.NewBlock(&e.scope.blockId, "if "+prev.Ident+" after")
-	linkBB(thenBlk, e.scope.blk)
-	linkBB(elseBlk, e.scope.blk)
+	linkBB(thenTail, e.scope.blk)
+	linkBB(elseTail, e.scope.blk)
 
 	return i
 }
@@ -404,7 +790,7 @@ func (e *Emitter) emitLoopInsn(n *ast.Loop) *ir.Instr {
 	origBlk := e.scope.blk
 
 	loopStartBlk := e.emitBlock("loop start")
-	loopBodyBlk := e.emitBlock("loop body", n.Body...)
+	loopBodyBlk, loopBodyTail := e.emitBranch("loop body", n.Body...)
 	afterBlk := e.emitBlock("loop after")
 
 	e.scope.blk = loopStartBlk
@@ -418,7 +804,7 @@ func (e *Emitter) emitLoopInsn(n *ast.Loop) *ir.Instr {
 	linkBB(origBlk, loopStartBlk)
 	linkBB(loopStartBlk, loopBodyBlk)
 	linkBB(loopStartBlk, afterBlk)
-	linkBB(loopBodyBlk, loopStartBlk)
+	linkBB(loopBodyTail, loopStartBlk)
 
 	e.scope.blk = afterBlk
 	return e.emitInsn(&ast.Unit{})
@@ -454,7 +840,7 @@ func (e *Emitter) emitMatchInsn(n *ast.Match) *ir.Instr {
 					panic(errors.NewError(errors.TYPE_ENUM_DESTRUCT_ILLEGAL, "enum match destruct illegal"))
 				}
 				innerAcs := &ir.RecAcs{
-					Tp:     varTp.MemTps[i],
+					Tp:     unfold(varTp.MemTps[i]),
 					Target: unboxIr.Ident,
 					Idx:    i,
 				}
@@ -472,6 +858,14 @@ func (e *Emitter) emitMatchInsn(n *ast.Match) *ir.Instr {
 	var condBlk *ir.Block = e.scope.blk
 	var hasOther bool
 	var allBlk []*ir.Block
+	// falls are blocks left when guard of a case fails, which fall through to the next case
+	var falls []*ir.Block
+	var fallTo = func(next *ir.Block) {
+		for _, f := range falls {
+			linkBB(f, next)
+		}
+		falls = nil
+	}
 	for i, c := range n.Cases {
 		switch cv := c.Cond.(type) {
 		case *ast.DotAcs:
@@ -481,14 +875,29 @@ func (e *Emitter) emitMatchInsn(n *ast.Match) *ir.Instr {
 			}
 
 			caseBlk := ir.NewBlock(&e.scope.blockId, "case-then-"+strconv.Itoa(i))
-			allBlk = append(allBlk, caseBlk)
 
 			e.scope.blk = caseBlk
-			emitThenBlock(enumTp.Tps[idx], cv, c.Body)
+			leave := e.enterVarScope()
+			var fall *ir.Block
+			if c.Guard == nil {
+				emitThenBlock(enumTp.Tps[idx], cv, c.Body)
+			} else {
+				emitThenBlock(enumTp.Tps[idx], cv, nil)
+				fall = e.emitGuard(c, "case-guard-"+strconv.Itoa(i))
+			}
+			leave()
+			if len(e.scope.blk.Ins) == 0 {
+				e.emitInsn(&ast.Unit{})
+			}
+			allBlk = append(allBlk, e.scope.blk)
 
 			ifBlk := ir.NewBlock(&e.scope.blockId, "case-if-"+strconv.Itoa(i))
 			linkBB(condBlk, ifBlk)
 			linkBB(ifBlk, caseBlk)
+			fallTo(ifBlk)
+			if fall != nil {
+				falls = append(falls, fall)
+			}
 			condBlk = ifBlk
 			if prevIf != nil {
 				prevIf.Else = ifBlk
@@ -507,9 +916,13 @@ func (e *Emitter) emitMatchInsn(n *ast.Match) *ir.Instr {
 			}
 		case *ast.VarRef:
 			if cv.Symbol.Name == "_" {
+				if c.Guard != nil {
+					panic(errors.NewErrorWithTk(errors.TYPE_ENUM_OTHER_ILLEGAL, "case _ cannot have guard", c.StartToken))
+				}
 				hasOther = true
-				otherBlk := e.emitBlock("case-other", c.Body...)
-				allBlk = append(allBlk, otherBlk)
+				otherBlk, otherTail := e.emitBranch("case-other", c.Body...)
+				fallTo(otherBlk)
+				allBlk = append(allBlk, otherTail)
 				linkBB(e.scope.blk, otherBlk)
 				if prevIf != nil {
 					prevIf.Else = otherBlk
@@ -533,11 +946,40 @@ func (e *Emitter) emitMatchInsn(n *ast.Match) *ir.Instr {
 	return firstIf
 }
 
+// emitGuard emits guard of case c, after which body of c is emitted when guard holds. It gives the block left when
+// guard fails, which is to fall through to the next case.
+func (e *Emitter) emitGuard(c *ast.Case, name string) *ir.Block {
+	guard := e.emitInsn(c.Guard)
+	if guard.Type() != types.Bool {
+		panic(errors.NewErrorWithTk(errors.TYPE_INCOMPATIBLE_PRIMITIVE, "match guard must be bool", c.StartToken))
+	}
+	guardBlk := e.scope.blk
+	bodyBlk := ir.NewBlock(&e.scope.blockId, name+" then")
+	fallBlk := ir.NewBlock(&e.scope.blockId, name+" else")
+	linkBB(guardBlk, bodyBlk)
+	linkBB(guardBlk, fallBlk)
+	e.scope.blk = fallBlk
+	e.emitInsn(&ast.Unit{})
+	e.scope.blk = bodyBlk
+	for _, node := range c.Body {
+		e.emitInsn(node)
+	}
+	if len(e.scope.blk.Ins) == 0 {
+		e.emitInsn(&ast.Unit{})
+	}
+	bodyTail := e.scope.blk
+
+	e.scope.blk = guardBlk
+	e.instr(&ir.If{Cond: guard.Ident, Then: bodyBlk, Else: fallBlk}, ir.DangleIdent(), ir.IfKind)
+	e.scope.blk = bodyTail
+	return fallBlk
+}
+
 func (e *Emitter) emitFuncInsn(node *ast.LetRec) *ir.Instr {
 	origScope := e.scope
 	e.scope = NewScope()
 	for k := range e.globals {
-		e.scope.vars[k] = k
+		e.scope.vars.names[k] = k
 	}
 
 	name := node.Func.Symbol.Name
@@ -560,10 +1002,21 @@ func (e *Emitter) emitFuncInsn(node *ast.LetRec) *ir.Instr {
 		if rcvTp.Impls() == nil {
 			panic(errors.NewError(errors.TYPE_METHOD_ILLEGAL, "receiver type cannot be have method: "+tpName))
 		}
+		if _, ok := impl.Fns[fnName]; ok {
+			panic(errors.NewError(errors.TYPE_METHOD_ILLEGAL, "method redeclared: "+name))
+		}
 		defer func() {
+			if funTp == nil {
+				// emit failed before func type is built
+				return
+			}
 			impl.Fns[fnName] = funTp
-			if tRec, ok := rcvTp.(*types.Rec); ok {
-				funTp.TpVars = append(funTp.TpVars, tRec.TpVars...)
+			// type params of generic receiver follow the method's own ones, their args are taken from receiver
+			switch t := rcvTp.(type) {
+			case *types.Rec:
+				funTp.TpVars = append(funTp.TpVars, t.TpVars...)
+			case *types.Enum:
+				funTp.TpVars = append(funTp.TpVars, t.TpVars...)
 			}
 		}()
 		impl.Prefix = tpName
@@ -575,15 +1028,53 @@ func (e *Emitter) emitFuncInsn(node *ast.LetRec) *ir.Instr {
 	for i, tpParam := range node.Func.TpParams {
 		tpVars[i] = e.emitTypeVar(tpParam)
 	}
+	e.scope.tpVars = tpVars
+	// const type params are passed as leading hidden int params, so they can be read as value in body
+	for _, tpVar := range tpVars {
+		if !tpVar.Const {
+			continue
+		}
+		ident := e.genID()
+		params = append(params, ident)
+		e.env.Defs[ident] = types.Int
+		e.scope.vars.names[tpVar.Name] = ident
+		e.immutables[ident] = errors.MUTATE_IMMUTABLE_PARAM
+	}
+	e.scope.params = map[string]int{}
 	for i, param := range paramDefs {
 		paramName := param.Ident.Name
 		ident := e.genID()
 		params = append(params, ident)
+		e.scope.params[ident] = i
 		tp := e.emitTypeExtra(param.Type, tpVars)
 		paramTypes[i] = tp
 		e.env.Defs[ident] = tp
-		e.scope.vars[paramName] = ident
+		e.scope.vars.names[paramName] = ident
+		e.immutables[ident] = errors.MUTATE_IMMUTABLE_PARAM
+	}
+	if node.Func.Rcv == nil {
+		name = e.overloadName(name, tpVars, paramTypes, node.LetToken)
+	}
+	e.scope.kept = make([]bool, len(paramDefs))
+	e.kept[name] = e.scope.kept
+	types.TpUidCounter++
+	funTp = &types.Func{
+		Uid:     types.TpUidCounter,
+		Params:  paramTypes,
+		Ret:     e.emitTypeExtra(node.Func.RetType, tpVars),
+		TpVars:  tpVars,
+		Effects: e.emitEffectRow(node.Func.Effects, node.LetToken),
+	}
+	// func is defined ahead of its body, so that body may call it recursively
+	e.env.Defs[name] = funTp
+	e.scope.ret = funTp.Ret
+	e.scope.effects = funTp.Effects
+	if yields := yieldsOf(node.Func.Body, map[*ast.Yield]bool{}); len(yields) > 0 {
+		val := e.emitGeneratorFunc(name, node, params, funTp, yields)
+		e.scope = origScope
+		return e.instr(val, name, ir.FuncKind)
 	}
+
 	blkName := name
 	blk := e.emitBlock(blkName, node.Func.Body...)
 	if e.debug {
@@ -592,23 +1083,180 @@ func (e *Emitter) emitFuncInsn(node *ast.LetRec) *ir.Instr {
 		fmt.Println("--- original bb end ---")
 	}
 
-	types.TpUidCounter++
-	funTp = &types.Func{
-		Uid:    types.TpUidCounter,
-		Params: paramTypes,
-		Ret:    e.emitTypeExtra(node.Func.RetType, tpVars),
-		TpVars: tpVars,
+	e.checkReturns(blk, funTp.Ret)
+
+	val := &ir.Func{
+		Params: params,
+		Body:   blk,
+		Tp:     funTp,
+	}
+	e.insertReturn(blk, funTp.Ret)
+
+	e.throwing[name] = e.scope.throws
+	maker := ir.NewDominatorMaker(blk, e.debug, params...)
+	defs := maker.Lift(e.env.Defs)
+	val.Params = maker.LiftParams
+	val.Defs = defs
+
+	e.scope = origScope
+	return e.instr(val, name, ir.FuncKind)
+}
+
+// emitImplInsn emits methods of impl block and checks them against the trait at once. Thus a nonconforming type is
+// reported at its impl block rather than where it is used as the trait
+func (e *Emitter) emitImplInsn(node *ast.Impl) *ir.Instr {
+	tt, ok := e.env.Types[node.Trait.Name].(*types.Trait)
+	if !ok {
+		panic(errors.NewErrorWithTk(errors.TYPE_IMPL_ILLEGAL, "trait not found: "+node.Trait.Name, node.StartToken))
+	}
+	if len(tt.TpVars) > 0 {
+		panic(errors.NewErrorWithTk(errors.TYPE_IMPL_ILLEGAL, "generic trait cannot be implemented by impl block: "+node.Trait.Name, node.StartToken))
+	}
+	target, ok := e.env.Types[node.Target.Name]
+	if !ok || target.Impls() == nil {
+		panic(errors.NewErrorWithTk(errors.TYPE_IMPL_ILLEGAL, "type cannot implement trait: "+node.Target.Name, node.StartToken))
+	}
+	impl := target.Impls()
+	if impl.Traits[tt.Uid] {
+		panic(errors.NewErrorWithTk(errors.TYPE_IMPL_ILLEGAL, "trait "+node.Trait.Name+" implemented twice for "+node.Target.Name, node.StartToken))
 	}
 
+	assocs := e.bindAssocs(node, tt, impl)
+	// funcs are checked with associated types bound by this implementor
+	bound := tt
+	if len(assocs) > 0 {
+		b, err := types.Subst(tt, assocs)
+		if err != nil {
+			panic(err)
+		}
+		bound = b.(*types.Trait)
+	}
+
+	keys := map[string]int{}
+	for i, k := range tt.Keys {
+		keys[k] = i
+	}
+	methods := map[string]*ast.LetRec{}
+	var last *ir.Instr
+	for _, c := range node.Consts {
+		name := c.Ident.Name
+		if !tt.Consts[name] {
+			panic(errors.NewErrorWithTk(errors.TYPE_IMPL_ILLEGAL, "const "+name+" is not declared by trait "+node.Trait.Name, c.Token))
+		}
+		// const is a method giving the value, so that it can be reached through trait as well
+		rcvTp := &ast.CtorType{EndToken: c.Token, Ctor: node.Target}
+		def := &ast.FuncDef{
+			FuncType: ast.FuncType{Token: c.Token, RetType: c.Type},
+			Symbol:   c.Ident,
+			Rcv:      &ast.Param{Token: c.Token, Ident: ast.NewSymbol("self"), Type: rcvTp},
+			Body:     []ast.Expr{c.Value},
+		}
+		m := &ast.LetRec{LetToken: c.Token, Func: def, Body: &ast.VarRef{Token: c.Token, Symbol: c.Ident}}
+		last = e.emitFuncInsn(m)
+		methods[name] = m
+		if impl.Consts == nil {
+			impl.Consts = map[string]bool{}
+		}
+		impl.Consts[name] = true
+	}
+	for _, m := range node.Methods {
+		name := m.Func.Symbol.Name
+		if rcv, ok := m.Func.Rcv.Type.(*ast.CtorType); !ok || rcv.Ctor.Name != node.Target.Name {
+			panic(errors.NewErrorWithTk(errors.TYPE_IMPL_ILLEGAL, "receiver of "+name+" must be "+node.Target.Name, m.LetToken))
+		}
+		if _, ok := keys[name]; !ok {
+			panic(errors.NewErrorWithTk(errors.TYPE_IMPL_ILLEGAL, "fun "+name+" is not declared by trait "+node.Trait.Name, m.LetToken))
+		}
+		if tt.Consts[name] {
+			panic(errors.NewErrorWithTk(errors.TYPE_IMPL_ILLEGAL, "const "+name+" must be defined by const", m.LetToken))
+		}
+		last = e.emitFuncInsn(m)
+		methods[name] = m
+	}
+	for i, k := range tt.Keys {
+		m, ok := methods[k]
+		if !ok && tt.Defaults[k] {
+			continue
+		}
+		if !ok {
+			msg := "impl " + node.Trait.Name + " for " + node.Target.Name + " missing fun: " + k
+			super := tt.SuperOf(k)
+			if super == nil {
+				panic(errors.NewErrorWithTk(errors.TYPE_IMPL_ILLEGAL, msg, node.StartToken))
+			}
+			// func of supertrait may be implemented by its own impl block or plain method
+			fn, ok := impl.Fns[k]
+			if !ok {
+				panic(errors.NewErrorWithTk(errors.TYPE_IMPL_ILLEGAL, msg+" of supertrait "+e.typeName(super), node.StartToken))
+			}
+			if err := types.MethodCompatible(bound, i, target, fn); err != nil {
+				msg = "impl " + node.Trait.Name + " for " + node.Target.Name + " fun " + k + " not compatible: " + err.Error()
+				panic(errors.NewErrorWithTk(errors.TYPE_INCOMPATIBLE_TRAIT, msg, node.StartToken))
+			}
+			continue
+		}
+		if err := types.MethodCompatible(bound, i, target, impl.Fns[k]); err != nil {
+			msg := "impl " + node.Trait.Name + " for " + node.Target.Name + " fun " + k + " not compatible: " + err.Error()
+			panic(errors.NewErrorWithTk(errors.TYPE_INCOMPATIBLE_TRAIT, msg, m.LetToken))
+		}
+	}
+	e.emitDefaultMethods(tt, target)
+	impl.Traits[tt.Uid] = true
+
+	if last == nil {
+		return e.rvalInstr(ir.NewUnit())
+	}
+	return last
+}
+
+// bindAssocs binds associated types of trait tt for the target of impl block. An associated type inherited from
+// supertrait may be bound by impl block of the supertrait already, then it is reused.
+func (e *Emitter) bindAssocs(node *ast.Impl, tt *types.Trait, impl *types.ImplBundle) map[string]types.ValType {
+	assocs := map[string]types.ValType{}
+	for _, a := range node.Types {
+		name := a.Ident.Name
+		if tt.AssocIndex(name) < 0 {
+			panic(errors.NewErrorWithTk(errors.TYPE_IMPL_ILLEGAL, "associated type "+name+" is not declared by trait "+node.Trait.Name, a.Token))
+		}
+		if _, ok := assocs[name]; ok {
+			panic(errors.NewErrorWithTk(errors.TYPE_IMPL_ILLEGAL, "associated type "+name+" bound twice", a.Token))
+		}
+		tp := e.emitType(a.Type)
+		if prev, ok := impl.Assocs[name]; ok && (types.TypeCompatible(prev, tp) != nil || types.TypeCompatible(tp, prev) != nil) {
+			panic(errors.NewErrorWithTk(errors.TYPE_IMPL_ILLEGAL, "associated type "+name+" of "+node.Target.Name+" is already bound to "+prev.String(), a.Token))
+		}
+		assocs[name] = tp
+	}
+	for _, a := range tt.Assocs {
+		if _, ok := assocs[a.Name]; ok {
+			continue
+		}
+		prev, ok := impl.Assocs[a.Name]
+		if !ok {
+			panic(errors.NewErrorWithTk(errors.TYPE_IMPL_ILLEGAL, "impl "+node.Trait.Name+" for "+node.Target.Name+" missing associated type: "+a.Name, node.StartToken))
+		}
+		assocs[a.Name] = prev
+	}
+	if len(assocs) > 0 && impl.Assocs == nil {
+		impl.Assocs = map[string]types.ValType{}
+	}
+	for k, v := range assocs {
+		impl.Assocs[k] = v
+	}
+	return assocs
+}
+
+// checkReturns checks the value of every block control leaves func body blk from against return type ret
+func (e *Emitter) checkReturns(blk *ir.Block, ret types.ValType) {
 	stack := []*ir.Block{blk}
 	visited := map[int]bool{}
 	for len(stack) > 0 {
 		top := stack[0]
 		visited[top.Id] = true
-		if top.Dest == nil && len(top.Ins) > 0 {
+		if top.Dest == nil && len(top.Ins) > 0 && !top.Terminated() {
 			last := top.Ins[len(top.Ins)-1]
 			retTp := e.env.GetDefTrusted(last.Ident)
-			if err := types.TypeCompatible(funTp.Ret, retTp); err != nil {
+			if err := types.Subtype(ret, retTp); err != nil {
 				panic(err)
 			}
 		}
@@ -620,21 +1268,6 @@ func (e *Emitter) emitFuncInsn(node *ast.LetRec) *ir.Instr {
 			stack = append(stack, b)
 		}
 	}
-
-	val := &ir.Func{
-		Params: params,
-		Body:   blk,
-		Tp:     funTp,
-	}
-	e.insertReturn(blk, funTp.Ret)
-
-	maker := ir.NewDominatorMaker(blk, e.debug, params...)
-	defs := maker.Lift(e.env.Defs)
-	val.Params = maker.LiftParams
-	val.Defs = defs
-
-	e.scope = origScope
-	return e.instr(val, name, ir.FuncKind)
 }
 
 func (e *Emitter) insertReturn(blk *ir.Block, retTp types.ValType) {
@@ -645,9 +1278,11 @@ func (e *Emitter) insertReturn(blk *ir.Block, retTp types.ValType) {
 		top := stack[0]
 		visited[top.Id] = true
 		stack = stack[1:]
-		if len(top.Dest) == 0 {
+		if len(top.Dest) == 0 && !top.Terminated() {
 			e.scope.blk = top
 			target := top.Ins[len(top.Ins)-1].Ident
+			e.checkRefEscape(target, retTp)
+			target, _ = e.emitCoerce(target, retTp)
 			target, _ = e.emitBoxTrait(target, retTp)
 
 			ret := &ir.Ret{
@@ -671,7 +1306,20 @@ func (e *Emitter) emitArrLitInsn(node *ast.ArrayLit) *ir.Instr {
 		arg := e.emitInsn(ele)
 		args[i] = arg.Ident
 	}
-	tp := e.env.GetDefTrusted(args[0])
+	var tp types.ValType
+	if node.ElemType != nil {
+		tp = e.emitType(node.ElemType)
+		for i, arg := range args {
+			arg, _ = e.emitCoerce(arg, tp)
+			argTp := e.env.GetDefTrusted(arg)
+			if err := types.TypeCompatible(tp, argTp); err != nil {
+				panic(err)
+			}
+			args[i], _ = e.emitBoxTrait(arg, tp)
+		}
+	} else {
+		tp = e.env.GetDefTrusted(args[0])
+	}
 	val := &ir.ArrLit{
 		Tp:   tp,
 		Args: args,
@@ -679,14 +1327,27 @@ func (e *Emitter) emitArrLitInsn(node *ast.ArrayLit) *ir.Instr {
 	return e.rvalInstr(val)
 }
 
+func (e *Emitter) arrEleType(arr *ir.Instr, index *ir.Instr) types.ValType {
+	tp, ok := e.env.GetDefTrusted(arr.Ident).(*types.Arr)
+	if !ok {
+		panic(errors.NewError(errors.TYPE_ARRAY_ACS_ILLEGAL, "subscript on non array type "+arr.Type().String()))
+	}
+	if indexTp := e.env.GetDefTrusted(index.Ident); indexTp != types.Int {
+		panic(errors.NewError(errors.TYPE_ARRAY_ACS_ILLEGAL, "array index must be int, but got "+indexTp.String()))
+	}
+	return unfold(tp.Ele)
+}
+
 func (e *Emitter) emitArrGetInsn(node *ast.ApplyBracket) *ir.Instr {
 	arr := e.emitInsn(node.Expr)
 	if len(node.Args) != 1 {
 		panic("unreachable. parser should have handled more than one subscript arg")
 	}
 	index := e.emitInsn(node.Args[0])
-	tp := e.env.GetDefTrusted(arr.Ident)
-	eleTp := tp.(*types.Arr).Ele
+	if res := e.emitIndexCall(arr, index); res != nil {
+		return res
+	}
+	eleTp := e.arrEleType(arr, index)
 	val := &ir.ArrGet{
 		Tp:    eleTp,
 		Arr:   arr.Ident,
@@ -695,15 +1356,67 @@ func (e *Emitter) emitArrGetInsn(node *ast.ApplyBracket) *ir.Instr {
 	return e.rvalInstr(val)
 }
 
+// emitArrPutInsn handles `a[i] = v`. For nested subscript like `m[i][j] = v`, node.Array is itself an ApplyBracket
+// which emits as ArrGet of the inner array. Array is stored by reference, so put on the inner one mutates `m`.
 func (e *Emitter) emitArrPutInsn(node *ast.ArrayPut) *ir.Instr {
 	arr := e.emitInsn(node.Array)
 	index := e.emitInsn(node.Index)
 	right := e.emitInsn(node.Assignee)
+	eleTp := e.arrEleType(arr, index)
+	if _, coerced := e.emitCoerce(right.Ident, eleTp); coerced != nil {
+		right = coerced
+	}
+	if err := types.TypeCompatible(eleTp, e.env.GetDefTrusted(right.Ident)); err != nil {
+		panic(err)
+	}
+	bound, _ := e.emitBoxTrait(right.Ident, eleTp)
 
 	val := &ir.ArrPut{
 		Arr:   arr.Ident,
 		Index: index.Ident,
-		Right: right.Ident,
+		Right: bound,
+	}
+	return e.instr(val, e.genID(), ir.CallKind)
+}
+
+// emitRecPutInsn handles `r.k = v`. Like arrays, record is stored by reference, so for nested `a.b.c = v` the put on
+// `a.b` mutates `a`. Record reached through a type var is resolved by its lower bound.
+func (e *Emitter) emitRecPutInsn(node *ast.RecordPut) *ir.Instr {
+	target := e.emitInsn(node.Record)
+	right := e.emitInsn(node.Assignee)
+	t := e.env.GetDefTrusted(target.Ident)
+	for {
+		tv, ok := t.(*types.TypeVar)
+		if !ok || tv.Lower == nil {
+			break
+		}
+		t = tv.Lower
+	}
+	tRec, ok := t.(*types.Rec)
+	if !ok {
+		panic(errors.NewError(errors.TYPE_RECORD_ACS_ILLEGAL, "field assignment on non-record type: "+t.String()))
+	}
+	key := node.Key.Symbol.Name
+	idx := tRec.KeyIndex(key)
+	if idx == -1 {
+		panic(errors.NewError(errors.TYPE_RECORD_KEY_NOTFOUND, "record key not found: "+key))
+	}
+	if tRec.ReadOnly[key] {
+		panic(errors.NewError(errors.MUTATE_READONLY_FIELD, "cannot assign to read-only field: "+key))
+	}
+	memTp := tRec.MemTps[idx]
+	if _, coerced := e.emitCoerce(right.Ident, memTp); coerced != nil {
+		right = coerced
+	}
+	if err := types.TypeCompatible(memTp, e.env.GetDefTrusted(right.Ident)); err != nil {
+		panic(err)
+	}
+	bound, _ := e.emitBoxTrait(right.Ident, memTp)
+
+	val := &ir.RecPut{
+		Target: target.Ident,
+		Idx:    idx,
+		Right:  bound,
 	}
 	return e.instr(val, e.genID(), ir.CallKind)
 }
@@ -728,13 +1441,13 @@ func (e *Emitter) emitRecLitInsn(node *ast.RecLit) *ir.Instr {
 			panic(errors.NewError(errors.TYPE_RECORD_NOT_FULFILLED, "struct literal not fulfilled"))
 		}
 		i := e.emitInsn(arg.Type)
-		args[idx] = i.Ident
+		args[idx], _ = e.emitCoerce(i.Ident, tRec.MemTps[idx])
 		tpArg := e.env.GetDefTrusted(args[idx])
 		argTps[idx] = tpArg
 	}
 	var tpArgs []types.ValType
 	for _, tpArg := range node.TpArgs {
-		tpArgs = append(tpArgs, e.emitType(tpArg))
+		tpArgs = append(tpArgs, e.emitTypeExtra(tpArg, e.scope.tpVars))
 	}
 	tRec, err := types.TypeCheckRecLit(tRec, tpArgs, argTps)
 	if err != nil {
@@ -754,6 +1467,40 @@ func (e *Emitter) emitRecLitInsn(node *ast.RecLit) *ir.Instr {
 	return e.rvalInstr(val)
 }
 
+// emitTupleInsn emits tuple literal `(a, b)` as record literal of anonymous tuple type
+func (e *Emitter) emitTupleInsn(node *ast.Tuple) *ir.Instr {
+	args := make([]string, len(node.Elems))
+	memTps := make([]types.ValType, len(node.Elems))
+	for i, elem := range node.Elems {
+		arg := e.emitInsn(elem)
+		args[i] = arg.Ident
+		memTps[i] = e.env.GetDefTrusted(arg.Ident)
+	}
+	val := &ir.RecLit{
+		Tp:   anonTuple(memTps),
+		Args: args,
+	}
+	return e.rvalInstr(val)
+}
+
+func anonTuple(memTps []types.ValType) *types.Rec {
+	keys := make([]string, len(memTps))
+	for i := range memTps {
+		keys[i] = strconv.Itoa(i)
+	}
+	types.TpUidCounter++
+	return &types.Rec{
+		ImplBundle: types.ImplBundle{
+			Fns:    map[string]*types.Func{},
+			Traits: map[uint64]bool{},
+		},
+		Uid:    types.TpUidCounter,
+		Keys:   keys,
+		MemTps: memTps,
+		Anon:   true,
+	}
+}
+
 var EnumBox *types.Rec
 
 func init() {
@@ -806,10 +1553,13 @@ func (e *Emitter) resolveEnum(node *ast.DotAcs) (*types.Enum, int, bool) {
 func (e *Emitter) dotAcsTypeDeduct(target *ir.Instr, t types.ValType, expr, dot ast.Expr) *ir.Instr {
 	switch tp := t.(type) {
 	case *types.Rec:
+		if vr, ok := dot.(*ast.VarRef); ok && tp.Impls().Consts[vr.Symbol.Name] && tp.KeyIndex(vr.Symbol.Name) < 0 {
+			return e.emitCall(tp.Impls().Fns[vr.Symbol.Name], e.typeName(tp)+"$"+vr.Symbol.Name, []ast.Expr{expr}, tp.Substs)
+		}
 		if vr, ok := dot.(*ast.VarRef); ok {
 			idx := tp.KeyIndex(vr.Symbol.Name)
 			val := &ir.RecAcs{
-				Tp:     tp.MemTps[idx],
+				Tp:     unfold(tp.MemTps[idx]),
 				Target: target.Ident,
 				Idx:    idx,
 			}
@@ -819,32 +1569,24 @@ func (e *Emitter) dotAcsTypeDeduct(target *ir.Instr, t types.ValType, expr, dot
 			if !ok {
 				panic(errors.NewError(errors.TYPE_RECORD_ACS_ILLEGAL, "record access syntax error"))
 			}
-			var name string
-			for k, t := range e.env.Types {
-				if tRec, ok := t.(*types.Rec); ok {
-					if tRec.Uid == tp.Uid {
-						name = k
-						break
-					}
-				}
-			}
-			if name == "" {
-				panic("unreachable. ")
-			}
+			name := e.typeName(tp)
 			args := append([]ast.Expr{expr}, ap.Args...)
-			tFun, ok := tp.Impls().Fns[vr.Symbol.Name]
+			tFun, ok := e.methodOf(tp, vr.Symbol.Name)
 			if !ok {
 				panic(errors.NewError(errors.TYPE_RECORD_ACS_ILLEGAL, "illegal record access. undefined method"))
 			}
 			var tpArgs []types.ValType
 			for _, tpArg := range ap.TpArgs {
-				tpArgs = append(tpArgs, e.emitType(tpArg))
+				tpArgs = append(tpArgs, e.emitTypeExtra(tpArg, e.scope.tpVars))
 			}
 			return e.emitCall(tFun, name+"$"+vr.Symbol.Name, args, append(tpArgs, tp.Substs...))
 		} else {
 			panic(errors.NewError(errors.TYPE_RECORD_ACS_ILLEGAL, "record access syntax error"))
 		}
 	case *types.Trait:
+		if vr, ok := dot.(*ast.VarRef); ok && tp.Consts[vr.Symbol.Name] {
+			return e.emitTraitAppInsn(vr.Symbol.Name, tp, []ast.Expr{expr}, nil)
+		}
 		if _, ok := dot.(*ast.VarRef); ok {
 			panic(errors.NewError(errors.TYPE_TRAIT_ACS_ILLEGAL, "illegal trait access. missing parenthesis?"))
 		} else if ap, ok := dot.(*ast.Apply); ok {
@@ -853,11 +1595,27 @@ func (e *Emitter) dotAcsTypeDeduct(target *ir.Instr, t types.ValType, expr, dot
 				panic(errors.NewError(errors.TYPE_TRAIT_ACS_ILLEGAL, "illegal trait access. trait func call syntax error"))
 			}
 			args := append([]ast.Expr{expr}, ap.Args...)
-			return e.emitTraitAppInsn(vr.Symbol.Name, tp, args)
+			return e.emitTraitAppInsn(vr.Symbol.Name, tp, args, ap.TpArgs)
 		} else {
 			panic(errors.NewError(errors.TYPE_TRAIT_ACS_ILLEGAL, "illegal trait access. trait func call syntax error"))
 		}
 	case *types.Enum:
+		if ap, ok := dot.(*ast.Apply); ok {
+			vr, ok := ap.Callee.(*ast.VarRef)
+			if !ok {
+				panic(errors.NewError(errors.TYPE_ENUM_ELE_UNDEFINED, "enum element illegal"))
+			}
+			tFun, ok := e.methodOf(tp, vr.Symbol.Name)
+			if !ok {
+				panic(errors.NewError(errors.TYPE_ENUM_ELE_UNDEFINED, "enum method undefined: "+vr.Symbol.Name))
+			}
+			args := append([]ast.Expr{expr}, ap.Args...)
+			var tpArgs []types.ValType
+			for _, tpArg := range ap.TpArgs {
+				tpArgs = append(tpArgs, e.emitTypeExtra(tpArg, e.scope.tpVars))
+			}
+			return e.emitCall(tFun, tp.Prefix+"$"+vr.Symbol.Name, args, append(tpArgs, tp.Substs...))
+		}
 		vr, ok := dot.(*ast.VarRef)
 		if !ok {
 			panic(errors.NewError(errors.TYPE_ENUM_ELE_UNDEFINED, "enum element illegal"))
@@ -876,6 +1634,9 @@ func (e *Emitter) dotAcsTypeDeduct(target *ir.Instr, t types.ValType, expr, dot
 }
 
 func (e *Emitter) emitDotAcsInsn(node *ast.DotAcs) *ir.Instr {
+	if eff, ok := e.resolveEffect(node); ok {
+		return e.emitPerformInsn(eff, node)
+	}
 	if enumTp, idx, ok := e.resolveEnum(node); ok {
 		var op string
 		if !enumTp.Simple {
@@ -900,7 +1661,7 @@ func (e *Emitter) emitDotAcsInsn(node *ast.DotAcs) *ir.Instr {
 	return e.dotAcsTypeDeduct(target, t, node.Expr, node.Dot)
 }
 
-func (e *Emitter) emitTraitAppInsn(fnName string, t *types.Trait, argNodes []ast.Expr) *ir.Instr {
+func (e *Emitter) emitTraitAppInsn(fnName string, t *types.Trait, argNodes []ast.Expr, tpArgNodes []ast.Expr) *ir.Instr {
 	var tFun *types.Func
 	for i, k := range t.Keys {
 		if k == fnName {
@@ -914,22 +1675,137 @@ func (e *Emitter) emitTraitAppInsn(fnName string, t *types.Trait, argNodes []ast
 		panic(errors.NewError(errors.TYPE_PARAM_COUNT_WRONG, "call arg count not aligned"))
 	}
 
-	args := make([]string, len(argNodes))
-	argTps := make([]types.ValType, len(argNodes))
+	argIns := make([]*ir.Instr, len(argNodes))
 	for i, arg := range argNodes {
-		arg := e.emitInsn(arg)
+		argIns[i] = e.emitInsn(arg)
+	}
+	return e.emitTraitCallArgs(fnName, t, tFun, argIns, tpArgNodes)
+}
+
+// emitTraitCallArgs emits call to func fnName of trait t with args already emitted
+func (e *Emitter) emitTraitCallArgs(fnName string, t *types.Trait, tFun *types.Func, argIns []*ir.Instr, tpArgNodes []ast.Expr) *ir.Instr {
+	args := make([]string, len(argIns))
+	argTps := make([]types.ValType, len(argIns))
+	for i, arg := range argIns {
 		args[i] = arg.Ident
 		argTps[i] = e.env.GetDefTrusted(arg.Ident)
 	}
+	if len(t.Assocs) > 0 && types.HasAssoc(tFun) {
+		tFun = e.projectTraitFunc(fnName, t, tFun, argTps)
+	}
+	// Self arg is passed to impl unboxed, which is only sound when it is known to be of the receiver's type, that
+	// is both of the same type var.
+	for i := 1; i < len(tFun.Params); i++ {
+		if !types.IsSelf(t, tFun.Params[i]) {
+			continue
+		}
+		rcv, ok1 := argTps[0].(*types.TypeVar)
+		arg, ok2 := argTps[i].(*types.TypeVar)
+		if !ok1 || !ok2 || rcv.Name != arg.Name {
+			panic(errors.NewError(errors.TYPE_TRAIT_ACS_ILLEGAL, "Self arg of "+fnName+" must be of receiver type var"))
+		}
+	}
+	if len(tpArgNodes) != len(tFun.TpVars) {
+		panic(errors.NewError(errors.TYPE_SUBSTITUTE_NUM_MISMATCH, "invoke type arguments more or less than defined type parameters of "+fnName))
+	}
+	var substFun *types.Func
+	if len(tpArgNodes) > 0 {
+		tpArgs := make([]types.ValType, len(tpArgNodes))
+		for i, tpArg := range tpArgNodes {
+			tpArgs[i] = e.emitTypeExtra(tpArg, e.scope.tpVars)
+		}
+		substFun = e.emitTraitTpArgs(tFun, tpArgs, args, argTps)
+	}
+	retTp := tFun.Ret
+	if types.IsSelf(t, retTp) {
+		retTp = argTps[0]
+	}
 
 	val := &ir.TraitCall{
-		Name:  fnName,
-		Trait: t,
-		Tp:    tFun.Ret,
-		Args:  args,
+		Name:   fnName,
+		Trait:  t,
+		Tp:     retTp,
+		Args:   args,
+		Unwind: e.scope.unwind,
 	}
+	e.scope.throws = true
 
-	return e.rvalInstr(val)
+	fir := e.rvalInstr(val)
+	if substFun != nil && types.Mentions(tFun.Ret, tFun.TpVars) {
+		fir = e.emitUnbox(fir.Ident, substFun.Ret, tFun.Ret)
+	}
+	return fir
+}
+
+// emitTraitTpArgs substitutes type params of generic trait func tFun by tpArgs. Args passed as the type params are
+// boxed, as implementing func takes them boxed like any generic func.
+func (e *Emitter) emitTraitTpArgs(tFun *types.Func, tpArgs []types.ValType, args []string, argTps []types.ValType) *types.Func {
+	set := map[string]types.ValType{}
+	for i, tv := range tFun.TpVars {
+		set[tv.Name] = tpArgs[i]
+	}
+	params, err := types.SubstList(tFun.Params[1:], set)
+	if err != nil {
+		panic(err)
+	}
+	ret, err := types.Subst(tFun.Ret, set)
+	if err != nil {
+		panic(err)
+	}
+	for i, p := range params {
+		if !types.Mentions(tFun.Params[i+1], tFun.TpVars) {
+			continue
+		}
+		if err := types.TypeCompatible(p, argTps[i+1]); err != nil {
+			panic(err)
+		}
+		var box *ir.Box
+		args[i+1], box, _ = e.makeBox(tFun.Params[i+1], args[i+1])
+		if box != nil {
+			box.Tp = p
+		}
+	}
+	return &types.Func{
+		Uid:    tFun.Uid,
+		Params: append([]types.ValType{tFun.Params[0]}, params...),
+		Ret:    ret,
+	}
+}
+
+// projectTraitFunc substitutes associated types in func fnName of trait t by projections from the receiver like
+// `T.item`. Associated type is only known by its name when the receiver is of type var, as two values of the same
+// trait may bind it differently.
+func (e *Emitter) projectTraitFunc(fnName string, t *types.Trait, tFun *types.Func, argTps []types.ValType) *types.Func {
+	rcv, ok := argTps[0].(*types.TypeVar)
+	if !ok {
+		panic(errors.NewError(errors.TYPE_ASSOC_ILLEGAL, "fun "+fnName+" using associated type must be called on receiver of type var"))
+	}
+	set := map[string]types.ValType{}
+	for _, a := range t.Assocs {
+		set[a.Name] = &types.TypeVar{Name: rcv.Name + "." + a.Name, Proj: rcv, Key: a.Name}
+	}
+	params, err := types.SubstList(tFun.Params[1:], set)
+	if err != nil {
+		panic(err)
+	}
+	ret, err := types.Subst(tFun.Ret, set)
+	if err != nil {
+		panic(err)
+	}
+	for i, p := range params {
+		if tv, ok := p.(*types.TypeVar); !ok || tv.Proj == nil {
+			continue
+		}
+		if err := types.TypeCompatible(p, argTps[i+1]); err != nil {
+			panic(err)
+		}
+	}
+	return &types.Func{
+		Uid:    tFun.Uid,
+		Params: append([]types.ValType{tFun.Params[0]}, params...),
+		Ret:    ret,
+		TpVars: tFun.TpVars,
+	}
 }
 
 func (e *Emitter) emitAppInsn(node *ast.Apply) *ir.Instr {
@@ -937,10 +1813,9 @@ func (e *Emitter) emitAppInsn(node *ast.Apply) *ir.Instr {
 	if !ok {
 		panic("unsupported apply instr")
 	}
-	tp, ok := e.env.Types[ref.Symbol.Name]
-	if ok {
+	// a record type applied is a literal of it. Other types, e.g. builtin trait add, do not shadow funcs of the name
+	if tr, ok := e.env.Types[ref.Symbol.Name].(*types.Rec); ok {
 		args := []*ast.Param{}
-		tr := tp.(*types.Rec)
 		if len(node.Args) != len(tr.Keys) {
 			panic(errors.NewError(errors.TYPE_RECORD_NOT_FULFILLED, "literal not fulfilled"))
 		}
@@ -958,14 +1833,23 @@ func (e *Emitter) emitAppInsn(node *ast.Apply) *ir.Instr {
 		return e.emitRecLitInsn(recLit)
 	}
 
-	t := e.env.GetDefTrusted(ref.Symbol.Name)
+	if c, ident := e.contOf(ref.Symbol.Name); c != nil {
+		return e.emitResumeInsn(c, ident, node)
+	}
+	if len(e.overloads[ref.Symbol.Name]) > 1 {
+		return e.emitOverloadCall(node)
+	}
+	t, ok := e.env.GetDef(ref.Symbol.Name)
+	if !ok {
+		panic(errors.NewErrorWithTk(errors.SCOPE_VAR_UNDEFINED, "undefined identifiers: "+ref.Symbol.Name, ref.Token))
+	}
 	tFun, ok := t.(*types.Func)
 	if !ok {
 		panic("APPLY not to func type: " + ref.Symbol.Name)
 	}
 	var tpArgs []types.ValType
 	for _, tpArg := range node.TpArgs {
-		tpArgs = append(tpArgs, e.emitType(tpArg))
+		tpArgs = append(tpArgs, e.emitTypeExtra(tpArg, e.scope.tpVars))
 	}
 
 	return e.emitCall(tFun, ref.Symbol.Name, node.Args, tpArgs)
@@ -975,15 +1859,27 @@ func (e *Emitter) emitCall(tFun *types.Func, fname string, argNodes []ast.Expr,
 	if len(argNodes) != len(tFun.Params) {
 		panic(errors.NewError(errors.TYPE_PARAM_COUNT_WRONG, "call arg count not aligned"))
 	}
+	return e.emitCallArgs(tFun, fname, len(argNodes), func(i int) *ir.Instr {
+		return e.emitInsn(argNodes[i])
+	}, tpArgs)
+}
 
-	args := make([]string, len(argNodes))
-	argTps := make([]types.ValType, len(argNodes))
-	boxes := make([]*ir.Box, len(argNodes))
-	for i, arg := range argNodes {
-		arg := e.emitInsn(arg)
+// emitCallArgs emits call to fname of n args. argAt gives the i-th arg, which is emitted right before it is boxed.
+func (e *Emitter) emitCallArgs(tFun *types.Func, fname string, n int, argAt func(i int) *ir.Instr, tpArgs []types.ValType) *ir.Instr {
+	e.checkEffects(tFun, fname)
+	args := make([]string, n)
+	argIns := make([]*ir.Instr, n)
+	argTps := make([]types.ValType, n)
+	boxes := make([]*ir.Box, n)
+	for i := 0; i < n; i++ {
+		arg := argAt(i)
+		paramTp := tFun.Params[i]
+		if _, coerced := e.emitCoerce(arg.Ident, paramTp); coerced != nil {
+			arg = coerced
+		}
+		argIns[i] = arg
 		argTp := e.env.GetDefTrusted(arg.Ident)
 		argTps[i] = argTp
-		paramTp := tFun.Params[i]
 		args[i], boxes[i], _ = e.makeBox(paramTp, arg.Ident)
 	}
 	var boxRet types.ValType
@@ -991,20 +1887,30 @@ func (e *Emitter) emitCall(tFun *types.Func, fname string, argNodes []ast.Expr,
 		boxRet = tFun.Ret
 	}
 
+	tpVars := tFun.TpVars
 	tFun, err := types.TypeCheckApp(tFun, tpArgs, argTps)
 	if err != nil {
 		panic(err)
 	}
+	args = append(e.emitConstArgs(tpVars, tpArgs), args...)
+	kept := e.kept[fname]
 	for i, box := range boxes {
 		if box != nil {
 			box.Tp = tFun.Params[i]
+			if kept != nil && kept[i] {
+				e.keepArg(box, argIns[i])
+			}
 		}
 	}
 
 	val := &ir.StaticCall{
-		Name: fname,
-		Tp:   tFun.Ret,
-		Args: args,
+		Name:   fname,
+		Tp:     tFun.Ret,
+		Args:   args,
+		Unwind: e.scope.unwind,
+	}
+	if e.throwing[fname] {
+		e.scope.throws = true
 	}
 
 	fir := e.rvalInstr(val)
@@ -1014,6 +1920,41 @@ func (e *Emitter) emitCall(tFun *types.Func, fname string, argNodes []ast.Expr,
 	return fir
 }
 
+// keepArg makes aggregate boxed by box copied to heap, as the callee keeps it. Param of type var passed on as is was
+// boxed by the caller of current function, which keeps the param as well then.
+func (e *Emitter) keepArg(box *ir.Box, arg *ir.Instr) {
+	switch box.Tp.Code() {
+	case types.TpRec, types.TpArr, types.TpEnum:
+		box.Heap = true
+	case types.TpVar:
+		if ref, ok := arg.Val.(*ir.Ref); ok {
+			if i, ok := e.scope.params[ref.Ident]; ok {
+				e.scope.kept[i] = true
+			}
+		}
+	}
+}
+
+// emitConstArgs emits values of type arguments which substitute const type params. They are the hidden leading args
+// of call.
+func (e *Emitter) emitConstArgs(tpVars []*types.TypeVar, tpArgs []types.ValType) []string {
+	var args []string
+	for i, tpVar := range tpVars {
+		if !tpVar.Const {
+			continue
+		}
+		switch tpArg := tpArgs[i].(type) {
+		case *types.ConstInt:
+			c := ir.NewConst(types.Int, []byte(strconv.Itoa(tpArg.Val)))
+			args = append(args, e.rvalInstr(c).Ident)
+		case *types.TypeVar:
+			ident, _ := e.scope.vars.Lookup(tpArg.Name)
+			args = append(args, e.rvalInstr(ir.NewRef(types.Int, ident)).Ident)
+		}
+	}
+	return args
+}
+
 func (e *Emitter) rvalInstr(val ir.Val) *ir.Instr {
 	return e.instr(val, e.genID(), ir.RValKind)
 }
@@ -1026,6 +1967,7 @@ func (e *Emitter) instr(val ir.Val, ident string, kind int) *ir.Instr {
 		Val:   val,
 	}
 	e.scope.blk.Ins = append(e.scope.blk.Ins, it)
+	e.spreadStackRefs(it)
 	return it
 }
 
@@ -1048,10 +1990,13 @@ func (e *Emitter) formDiscriminant(target *ir.Instr, tp *types.Enum) *ir.Instr {
 
 func (e *Emitter) mutateIdentEndOfBlock(ident string, bs ...*ir.Block) {
 	for _, b := range bs {
+		if b.Terminated() {
+			// e.g. err branch of `?`, whose value never reaches ident
+			continue
+		}
 		last := b.Last()
-		if i, ok := last.Val.(*ir.If); ok {
-			e.mutateIdentEndOfBlock(ident, i.Then)
-			e.mutateIdentEndOfBlock(ident, i.Else)
+		if branches := ir.Branches(last.Val); branches != nil {
+			e.mutateIdentEndOfBlock(ident, branches...)
 		} else {
 			it := &ir.Instr{
 				Ident: ident,
@@ -1059,11 +2004,21 @@ func (e *Emitter) mutateIdentEndOfBlock(ident string, bs ...*ir.Block) {
 				Val:   ir.NewRef(last.Type(), last.Ident),
 			}
 			b.Ins = append(b.Ins, it)
+			if e.stackRefs[last.Ident] {
+				// value of branch flows to ident at join
+				e.stackRefs[ident] = true
+			}
 		}
 	}
 }
 
 func (e *Emitter) emitTypeVar(p *ast.Param) *types.TypeVar {
+	if p.Const() {
+		return &types.TypeVar{Name: p.Ident.Name, Const: true}
+	}
+	if b, ok := p.Type.(*ast.Bounds); ok {
+		return &types.TypeVar{Name: p.Ident.Name, Lower: e.emitBounds(p.Ident.Name, b)}
+	}
 	var lower types.ValType
 	if p.Type != nil {
 		lower = e.emitType(p.Type)
@@ -1074,6 +2029,68 @@ func (e *Emitter) emitTypeVar(p *ast.Param) *types.TypeVar {
 	return &types.TypeVar{Name: p.Ident.Name, Lower: lower}
 }
 
+// emitBounds combines multiple bounds of type var into an anonymous trait having every bound as supertrait, so
+// that method lookup on the type var searches all bounds, and it can be passed where any one bound is expected.
+func (e *Emitter) emitBounds(name string, b *ast.Bounds) *types.Trait {
+	types.TpUidCounter++
+	trait := &types.Trait{
+		Uid: types.TpUidCounter,
+	}
+	defaults := map[string]*ast.LetRec{}
+	bySuper := map[string]string{}
+	for _, ref := range b.Refs {
+		super, ok := e.emitType(ref).(*types.Trait)
+		if !ok {
+			panic(errors.NewErrorWithTk(errors.TYPE_BOUND_LOWER_TRAIT, "lower bound must be trait: "+ref.Symbol.Name, ref.Token))
+		}
+		if len(super.TpVars) > 0 {
+			panic(errors.NewErrorWithTk(errors.TYPE_BOUND_LOWER_TRAIT, "generic trait cannot be one of multiple bounds: "+ref.Symbol.Name, ref.Token))
+		}
+		for _, s := range trait.Supers {
+			if s.Uid == super.Uid {
+				panic(errors.NewErrorWithTk(errors.TYPE_BOUND_LOWER_TRAIT, "duplicated bound "+ref.Symbol.Name+" of "+name, ref.Token))
+			}
+		}
+		trait.Supers = append(trait.Supers, super)
+		for i, k := range super.Keys {
+			fn := types.InheritFunc(super, trait, super.Fns[i])
+			if j := trait.KeyIndex(k); j >= 0 {
+				// a method declared by more than one bound is fine as long as no caller could tell them apart
+				if !types.SameSignature(trait.Fns[j], fn) {
+					panic(errors.NewErrorWithTk(errors.TYPE_BOUND_AMBIGUOUS, "ambiguous fun "+k+" of "+name+
+						", bounds "+bySuper[k]+" and "+ref.Symbol.Name+" declare it with different signatures", ref.Token))
+				}
+				continue
+			}
+			bySuper[k] = ref.Symbol.Name
+			trait.Keys = append(trait.Keys, k)
+			trait.Fns = append(trait.Fns, fn)
+			if d, ok := e.traitDefaults[super.Uid][k]; ok {
+				defaults[k] = d
+			}
+			if super.Consts[k] {
+				if trait.Consts == nil {
+					trait.Consts = map[string]bool{}
+				}
+				trait.Consts[k] = true
+			}
+		}
+		for _, a := range super.Assocs {
+			if trait.AssocIndex(a.Name) < 0 {
+				trait.Assocs = append(trait.Assocs, a)
+			}
+		}
+	}
+	if len(defaults) > 0 {
+		trait.Defaults = map[string]bool{}
+		for k := range defaults {
+			trait.Defaults[k] = true
+		}
+		e.traitDefaults[trait.Uid] = defaults
+	}
+	return trait
+}
+
 func (e *Emitter) emitType(node ast.Expr) types.ValType {
 	return e.emitTypeExtra(node, nil)
 }
@@ -1093,6 +2110,9 @@ func (e *Emitter) emitTypeExtra(node ast.Expr, tpVars []*types.TypeVar) types.Va
 		if t, ok := primitiveMap[v.Symbol.Name]; ok {
 			return t
 		}
+		if decl, ok := e.pendingTypes[v.Symbol.Name]; ok {
+			return e.emitFix(decl, nil)
+		}
 		if t, ok := e.env.Types[v.Symbol.Name]; ok {
 			return t
 		}
@@ -1105,19 +2125,49 @@ func (e *Emitter) emitTypeExtra(node ast.Expr, tpVars []*types.TypeVar) types.Va
 	}
 
 	switch n := node.(type) {
+	case *ast.Int:
+		return &types.ConstInt{Val: int(n.Value)}
+	case *ast.DotAcs:
+		owner := e.emitTypeExtra(n.Expr, tpVars)
+		t, err := types.ProjectAssoc(owner, n.Dot.(*ast.VarRef).Symbol.Name)
+		if err != nil {
+			panic(err)
+		}
+		return t
+	case *ast.TupleType:
+		var memTps []types.ValType
+		for _, elem := range n.ElemTypes {
+			memTps = append(memTps, e.emitTypeExtra(elem, tpVars))
+		}
+		return anonTuple(memTps)
 	case *ast.CtorType:
 		switch n.Ctor.Name {
 		case "array":
-			ele := e.emitType(n.ParamTypes[0])
-			size := n.ParamTypes[1].(*ast.Int).Value
-			return &types.Arr{
-				Ele:  ele,
-				Size: int(size),
+			ele := e.emitTypeExtra(n.ParamTypes[0], tpVars)
+			switch size := e.emitTypeExtra(n.ParamTypes[1], tpVars).(type) {
+			case *types.ConstInt:
+				return &types.Arr{
+					Ele:  ele,
+					Size: size.Val,
+				}
+			case *types.TypeVar:
+				if size.Const {
+					return &types.Arr{
+						Ele:     ele,
+						SizeVar: size,
+					}
+				}
 			}
+			panic(errors.NewErrorWithTk(errors.TYPE_CONST_PARAM_ILLEGAL, "array size must be int or const type parameter", n.StartToken))
+		case "ref", "ptr":
+			return e.emitRefType(n, tpVars)
+		case "effect":
+			return e.emitEffectType(n)
 		case "rec":
 			var typeVars []*types.TypeVar
 			var keys []string
 			var memTps []types.ValType
+			readOnly := map[string]bool{}
 			for _, a := range n.TpParams {
 				typeVars = append(typeVars, e.emitTypeVar(a))
 			}
@@ -1125,16 +2175,21 @@ func (e *Emitter) emitTypeExtra(node ast.Expr, tpVars []*types.TypeVar) types.Va
 				param := p.(*ast.Param)
 				keys = append(keys, param.Ident.Name)
 				memTps = append(memTps, e.emitTypeExtra(param.Type, tpVars))
+				if param.ReadOnly() {
+					readOnly[param.Ident.Name] = true
+				}
 			}
 			types.TpUidCounter++
 			return &types.Rec{
 				ImplBundle: types.ImplBundle{
-					Fns: map[string]*types.Func{},
+					Fns:    map[string]*types.Func{},
+					Traits: map[uint64]bool{},
 				},
-				Uid:    types.TpUidCounter,
-				Keys:   keys,
-				MemTps: memTps,
-				TpVars: typeVars,
+				Uid:      types.TpUidCounter,
+				Keys:     keys,
+				MemTps:   memTps,
+				TpVars:   typeVars,
+				ReadOnly: readOnly,
 			}
 		case "tup":
 			var typeVars []*types.TypeVar
@@ -1150,7 +2205,8 @@ func (e *Emitter) emitTypeExtra(node ast.Expr, tpVars []*types.TypeVar) types.Va
 			types.TpUidCounter++
 			return &types.Rec{
 				ImplBundle: types.ImplBundle{
-					Fns: map[string]*types.Func{},
+					Fns:    map[string]*types.Func{},
+					Traits: map[uint64]bool{},
 				},
 				Uid:    types.TpUidCounter,
 				Keys:   keys,
@@ -1176,6 +2232,7 @@ func (e *Emitter) emitTypeExtra(node ast.Expr, tpVars []*types.TypeVar) types.Va
 					panic(errors.NewErrorWithTk(errors.TYPE_ENUM_ELE_ILLEGAL, ctor.Ctor.Name+" not allowed", ctor.StartToken))
 				}
 				tokens = append(tokens, ctor.Ctor.Name)
+				e.emitVariantDecl(ctor)
 				tp := e.emitType(p)
 				if tv, ok := tp.(*types.TypeVar); ok && !tvMap[tv.Name] {
 					types.TpUidCounter++
@@ -1190,6 +2247,10 @@ func (e *Emitter) emitTypeExtra(node ast.Expr, tpVars []*types.TypeVar) types.Va
 			}
 			types.TpUidCounter++
 			return &types.Enum{
+				ImplBundle: types.ImplBundle{
+					Fns:    map[string]*types.Func{},
+					Traits: map[uint64]bool{},
+				},
 				Uid:    types.TpUidCounter,
 				Simple: simple,
 				Tokens: tokens,
@@ -1210,27 +2271,127 @@ func (e *Emitter) emitTypeExtra(node ast.Expr, tpVars []*types.TypeVar) types.Va
 				tpVars = append(tpVars, tpVar)
 				tpVarSet[tpVar.Name] = tpVar
 			}
+			defaults := map[string]*ast.LetRec{}
+			var supers []*types.Trait
+			var assocs []*types.TypeVar
+			consts := map[string]bool{}
+			keyIdx := map[string]int{}
+			// associated types may be used by funcs declared ahead of them
 			for _, p := range n.ParamTypes {
+				if a, ok := p.(*ast.AssocType); ok {
+					if _, ok := tpVarSet[a.Ident.Name]; ok {
+						panic(errors.NewErrorWithTk(errors.TYPE_ASSOC_ILLEGAL, "associated type "+a.Ident.Name+" redeclared", a.Token))
+					}
+					tv := &types.TypeVar{Name: a.Ident.Name, Assoc: true}
+					tpVarSet[tv.Name] = tv
+					assocs = append(assocs, tv)
+				}
+			}
+			if len(assocs) > 0 && len(tpVars) > 0 {
+				panic(errors.NewErrorWithTk(errors.TYPE_ASSOC_ILLEGAL, "generic trait cannot have associated type", n.StartToken))
+			}
+			for _, p := range n.ParamTypes {
+				if ref, ok := p.(*ast.VarRef); ok {
+					super, ok := e.env.Types[ref.Symbol.Name].(*types.Trait)
+					if !ok {
+						panic(errors.NewErrorWithTk(errors.TYPE_SUPERTRAIT_ILLEGAL, "supertrait not found: "+ref.Symbol.Name, ref.Token))
+					}
+					if len(super.TpVars) > 0 {
+						panic(errors.NewErrorWithTk(errors.TYPE_SUPERTRAIT_ILLEGAL, "generic supertrait not supported: "+ref.Symbol.Name, ref.Token))
+					}
+					supers = append(supers, super)
+					for i, k := range super.Keys {
+						fn := types.InheritFunc(super, trait, super.Fns[i])
+						if j, ok := keyIdx[k]; ok {
+							// the same func reached by more than one supertrait
+							if !types.SameSignature(fns[j], fn) {
+								panic(errors.NewErrorWithTk(errors.TYPE_SUPERTRAIT_ILLEGAL, "conflicting fun "+k+" of supertrait "+ref.Symbol.Name, ref.Token))
+							}
+							continue
+						}
+						keyIdx[k] = len(keys)
+						keys = append(keys, k)
+						fns = append(fns, fn)
+						if d, ok := e.traitDefaults[super.Uid][k]; ok {
+							defaults[k] = d
+						}
+						if super.Consts[k] {
+							consts[k] = true
+						}
+					}
+					for _, a := range super.Assocs {
+						if _, ok := tpVarSet[a.Name]; !ok {
+							tpVarSet[a.Name] = a
+							assocs = append(assocs, a)
+						}
+					}
+					continue
+				}
+				if _, ok := p.(*ast.AssocType); ok {
+					continue
+				}
+				if c, ok := p.(*ast.AssocConst); ok {
+					if _, ok := keyIdx[c.Ident.Name]; ok {
+						panic(errors.NewErrorWithTk(errors.TYPE_ASSOC_ILLEGAL, "const "+c.Ident.Name+" redeclared", c.Token))
+					}
+					keyIdx[c.Ident.Name] = len(keys)
+					keys = append(keys, c.Ident.Name)
+					consts[c.Ident.Name] = true
+					types.TpUidCounter++
+					fns = append(fns, &types.Func{
+						Uid:    types.TpUidCounter,
+						Params: []types.ValType{trait},
+						Ret:    e.emitTypeExtra(c.Type, assocs),
+					})
+					continue
+				}
 				ft := p.(ast.Param)
+				if _, ok := keyIdx[ft.Ident.Name]; ok {
+					panic(errors.NewErrorWithTk(errors.TYPE_SUPERTRAIT_ILLEGAL, "fun "+ft.Ident.Name+" redeclared, it is inherited from supertrait", ft.Token))
+				}
+				keyIdx[ft.Ident.Name] = len(keys)
 				keys = append(keys, ft.Ident.Name)
-				fnTp := ft.Type.(*ast.FuncType)
+				var fnTp *ast.FuncType
+				switch t := ft.Type.(type) {
+				case *ast.FuncType:
+					fnTp = t
+				case *ast.LetRec:
+					fnTp = &t.Func.FuncType
+					defaults[ft.Ident.Name] = t
+				default:
+					panic("unreachable. trait func must be FuncType or LetRec")
+				}
+				// own type params of func are substituted at call site, unlike those of trait
+				var ownTpVars []*types.TypeVar
+				own := map[string]bool{}
+				for _, tpParam := range fnTp.TpParams {
+					tv := e.emitTypeVar(tpParam)
+					if _, ok := tpVarSet[tv.Name]; ok {
+						panic(errors.NewErrorWithTk(errors.TYPE_METHOD_ILLEGAL, "type parameter "+tv.Name+" of fun "+ft.Ident.Name+" shadows that of trait", ft.Token))
+					}
+					if tv.Const {
+						panic(errors.NewErrorWithTk(errors.TYPE_CONST_PARAM_ILLEGAL, "trait fun "+ft.Ident.Name+" cannot have const type parameter", ft.Token))
+					}
+					ownTpVars = append(ownTpVars, tv)
+					own[tv.Name] = true
+				}
+				scope := append(append([]*types.TypeVar{}, assocs...), ownTpVars...)
 				paramTps := []types.ValType{trait}
 				for _, param := range fnTp.Params {
-					paramTp := e.emitType(param.Type)
+					paramTp := e.emitTypeExtra(param.Type, scope)
 					paramTps = append(paramTps, paramTp)
 				}
 				types.TpUidCounter++
 				funTp := &types.Func{
 					Uid:    types.TpUidCounter,
 					Params: paramTps,
-					Ret:    e.emitType(fnTp.RetType),
+					Ret:    e.emitTypeExtra(fnTp.RetType, scope),
+					TpVars: ownTpVars,
 				}
-				fnTpVars := types.CollectTpVar(funTp)
-				for _, ftv := range fnTpVars {
-					if _, ok := tpVarSet[ftv.Name]; !ok {
+				for _, ftv := range types.CollectTpVar(funTp) {
+					if _, ok := tpVarSet[ftv.Name]; !ok && !own[ftv.Name] {
 						panic(errors.NewError(errors.TYPE_TRAIT_TYPE_VAR_UNDEFINED, "undefined type parameter"))
 					}
-					funTp.TpVars = append(funTp.TpVars, ftv)
 				}
 
 				fns = append(fns, funTp)
@@ -1238,9 +2399,34 @@ func (e *Emitter) emitTypeExtra(node ast.Expr, tpVars []*types.TypeVar) types.Va
 			trait.Keys = keys
 			trait.Fns = fns
 			trait.TpVars = tpVars
+			trait.Supers = supers
+			trait.Assocs = assocs
+			if len(consts) > 0 {
+				trait.Consts = consts
+			}
+			if len(defaults) > 0 {
+				if len(tpVars) > 0 {
+					panic(errors.NewErrorWithTk(errors.TYPE_METHOD_ILLEGAL, "generic trait cannot have default func", n.StartToken))
+				}
+				if len(assocs) > 0 {
+					panic(errors.NewErrorWithTk(errors.TYPE_METHOD_ILLEGAL, "trait with associated type cannot have default func", n.StartToken))
+				}
+				trait.Defaults = map[string]bool{}
+				for k := range defaults {
+					trait.Defaults[k] = true
+				}
+				e.traitDefaults[trait.Uid] = defaults
+			}
 
 			return trait
 		default:
+			if decl, ok := e.pendingTypes[n.Ctor.Name]; ok {
+				var tpArgs []types.ValType
+				for _, p := range n.ParamTypes {
+					tpArgs = append(tpArgs, e.emitTypeExtra(p, tpVars))
+				}
+				return e.emitFix(decl, tpArgs)
+			}
 			if t, ok := e.env.Types[n.Ctor.Name]; ok {
 				var tpArgs []types.ValType
 				for _, p := range n.ParamTypes {
@@ -0,0 +1,97 @@
+package semantics
+
+import (
+	"fmt"
+	"hash/fnv"
+
+	"github.com/kingfolk/capybara/ast"
+	"github.com/kingfolk/capybara/errors"
+	"github.com/kingfolk/capybara/ir"
+	"github.com/kingfolk/capybara/token"
+	"github.com/kingfolk/capybara/types"
+)
+
+// exceptionId identifies exception type tp at runtime. Record and enum declarations are told apart by uid, since
+// declarations of the same shape are different types.
+func exceptionId(tp types.ValType) uint64 {
+	h := fnv.New64a()
+	switch t := tp.(type) {
+	case *types.Rec:
+		if !t.Anon {
+			fmt.Fprintf(h, "%d:", t.Uid)
+		}
+	case *types.Enum:
+		fmt.Fprintf(h, "%d:", t.Uid)
+	}
+	h.Write([]byte(tp.String()))
+	return h.Sum64()
+}
+
+// checkException panics if value of tp cannot be thrown. Exception is boxed when thrown, so that only int, float,
+// record and enum are supported.
+func checkException(tp types.ValType, tk *token.Token) {
+	switch tp.Code() {
+	case types.TpInt, types.TpFloat, types.TpRec, types.TpEnum:
+		if !types.HasTpVar(tp) {
+			return
+		}
+	}
+	panic(errors.NewErrorWithTk(errors.TYPE_EXCEPTION_ILLEGAL, "type "+tp.String()+" cannot be thrown", tk))
+}
+
+func (e *Emitter) emitThrowInsn(n *ast.Throw) *ir.Instr {
+	target := e.emitInsn(n.Child)
+	tp := e.env.GetDefTrusted(target.Ident)
+	checkException(tp, n.ThrowToken)
+	e.scope.throws = true
+	val := &ir.Throw{
+		Tp:     tp,
+		TypeId: exceptionId(tp),
+		Target: target.Ident,
+		Unwind: e.scope.unwind,
+	}
+	return e.instr(val, e.genID(), ir.CallKind)
+}
+
+// emitTryInsn emits try like if, whose branches are the body and the catch block. Calls and throws in body unwind to
+// the catch block, which starts with the caught exception bound to its var.
+func (e *Emitter) emitTryInsn(n *ast.Try) *ir.Instr {
+	catchTp := e.emitTypeExtra(n.CatchType, e.scope.tpVars)
+	checkException(catchTp, n.TryToken)
+
+	condBlk := e.scope.blk
+	catchBlk := ir.NewBlock(&e.scope.blockId, "try catch")
+	outer := e.scope.unwind
+	e.scope.unwind = catchBlk
+	bodyBlk, bodyTail := e.emitBranch("try body", n.Body...)
+	e.scope.unwind = outer
+
+	e.scope.blk = catchBlk
+	leave := e.enterVarScope()
+	caught := e.rvalInstr(&ir.Catch{Tp: catchTp})
+	e.registerDecl(n.Var.Name, caught.Ident)
+	for _, node := range n.Handler {
+		e.emitInsn(node)
+	}
+	leave()
+	if len(e.scope.blk.Ins) == 0 {
+		e.emitInsn(&ast.Unit{})
+	}
+	catchTail := e.scope.blk
+
+	e.scope.blk = condBlk
+	linkBB(condBlk, bodyBlk)
+	linkBB(condBlk, catchBlk)
+	val := &ir.Try{
+		Body:   bodyBlk,
+		Catch:  catchBlk,
+		TypeId: exceptionId(catchTp),
+		Unwind: outer,
+	}
+	i := e.instr(val, e.genID(), ir.IfKind)
+
+	e.scope.blk = ir.NewBlock(&e.scope.blockId, "try after")
+	linkBB(bodyTail, e.scope.blk)
+	linkBB(catchTail, e.scope.blk)
+	return i
+}
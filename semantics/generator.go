@@ -0,0 +1,509 @@
+package semantics
+
+import (
+	"sort"
+	"strconv"
+
+	"github.com/kingfolk/capybara/ast"
+	"github.com/kingfolk/capybara/errors"
+	"github.com/kingfolk/capybara/ir"
+	"github.com/kingfolk/capybara/token"
+	"github.com/kingfolk/capybara/types"
+)
+
+const (
+	frameStateIdx = 0
+	// frameDone is the state of generator whose body has returned
+	frameDone = -1
+)
+
+// generator is the state of emitting body of generator func, which is lowered to state machine of next method of its
+// frame. The frame is a record holding the state, the params and the vars living across yield. Each yield splits the
+// body at the point it resumes, and next dispatches on state to the point where the last call left off.
+type generator struct {
+	name  string
+	frame *types.Rec
+	item  types.ValType
+	// self ident of the frame param of next
+	self string
+	// valueIdx index of the member holding the element last yielded, which follows state and params
+	valueIdx int
+	// params idents of params of generator. They are stored in frame once it is made and never change
+	params map[string]bool
+	// slots maps ident of var to index of the member of frame it is stored in
+	slots map[string]int
+	// resumes blocks where body goes on after each yield, the i-th of which is resumed by state i+1
+	resumes []*ir.Block
+	// yields yields of body at statement level, see yieldsOf
+	yields map[*ast.Yield]bool
+}
+
+// slotOf gives index of the member of frame storing var ident, which is added on the first store
+func (g *generator) slotOf(ident string, tp types.ValType) int {
+	if idx, ok := g.slots[ident]; ok {
+		return idx
+	}
+	idx := len(g.frame.Keys)
+	g.frame.Keys = append(g.frame.Keys, ident)
+	g.frame.MemTps = append(g.frame.MemTps, tp)
+	g.slots[ident] = idx
+	return idx
+}
+
+// declareIter registers builtin generic trait iter to env, as if declared by
+//
+//	type iter = trait[T]{
+//	    next(): bool
+//	    value(): T
+//	}
+//
+// next advances iterator and tells if it has an element, which value gives then. for in walks iterator by them.
+func (e *Emitter) declareIter() {
+	types.TpUidCounter++
+	tt := &types.Trait{
+		Uid:    types.TpUidCounter,
+		Keys:   []string{"next", "value"},
+		TpVars: []*types.TypeVar{{Name: "T"}},
+	}
+	types.TpUidCounter++
+	next := &types.Func{
+		Uid:    types.TpUidCounter,
+		Params: []types.ValType{tt},
+		Ret:    types.Bool,
+	}
+	types.TpUidCounter++
+	value := &types.Func{
+		Uid:    types.TpUidCounter,
+		Params: []types.ValType{tt},
+		Ret:    &types.TypeVar{Name: "T"},
+	}
+	tt.Fns = []*types.Func{next, value}
+	e.iterTp = tt
+	e.env.Types["iter"] = tt
+}
+
+// iterItem gives element type T of t, if t is instance of builtin iter[T]
+func (e *Emitter) iterItem(t types.ValType) (types.ValType, bool) {
+	tt, ok := t.(*types.Trait)
+	if !ok || e.iterTp == nil || tt.Uid != e.iterTp.Uid {
+		return nil, false
+	}
+	item := tt.Fns[tt.KeyIndex("value")].Ret
+	if item.Code() == types.TpVar {
+		return nil, false
+	}
+	return item, true
+}
+
+// yieldsOf collects yields of nodes at statement level, which are those in the sequence of nodes, or of branch, loop
+// and match case in it. Value of expression cannot live across yield, so yield elsewhere, like in arg of call, is not
+// collected and is rejected once emitted. Nested funcs are not looked into, as they are generators of their own.
+func yieldsOf(nodes []ast.Expr, yields map[*ast.Yield]bool) map[*ast.Yield]bool {
+	for _, node := range nodes {
+		switch n := node.(type) {
+		case *ast.Yield:
+			yields[n] = true
+		case *ast.If:
+			yieldsOf(n.Then, yields)
+			yieldsOf(n.Else, yields)
+		case *ast.Loop:
+			yieldsOf(n.Body, yields)
+		case *ast.ForIn:
+			yieldsOf(n.Body, yields)
+		case *ast.Match:
+			for _, c := range n.Cases {
+				yieldsOf(c.Body, yields)
+			}
+		}
+	}
+	return yields
+}
+
+// emitGeneratorFunc emits func declared to return iter[T] whose body yields. The func itself only makes the frame,
+// which is what it gives in place of iter[T], and the body is lowered to next method of the frame. The frame
+// implements iter[T] by next and value methods, so it can be used wherever iter[T] is expected.
+func (e *Emitter) emitGeneratorFunc(name string, node *ast.LetRec, params []string, funTp *types.Func, yields map[*ast.Yield]bool) *ir.Func {
+	tk := node.LetToken
+	for _, p := range funTp.Params {
+		if types.HasTpVar(p) {
+			panic(errors.NewErrorWithTk(errors.TYPE_GENERATOR_ILLEGAL, "generic generator "+name+" is not supported", tk))
+		}
+	}
+	if len(funTp.TpVars) > 0 {
+		panic(errors.NewErrorWithTk(errors.TYPE_GENERATOR_ILLEGAL, "generic generator "+name+" is not supported", tk))
+	}
+	if len(funTp.Effects) > 0 {
+		panic(errors.NewErrorWithTk(errors.TYPE_GENERATOR_ILLEGAL, "generator "+name+" cannot perform effect", tk))
+	}
+	item, ok := e.iterItem(funTp.Ret)
+	if !ok {
+		panic(errors.NewErrorWithTk(errors.TYPE_GENERATOR_ILLEGAL, "generator "+name+" must return iter[T], but got "+funTp.Ret.String(), tk))
+	}
+
+	types.TpUidCounter++
+	frame := &types.Rec{
+		ImplBundle: types.ImplBundle{
+			Prefix: name + "$gen",
+			Fns:    map[string]*types.Func{},
+			Traits: map[uint64]bool{},
+		},
+		Uid:    types.TpUidCounter,
+		Keys:   []string{"$state"},
+		MemTps: []types.ValType{types.Int},
+		Frame:  true,
+	}
+	g := &generator{
+		name:   name,
+		frame:  frame,
+		item:   item,
+		self:   e.genID(),
+		params: map[string]bool{},
+		slots:  map[string]int{},
+		yields: yields,
+	}
+	for _, p := range params {
+		g.params[p] = true
+		g.slotOf(p, e.env.GetDefTrusted(p))
+	}
+	g.valueIdx = g.slotOf("$value", item)
+	e.env.Types[frame.Prefix] = frame
+	types.TpUidCounter++
+	frame.Fns["next"] = &types.Func{
+		Uid:    types.TpUidCounter,
+		Params: []types.ValType{frame},
+		Ret:    types.Bool,
+	}
+	types.TpUidCounter++
+	frame.Fns["value"] = &types.Func{
+		Uid:    types.TpUidCounter,
+		Params: []types.ValType{frame},
+		Ret:    item,
+	}
+	// call of generator gives its frame, including the recursive one in body
+	funTp.Ret = frame
+
+	e.env.Defs[g.self] = frame
+	e.immutables[g.self] = errors.MUTATE_IMMUTABLE_PARAM
+	e.scope.gen = g
+	e.emitNextFunc(g, node.Func.Body)
+	e.emitValueFunc(g)
+	return e.emitFrameFunc(g, funTp)
+}
+
+// emitNextFunc emits next method of frame of g. Params are reloaded from frame on entry, then state tells where to
+// go: 0 starts body, i resumes it after the i-th yield, and done state returns false at once.
+func (e *Emitter) emitNextFunc(g *generator, body []ast.Expr) {
+	entry := ir.NewBlock(&e.scope.blockId, g.frame.Prefix+"$next")
+	e.scope.blk = entry
+	var params []string
+	for p := range g.params {
+		params = append(params, p)
+	}
+	sortIdents(params)
+	for _, p := range params {
+		e.instr(&ir.RecAcs{Tp: e.env.GetDefTrusted(p), Target: g.self, Idx: g.slots[p]}, p, ir.RValKind)
+	}
+	st := e.rvalInstr(&ir.RecAcs{Tp: types.Int, Target: g.self, Idx: frameStateIdx})
+
+	start, tail := e.emitBranch(g.name+" start", body...)
+	if !tail.Terminated() {
+		// body returns, whose value is dropped
+		e.scope.blk = tail
+		e.emitGeneratorRet(g, frameDone, false)
+	}
+	done := ir.NewBlock(&e.scope.blockId, g.name+" done")
+	e.scope.blk = done
+	f := e.rvalInstr(ir.NewConst(types.Bool, []byte("false")))
+	e.rvalInstr(&ir.Ret{Tp: types.Bool, Target: f.Ident})
+
+	next := done
+	for i := len(g.resumes); i >= 1; i-- {
+		test := ir.NewBlock(&e.scope.blockId, g.name+" test "+strconv.Itoa(i))
+		e.scope.blk = test
+		c := e.rvalInstr(ir.NewConst(types.Int, []byte(strconv.Itoa(i))))
+		cond := e.rvalInstr(ir.NewBinary(ir.EQ, st.Ident, c.Ident, types.Bool))
+		linkBB(test, g.resumes[i-1])
+		linkBB(test, next)
+		e.instr(&ir.If{Cond: cond.Ident, Then: g.resumes[i-1], Else: next}, e.genID(), ir.IfKind)
+		next = test
+	}
+	e.scope.blk = entry
+	zero := e.rvalInstr(ir.NewConst(types.Int, []byte("0")))
+	cond := e.rvalInstr(ir.NewBinary(ir.EQ, st.Ident, zero.Ident, types.Bool))
+	linkBB(entry, start)
+	linkBB(entry, next)
+	e.instr(&ir.If{Cond: cond.Ident, Then: start, Else: next}, e.genID(), ir.IfKind)
+
+	tp := g.frame.Fns["next"]
+	e.env.Defs[entry.Name] = tp
+	val := &ir.Func{
+		Params: []string{g.self},
+		Body:   entry,
+		Tp:     tp,
+	}
+	maker := ir.NewDominatorMaker(entry, e.debug, g.self)
+	val.Defs = maker.Lift(e.env.Defs)
+	val.Params = maker.LiftParams
+	e.module.Funcs = append(e.module.Funcs, val)
+}
+
+// emitValueFunc emits value method of frame of g, which gives the element last yielded
+func (e *Emitter) emitValueFunc(g *generator) {
+	e.scope = NewScope()
+	self := e.genID()
+	e.env.Defs[self] = g.frame
+	blk := ir.NewBlock(&e.scope.blockId, g.frame.Prefix+"$value")
+	e.scope.blk = blk
+	v := e.rvalInstr(&ir.RecAcs{Tp: g.item, Target: self, Idx: g.valueIdx})
+	e.rvalInstr(&ir.Ret{Tp: g.item, Target: v.Ident})
+
+	tp := g.frame.Fns["value"]
+	e.env.Defs[blk.Name] = tp
+	val := &ir.Func{
+		Params: []string{self},
+		Body:   blk,
+		Tp:     tp,
+	}
+	maker := ir.NewDominatorMaker(blk, e.debug, self)
+	val.Defs = maker.Lift(e.env.Defs)
+	val.Params = maker.LiftParams
+	e.module.Funcs = append(e.module.Funcs, val)
+}
+
+// emitFrameFunc emits the generator func itself, which makes frame of state 0 by args. The rest members of frame are
+// written by next before they are read, so they are left out of the literal.
+func (e *Emitter) emitFrameFunc(g *generator, funTp *types.Func) *ir.Func {
+	e.scope = NewScope()
+	params := make([]string, len(funTp.Params))
+	for i, tp := range funTp.Params {
+		params[i] = e.genID()
+		e.env.Defs[params[i]] = tp
+	}
+	blk := ir.NewBlock(&e.scope.blockId, g.name)
+	e.scope.blk = blk
+	state := e.rvalInstr(ir.NewConst(types.Int, []byte("0")))
+	lit := e.rvalInstr(&ir.RecLit{
+		Tp:   g.frame,
+		Args: append([]string{state.Ident}, params...),
+	})
+	e.rvalInstr(&ir.Ret{Tp: g.frame, Target: lit.Ident})
+
+	val := &ir.Func{
+		Params: params,
+		Body:   blk,
+		Tp:     funTp,
+	}
+	maker := ir.NewDominatorMaker(blk, e.debug, params...)
+	val.Defs = maker.Lift(e.env.Defs)
+	val.Params = maker.LiftParams
+	return val
+}
+
+// emitGeneratorRet stores state to frame and returns from next with has, which tells if there is an element
+func (e *Emitter) emitGeneratorRet(g *generator, state int, has bool) {
+	c := e.rvalInstr(ir.NewConst(types.Int, []byte(strconv.Itoa(state))))
+	e.instr(&ir.RecPut{Target: g.self, Idx: frameStateIdx, Right: c.Ident}, e.genID(), ir.CallKind)
+	ret := e.rvalInstr(ir.NewConst(types.Bool, []byte(strconv.FormatBool(has))))
+	e.rvalInstr(&ir.Ret{Tp: types.Bool, Target: ret.Ident})
+}
+
+// emitYieldInsn emits `yield v`. v is stored to frame, and so are vars in scope, then next returns true. The block
+// following is where next resumes by the state, which reloads the vars from frame.
+func (e *Emitter) emitYieldInsn(n *ast.Yield) *ir.Instr {
+	g := e.scope.gen
+	if g == nil || !g.yields[n] {
+		panic(errors.NewErrorWithTk(errors.TYPE_GENERATOR_ILLEGAL, "yield can only be a statement of generator body", n.YieldToken))
+	}
+	value := e.emitArg(e.emitInsn(n.Child), g.item)
+	e.instr(&ir.RecPut{Target: g.self, Idx: g.valueIdx, Right: value}, e.genID(), ir.CallKind)
+	live := e.liveVars(g, n.YieldToken)
+	for _, ident := range live {
+		idx := g.slotOf(ident, e.env.GetDefTrusted(ident))
+		e.instr(&ir.RecPut{Target: g.self, Idx: idx, Right: ident}, e.genID(), ir.CallKind)
+	}
+	state := len(g.resumes) + 1
+	e.emitGeneratorRet(g, state, true)
+
+	resume := ir.NewBlock(&e.scope.blockId, g.name+" resume "+strconv.Itoa(state))
+	g.resumes = append(g.resumes, resume)
+	e.scope.blk = resume
+	for _, ident := range live {
+		e.instr(&ir.RecAcs{Tp: e.env.GetDefTrusted(ident), Target: g.self, Idx: g.slots[ident]}, ident, ir.RValKind)
+	}
+	return e.rvalInstr(ir.NewUnit())
+}
+
+// liveVars gives idents of vars in scope at yield, shadowed ones included, as they may be used once body resumes.
+// Params are left out, since they are reloaded on every call of next.
+func (e *Emitter) liveVars(g *generator, tk *token.Token) []string {
+	seen := map[string]bool{}
+	var idents []string
+	for s := e.scope.vars; s != nil; s = s.parent {
+		for name, ident := range s.names {
+			if seen[ident] || g.params[ident] {
+				continue
+			}
+			if _, ok := e.globals[ident]; ok {
+				continue
+			}
+			if e.stackRefs[ident] {
+				panic(errors.NewErrorWithTk(errors.TYPE_GENERATOR_ILLEGAL, "reference to local "+name+" cannot live across yield", tk))
+			}
+			seen[ident] = true
+			idents = append(idents, ident)
+		}
+	}
+	sortIdents(idents)
+	return idents
+}
+
+// sortIdents sorts idents of vars in order of declaration, so that frame is laid out the same on every emit
+func sortIdents(idents []string) {
+	sort.Slice(idents, func(i, j int) bool {
+		return ir.DestructVarId(idents[i]) < ir.DestructVarId(idents[j])
+	})
+}
+
+// emitForInInsn emits `for (x in src) { body }` as loop. Range counts from lo up to hi, array is walked by index, and
+// any other src is iterator, walked by its next and value. States of the loop are vars hidden from code, so that
+// they are kept like other vars by yield of generator.
+func (e *Emitter) emitForInInsn(n *ast.ForIn) *ir.Instr {
+	leave := e.enterVarScope()
+	defer leave()
+
+	var hasNext func() *ir.Instr
+	var element func() *ir.Instr
+	if r, ok := n.Src.(*ast.Range); ok {
+		i := e.hiddenVar("$i", e.emitIntArg(r.Lo, n.ForToken).Ident)
+		hi := e.hiddenVar("$hi", e.emitIntArg(r.Hi, n.ForToken).Ident)
+		hasNext = func() *ir.Instr {
+			return e.rvalInstr(ir.NewBinary(ir.LT, i, hi, types.Bool))
+		}
+		element = func() *ir.Instr {
+			x := e.rvalInstr(ir.NewRef(types.Int, i))
+			e.emitIncr(i)
+			return x
+		}
+	} else {
+		src := e.emitInsn(n.Src)
+		switch t := unfold(e.env.GetDefTrusted(src.Ident)).(type) {
+		case *types.Arr:
+			arr := e.hiddenVar("$arr", src.Ident)
+			size := e.hiddenVar("$len", e.arrSize(t, n.ForToken))
+			i := e.hiddenVar("$i", e.rvalInstr(ir.NewConst(types.Int, []byte("0"))).Ident)
+			hasNext = func() *ir.Instr {
+				return e.rvalInstr(ir.NewBinary(ir.LT, i, size, types.Bool))
+			}
+			element = func() *ir.Instr {
+				x := e.rvalInstr(&ir.ArrGet{Tp: unfold(t.Ele), Arr: arr, Index: i})
+				e.emitIncr(i)
+				return x
+			}
+		default:
+			it := e.hiddenVar("$iter", src.Ident)
+			hasNext = func() *ir.Instr {
+				has := e.emitIterCall(t, it, "next", n.ForToken)
+				if tp := e.env.GetDefTrusted(has.Ident); tp != types.Bool {
+					panic(errors.NewErrorWithTk(errors.TYPE_ITER_ILLEGAL, "next of iterator "+t.String()+" must return bool, but got "+tp.String(), n.ForToken))
+				}
+				return has
+			}
+			element = func() *ir.Instr {
+				return e.emitIterCall(t, it, "value", n.ForToken)
+			}
+		}
+	}
+
+	origBlk := e.scope.blk
+	startBlk := ir.NewBlock(&e.scope.blockId, "for start")
+	e.scope.blk = startBlk
+	cond := hasNext()
+
+	bodyBlk := ir.NewBlock(&e.scope.blockId, "for body")
+	e.scope.blk = bodyBlk
+	leaveBody := e.enterVarScope()
+	x := element()
+	if !n.Var.IsIgnored() {
+		e.registerDecl(n.Var.Name, x.Ident)
+		e.immutables[x.Ident] = errors.MUTATE_IMMUTABLE_VAR
+	}
+	for _, node := range n.Body {
+		e.emitInsn(node)
+	}
+	leaveBody()
+	bodyTail := e.scope.blk
+
+	afterBlk := ir.NewBlock(&e.scope.blockId, "for after")
+	e.scope.blk = startBlk
+	e.instr(&ir.If{Cond: cond.Ident, Then: bodyBlk, Else: afterBlk}, ir.DangleIdent(), ir.IfKind)
+	linkBB(origBlk, startBlk)
+	linkBB(startBlk, bodyBlk)
+	linkBB(startBlk, afterBlk)
+	linkBB(bodyTail, startBlk)
+
+	e.scope.blk = afterBlk
+	return e.emitInsn(&ast.Unit{})
+}
+
+// hiddenVar declares var of name, which code cannot refer to, as a copy of ident. Source of for in is kept by such
+// vars rather than temporaries, as they are then stored to frame like other vars when the body yields.
+func (e *Emitter) hiddenVar(name string, ident string) string {
+	v := e.rvalInstr(ir.NewRef(e.env.GetDefTrusted(ident), ident))
+	e.registerDecl(name, v.Ident)
+	return v.Ident
+}
+
+// emitIncr increments int var ident by 1
+func (e *Emitter) emitIncr(ident string) {
+	one := e.rvalInstr(ir.NewConst(types.Int, []byte("1")))
+	sum := e.rvalInstr(ir.NewBinary(ir.ADD, ident, one.Ident, types.Int))
+	e.instr(ir.NewRef(types.Int, sum.Ident), ident, ir.RValKind)
+}
+
+// emitIntArg emits bound of range, which must be int
+func (e *Emitter) emitIntArg(node ast.Expr, tk *token.Token) *ir.Instr {
+	it := e.emitInsn(node)
+	if tp := e.env.GetDefTrusted(it.Ident); tp != types.Int {
+		panic(errors.NewErrorWithTk(errors.TYPE_ITER_ILLEGAL, "bound of range must be int, but got "+tp.String(), tk))
+	}
+	return it
+}
+
+// arrSize gives ident of the size of array t. Size given by const type param is read from the param.
+func (e *Emitter) arrSize(t *types.Arr, tk *token.Token) string {
+	if t.SizeVar == nil {
+		return e.rvalInstr(ir.NewConst(types.Int, []byte(strconv.Itoa(t.Size)))).Ident
+	}
+	ident, ok := e.lookupVar(t.SizeVar.Name)
+	if !ok {
+		panic(errors.NewErrorWithTk(errors.TYPE_ITER_ILLEGAL, "size of array "+t.String()+" is unknown", tk))
+	}
+	return ident
+}
+
+// emitIterCall calls method fn of iterator it of type t. Record and enum are called statically, trait and type var
+// bounded by trait are called through trait.
+func (e *Emitter) emitIterCall(t types.ValType, ident string, fn string, tk *token.Token) *ir.Instr {
+	it := e.rvalInstr(ir.NewRef(t, ident))
+	if tv, ok := t.(*types.TypeVar); ok && tv.Lower != nil {
+		t = tv.Lower
+	}
+	argAt := func(int) *ir.Instr {
+		return it
+	}
+	switch t := t.(type) {
+	case *types.Rec:
+		if tFun, ok := t.Fns[fn]; ok && len(tFun.Params) == 1 {
+			return e.emitCallArgs(tFun, e.typeName(t)+"$"+fn, 1, argAt, t.Substs)
+		}
+	case *types.Enum:
+		if tFun, ok := t.Fns[fn]; ok && len(tFun.Params) == 1 {
+			return e.emitCallArgs(tFun, t.Prefix+"$"+fn, 1, argAt, t.Substs)
+		}
+	case *types.Trait:
+		if idx := t.KeyIndex(fn); idx >= 0 && len(t.Fns[idx].Params) == 1 {
+			return e.emitTraitCallArgs(fn, t, t.Fns[idx], []*ir.Instr{it}, nil)
+		}
+	}
+	panic(errors.NewErrorWithTk(errors.TYPE_ITER_ILLEGAL, t.String()+" is not iterable, which needs next(): bool and value(): T", tk))
+}
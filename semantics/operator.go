@@ -0,0 +1,111 @@
+package semantics
+
+import (
+	"github.com/kingfolk/capybara/ir"
+	"github.com/kingfolk/capybara/types"
+)
+
+// opTraits builtin traits overloading operators. A record or enum declaring `impl add for t` makes `a + b` a call to
+// its add method, and so does a type var bounded by add. eq and ord are Eq and Ord of deriveTraits, so a derived
+// comparison overloads comparison operators alike. Being initialized by var, it is ordered after deriveTraits.
+var opTraits = map[string]*types.Trait{
+	"add":   builtinTrait("add", true, true, nil),
+	"sub":   builtinTrait("sub", true, true, nil),
+	"mul":   builtinTrait("mul", true, true, nil),
+	"eq":    deriveTraits["Eq"],
+	"ord":   deriveTraits["Ord"],
+	"index": indexTrait(),
+}
+
+// opTraitNames maps operator to the builtin trait overloading it
+var opTraitNames = map[ir.OperatorKind]string{
+	ir.ADD: "add",
+	ir.SUB: "sub",
+	ir.MUL: "mul",
+	ir.EQ:  "eq",
+	ir.NEQ: "eq",
+	ir.LT:  "ord",
+	ir.LTE: "ord",
+	ir.GT:  "ord",
+	ir.GTE: "ord",
+}
+
+// indexTrait is the builtin trait overloading subscript `a[i]`. The element type is its associated type item, so
+// that the same trait serves containers of any element.
+func indexTrait() *types.Trait {
+	types.TpUidCounter++
+	tt := &types.Trait{
+		Uid:  types.TpUidCounter,
+		Keys: []string{"index"},
+	}
+	item := &types.TypeVar{Name: "item", Assoc: true}
+	tt.Assocs = []*types.TypeVar{item}
+	types.TpUidCounter++
+	tt.Fns = []*types.Func{{
+		Uid:    types.TpUidCounter,
+		Params: []types.ValType{tt, types.Int},
+		Ret:    item,
+	}}
+	return tt
+}
+
+// emitOperatorCall emits operator op on l and r as call to the method of the builtin trait overloading it. nil is
+// given if type of l does not overload op, then builtin operator applies. Comparison by Ord compares result of cmp
+// with 0, and `<>` by Eq compares result of eq with false.
+func (e *Emitter) emitOperatorCall(op ir.OperatorKind, l, r *ir.Instr) *ir.Instr {
+	name, ok := opTraitNames[op]
+	if !ok {
+		return nil
+	}
+	res := e.emitTraitMethodCall(opTraits[name], l, r)
+	if res == nil {
+		return nil
+	}
+	var zero *ir.Instr
+	switch op {
+	case ir.NEQ:
+		zero = e.rvalInstr(ir.NewConst(types.Bool, []byte("false")))
+		op = ir.EQ
+	case ir.LT, ir.LTE, ir.GT, ir.GTE:
+		zero = e.rvalInstr(ir.NewConst(types.Int, []byte("0")))
+	default:
+		return res
+	}
+	return e.rvalInstr(ir.NewBinary(op, res.Ident, zero.Ident, types.Bool))
+}
+
+// emitIndexCall emits subscript `arr[index]` as call to index method of builtin trait index. nil is given if arr does
+// not overload subscript.
+func (e *Emitter) emitIndexCall(arr, index *ir.Instr) *ir.Instr {
+	return e.emitTraitMethodCall(opTraits["index"], arr, index)
+}
+
+// emitTraitMethodCall calls the single func of builtin trait tt on receiver rcv. Record or enum implementing tt is
+// called statically, and type var bounded by tt is called through trait.
+func (e *Emitter) emitTraitMethodCall(tt *types.Trait, rcv, arg *ir.Instr) *ir.Instr {
+	fnName := tt.Keys[0]
+	argIns := []*ir.Instr{rcv, arg}
+	switch t := e.env.GetDefTrusted(rcv.Ident).(type) {
+	case *types.Rec:
+		if !t.Traits[tt.Uid] {
+			return nil
+		}
+		return e.emitCallArgs(t.Fns[fnName], e.typeName(t)+"$"+fnName, len(argIns), func(i int) *ir.Instr {
+			return argIns[i]
+		}, t.Substs)
+	case *types.Enum:
+		if !t.Traits[tt.Uid] {
+			return nil
+		}
+		return e.emitCallArgs(t.Fns[fnName], t.Prefix+"$"+fnName, len(argIns), func(i int) *ir.Instr {
+			return argIns[i]
+		}, t.Substs)
+	case *types.TypeVar:
+		bound, ok := t.Lower.(*types.Trait)
+		if !ok || (bound.Uid != tt.Uid && !bound.Inherits(tt)) {
+			return nil
+		}
+		return e.emitTraitCallArgs(fnName, bound, bound.Fns[bound.KeyIndex(fnName)], argIns, nil)
+	}
+	return nil
+}
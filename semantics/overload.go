@@ -0,0 +1,201 @@
+package semantics
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/kingfolk/capybara/ast"
+	"github.com/kingfolk/capybara/errors"
+	"github.com/kingfolk/capybara/ir"
+	"github.com/kingfolk/capybara/token"
+	"github.com/kingfolk/capybara/types"
+)
+
+// overload is a func of overload set. sig is the name mangled by param types, like `add(int,float)`. ident is the
+// name func is emitted with, which is the plain name for the first declaration and `name$<n>` for the n-th later one.
+type overload struct {
+	sig   string
+	ident string
+}
+
+// overloadName registers func name of the given signature to its overload set, and gives the name to emit it with.
+// Declarations of the same name are told apart by param count, type param count and param types.
+func (e *Emitter) overloadName(name string, tpVars []*types.TypeVar, paramTps []types.ValType, tk *token.Token) string {
+	sig := e.mangle(name, tpVars, paramTps)
+	set := e.overloads[name]
+	for _, o := range set {
+		if o.sig == sig {
+			panic(errors.NewErrorWithTk(errors.TYPE_OVERLOAD_ILLEGAL, "fun "+sig+" redeclared with the same signature", tk))
+		}
+	}
+	ident := name
+	if len(set) > 0 {
+		ident = name + "$" + strconv.Itoa(len(set))
+	}
+	e.overloads[name] = append(set, &overload{sig: sig, ident: ident})
+	return ident
+}
+
+// mangle gives deterministic name of func by its param types. Type params are named by position, thus `f[T](a:T)`
+// and `f[U](a:U)` are the same signature
+func (e *Emitter) mangle(name string, tpVars []*types.TypeVar, paramTps []types.ValType) string {
+	names := make([]string, len(paramTps))
+	for i, t := range paramTps {
+		names[i] = e.mangleType(t, tpVars)
+	}
+	sig := name
+	if len(tpVars) > 0 {
+		sig += "[" + strconv.Itoa(len(tpVars)) + "]"
+	}
+	return sig + "(" + strings.Join(names, ",") + ")"
+}
+
+func (e *Emitter) mangleType(t types.ValType, tpVars []*types.TypeVar) string {
+	switch tp := t.(type) {
+	case *types.TypeVar:
+		for i, tv := range tpVars {
+			if tv.Name == tp.Name {
+				return "'" + strconv.Itoa(i)
+			}
+		}
+		return "'" + tp.Name
+	case *types.Arr:
+		size := strconv.Itoa(tp.Size)
+		if tp.SizeVar != nil {
+			size = e.mangleType(tp.SizeVar, tpVars)
+		}
+		return "array[" + e.mangleType(tp.Ele, tpVars) + "," + size + "]"
+	case *types.Rec:
+		if tp.Anon {
+			return "(" + e.mangleList(tp.MemTps, tpVars) + ")"
+		}
+		if len(tp.Substs) > 0 {
+			return e.declName(t) + "[" + e.mangleList(tp.Substs, tpVars) + "]"
+		}
+	case *types.Enum:
+		if len(tp.Substs) > 0 {
+			return e.declName(t) + "[" + e.mangleList(tp.Substs, tpVars) + "]"
+		}
+	}
+	return e.declName(t)
+}
+
+func (e *Emitter) mangleList(ts []types.ValType, tpVars []*types.TypeVar) string {
+	names := make([]string, len(ts))
+	for i, t := range ts {
+		names[i] = e.mangleType(t, tpVars)
+	}
+	return strings.Join(names, ",")
+}
+
+// declName is the declared name of record, enum or trait t, and the printed type otherwise. The least name is taken
+// when t is declared under several names.
+func (e *Emitter) declName(t types.ValType) string {
+	decl := ""
+	switch t.(type) {
+	case *types.Rec, *types.Enum, *types.Trait:
+		for name, dt := range e.env.Types {
+			if dt.Code() == t.Code() && sameUid(dt, t) && (decl == "" || name < decl) {
+				decl = name
+			}
+		}
+	}
+	if decl == "" {
+		return t.String()
+	}
+	return decl
+}
+
+func sameUid(t1, t2 types.ValType) bool {
+	switch t1 := t1.(type) {
+	case *types.Rec:
+		return t1.Uid == t2.(*types.Rec).Uid
+	case *types.Enum:
+		return t1.Uid == t2.(*types.Enum).Uid
+	case *types.Trait:
+		return t1.Uid == t2.(*types.Trait).Uid
+	}
+	return false
+}
+
+// emitOverloadCall resolves call of overloaded func by arg types. Candidates are funcs of the same param count and
+// type param count as the call, whose params receive the args. The most specific one, whose params are all
+// received by every other candidate, is chosen. Any tie is reported as ambiguous rather than broken by declaration
+// order.
+func (e *Emitter) emitOverloadCall(node *ast.Apply) *ir.Instr {
+	ref := node.Callee.(*ast.VarRef)
+	name := ref.Symbol.Name
+	argIns := make([]*ir.Instr, len(node.Args))
+	argTps := make([]types.ValType, len(node.Args))
+	for i, arg := range node.Args {
+		argIns[i] = e.emitInsn(arg)
+		argTps[i] = e.env.GetDefTrusted(argIns[i].Ident)
+	}
+	var tpArgs []types.ValType
+	for _, tpArg := range node.TpArgs {
+		tpArgs = append(tpArgs, e.emitTypeExtra(tpArg, e.scope.tpVars))
+	}
+
+	var viable []*overload
+	var viableTps []*types.Func
+	for _, o := range e.overloads[name] {
+		tFun, ok := e.env.Defs[o.ident].(*types.Func)
+		if !ok || len(tFun.Params) != len(argTps) || len(tFun.TpVars) != len(tpArgs) {
+			continue
+		}
+		substFun, err := types.SubstRoot(tFun, tpArgs)
+		if err != nil {
+			continue
+		}
+		if _, err := types.TypeCheckApp(tFun, tpArgs, argTps); err != nil {
+			continue
+		}
+		viable = append(viable, o)
+		viableTps = append(viableTps, substFun.(*types.Func))
+	}
+
+	argNames := make([]string, len(argTps))
+	for i, t := range argTps {
+		argNames[i] = e.mangleType(t, nil)
+	}
+	call := name + "(" + strings.Join(argNames, ",") + ")"
+	if len(viable) == 0 {
+		panic(errors.NewErrorWithTk(errors.TYPE_OVERLOAD_ILLEGAL, "no overload of "+name+" matches call "+call, ref.Token))
+	}
+	best := -1
+	for i := range viable {
+		if moreSpecific(viableTps, i) {
+			if best >= 0 {
+				best = -1
+				break
+			}
+			best = i
+		}
+	}
+	if best < 0 {
+		var sigs []string
+		for _, o := range viable {
+			sigs = append(sigs, o.sig)
+		}
+		panic(errors.NewErrorWithTk(errors.TYPE_OVERLOAD_AMBIGUOUS, "ambiguous call "+call+", candidates: "+strings.Join(sigs, ", "), ref.Token))
+	}
+	tFun := e.env.Defs[viable[best].ident].(*types.Func)
+	return e.emitCallArgs(tFun, viable[best].ident, len(argIns), func(i int) *ir.Instr {
+		return argIns[i]
+	}, tpArgs)
+}
+
+// moreSpecific tests if params of the i-th func can be received by params of every other func
+func moreSpecific(fns []*types.Func, i int) bool {
+	for j, other := range fns {
+		if j == i {
+			continue
+		}
+		for k, p := range fns[i].Params {
+			if types.TypeCompatible(other.Params[k], p) != nil {
+				return false
+			}
+		}
+	}
+	return true
+}
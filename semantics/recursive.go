@@ -0,0 +1,84 @@
+package semantics
+
+import (
+	"strconv"
+
+	"github.com/kingfolk/capybara/ast"
+	"github.com/kingfolk/capybara/errors"
+	"github.com/kingfolk/capybara/types"
+)
+
+// declareTypes marks record and enum declarations of mod pending. Until a pending declaration is emitted, reference to
+// it is a Fix. Thus a type may refer to itself, or to the ones declared after it.
+func (e *Emitter) declareTypes(mod *ast.AST) {
+	for _, decl := range mod.TypeDecls {
+		ctor, ok := decl.Type.(*ast.CtorType)
+		if !ok {
+			continue
+		}
+		switch ctor.Ctor.Name {
+		case "rec", "tup", "enum":
+			e.pendingTypes[decl.Ident.Name] = decl
+		}
+	}
+}
+
+// emitTypeDecl emits type declaration, and fills Fix referring to it
+func (e *Emitter) emitTypeDecl(decl *ast.TypeDecl) {
+	name := decl.Ident.Name
+	e.startedTypes[decl] = true
+	tp := e.emitType(decl.Type)
+	if eff, ok := tp.(*types.Effect); ok {
+		eff.Name = name
+	}
+	e.env.Types[name] = tp
+	if e.pendingTypes[name] == decl {
+		delete(e.pendingTypes, name)
+	}
+	if fd, ok := e.fixDecls[name]; ok {
+		fd.Tp = tp
+	}
+}
+
+// emitVariantDecl emits declaration of enum variant ahead if it is pending, as variant is inspected by its shape
+// rather than referred to. Variant under emit is still pending, which is a variant referring to its enum.
+func (e *Emitter) emitVariantDecl(ctor *ast.CtorType) {
+	decl, ok := e.pendingTypes[ctor.Ctor.Name]
+	if !ok {
+		return
+	}
+	if e.startedTypes[decl] {
+		panic(errors.NewErrorWithTk(errors.TYPE_RECURSIVE_ILLEGAL, "enum variant "+ctor.Ctor.Name+" cannot contain its enum in place", ctor.StartToken))
+	}
+	e.emitTypeDecl(decl)
+}
+
+// emitFix gives reference to pending declaration decl. Type args are checked against type params of decl, since decl
+// is not emitted yet.
+func (e *Emitter) emitFix(decl *ast.TypeDecl, tpArgs []types.ValType) *types.Fix {
+	name := decl.Ident.Name
+	ctor := decl.Type.(*ast.CtorType)
+	if len(tpArgs) != len(ctor.TpParams) {
+		msg := "type " + name + " takes " + strconv.Itoa(len(ctor.TpParams)) + " type arguments, but got " + strconv.Itoa(len(tpArgs))
+		panic(errors.NewErrorWithTk(errors.TYPE_SUBSTITUTE_NUM_MISMATCH, msg, decl.Token))
+	}
+	fd, ok := e.fixDecls[name]
+	if !ok {
+		fd = &types.FixDecl{Name: name}
+		e.fixDecls[name] = fd
+	}
+	return &types.Fix{
+		Decl: fd,
+		Args: tpArgs,
+	}
+}
+
+// unfold gives the type Fix t refers to, and t itself otherwise. Value is always of unfolded type, so member reached
+// by Fix is unfolded on access.
+func unfold(t types.ValType) types.ValType {
+	u, err := types.Unfold(t)
+	if err != nil {
+		panic(err)
+	}
+	return u
+}
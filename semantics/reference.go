@@ -0,0 +1,174 @@
+package semantics
+
+import (
+	"github.com/kingfolk/capybara/ast"
+	"github.com/kingfolk/capybara/errors"
+	"github.com/kingfolk/capybara/ir"
+	"github.com/kingfolk/capybara/token"
+	"github.com/kingfolk/capybara/types"
+)
+
+// emitRefType emits `ref[T]` or raw pointer `ptr[T]`
+func (e *Emitter) emitRefType(n *ast.CtorType, tpVars []*types.TypeVar) *types.Ref {
+	if len(n.ParamTypes) != 1 {
+		panic(errors.NewErrorWithTk(errors.TYPE_REF_ILLEGAL, n.Ctor.Name+" takes exactly one type argument", n.StartToken))
+	}
+	ele := e.emitTypeExtra(n.ParamTypes[0], tpVars)
+	return refType(ele, n.Ctor.Name == "ptr", n.StartToken)
+}
+
+// refType gives reference to ele. Value of type param is boxed while the one it is instantiated by is not, so a slot
+// cannot be shared by both, and reference to type param is rejected.
+func refType(ele types.ValType, raw bool, tk *token.Token) *types.Ref {
+	if types.HasTpVar(ele) {
+		panic(errors.NewErrorWithTk(errors.TYPE_REF_ILLEGAL, "reference to generic type "+ele.String()+" is not supported", tk))
+	}
+	return &types.Ref{
+		Ele: ele,
+		Raw: raw,
+	}
+}
+
+// emitAddrInsn emits `&x`. Only mutable local variable can be referred, as it is written through the reference. The
+// variable is moved to a stack slot when lifted to SSA.
+func (e *Emitter) emitAddrInsn(node *ast.AddrOf) *ir.Instr {
+	v, ok := node.Child.(*ast.VarRef)
+	if !ok {
+		panic(errors.NewErrorWithTk(errors.TYPE_REF_ILLEGAL, "only variable can be referred by &", node.AmpToken))
+	}
+	ident, ok := e.lookupVar(v.Symbol.Name)
+	if !ok {
+		panic(errors.NewErrorWithTk(errors.SCOPE_VAR_UNDEFINED, "undefined identifiers: "+v.Symbol.Name, v.Token))
+	}
+	if e.derefs[ident] {
+		// captured var is already referred by the param
+		it := e.rvalInstr(ir.NewRef(e.env.GetDefTrusted(ident), ident))
+		e.stackRefs[it.Ident] = true
+		return it
+	}
+	if ident[0] != '$' {
+		panic(errors.NewErrorWithTk(errors.TYPE_REF_ILLEGAL, "only local variable can be referred by &: "+v.Symbol.Name, v.Token))
+	}
+	if code, ok := e.immutables[ident]; ok {
+		panic(errors.NewErrorWithTk(code, "cannot refer to immutable "+v.Symbol.Name, v.Token))
+	}
+	val := &ir.Addr{
+		Tp:     refType(e.env.GetDefTrusted(ident), false, node.AmpToken),
+		Target: ident,
+	}
+	it := e.rvalInstr(val)
+	e.stackRefs[it.Ident] = true
+	return it
+}
+
+// emitDerefInsn emits `*p` reading value p refers to
+func (e *Emitter) emitDerefInsn(node *ast.Deref) *ir.Instr {
+	target := e.emitInsn(node.Child)
+	r := e.refOf(target, node.StarToken)
+	val := &ir.Load{
+		Tp:     r.Ele,
+		Target: target.Ident,
+	}
+	return e.rvalInstr(val)
+}
+
+// emitDerefPutInsn emits `*p = v` writing value p refers to
+func (e *Emitter) emitDerefPutInsn(node *ast.DerefPut) *ir.Instr {
+	target := e.emitInsn(node.Ref)
+	right := e.emitInsn(node.Assignee)
+	r := e.refOf(target, node.StarToken)
+	if _, coerced := e.emitCoerce(right.Ident, r.Ele); coerced != nil {
+		right = coerced
+	}
+	if err := types.TypeCompatible(r.Ele, e.env.GetDefTrusted(right.Ident)); err != nil {
+		panic(err)
+	}
+	e.checkStoreEscape(target.Ident, right.Ident, r.Ele, node.StarToken)
+	bound, _ := e.emitBoxTrait(right.Ident, r.Ele)
+	val := &ir.Store{
+		Target: target.Ident,
+		Right:  bound,
+	}
+	return e.instr(val, e.genID(), ir.CallKind)
+}
+
+func (e *Emitter) refOf(target *ir.Instr, tk *token.Token) *types.Ref {
+	r, ok := e.env.GetDefTrusted(target.Ident).(*types.Ref)
+	if !ok {
+		panic(errors.NewErrorWithTk(errors.TYPE_REF_ILLEGAL, "dereference of non-reference type: "+target.Type().String(), tk))
+	}
+	return r
+}
+
+// spreadStackRefs marks result of it as holding reference to stack local if it reads one, and its type may hold a
+// reference, e.g. a call taking the reference, or a record literal of it. A record or array written by one is marked
+// as well. It is conservative: a call returning a reference taken by arg is taken as returning the arg.
+func (e *Emitter) spreadStackRefs(it *ir.Instr) {
+	var tainted bool
+	for _, op := range ir.Operands(it) {
+		if e.stackRefs[op] {
+			tainted = true
+			break
+		}
+	}
+	if !tainted {
+		return
+	}
+	switch v := it.Val.(type) {
+	case *ir.RecPut:
+		e.stackRefs[v.Target] = true
+	case *ir.ArrPut:
+		e.stackRefs[v.Arr] = true
+	}
+	if holdsRef(it.Val.Type(), true, map[*types.FixDecl]bool{}) {
+		e.stackRefs[it.Ident] = true
+	}
+}
+
+// holdsRef tests if value of tp holds a reference, as is or by a member. If loose is set, raw pointer and value whose
+// type does not tell what it holds, i.e. type var, boxed value and trait, are counted as well.
+func holdsRef(tp types.ValType, loose bool, seen map[*types.FixDecl]bool) bool {
+	switch t := tp.(type) {
+	case *types.Ref:
+		return loose || !t.Raw
+	case *types.Rec:
+		for _, m := range t.MemTps {
+			if holdsRef(m, loose, seen) {
+				return true
+			}
+		}
+	case *types.Arr:
+		return holdsRef(t.Ele, loose, seen)
+	case *types.Enum:
+		for _, m := range t.Tps {
+			if holdsRef(m, loose, seen) {
+				return true
+			}
+		}
+	case *types.Fix:
+		if seen[t.Decl] || t.Decl.Tp == nil {
+			return false
+		}
+		seen[t.Decl] = true
+		return holdsRef(t.Decl.Tp, loose, seen)
+	case *types.TypeVar, *types.Trait:
+		return loose
+	}
+	return loose && tp == types.VoidP
+}
+
+// checkRefEscape rejects returning reference to stack local of current function, which is gone once it returns, as
+// is or held by a record, tuple, array or enum. Raw pointer is not checked.
+func (e *Emitter) checkRefEscape(target string, retTp types.ValType) {
+	if e.stackRefs[target] && holdsRef(retTp, false, map[*types.FixDecl]bool{}) {
+		panic(errors.NewError(errors.TYPE_REF_ESCAPE, "reference to stack local cannot be returned"))
+	}
+}
+
+// checkStoreEscape rejects writing reference to stack local of current function through target which is not known to
+// refer to a local of current function, e.g. a param. The reference would outlive the function there.
+func (e *Emitter) checkStoreEscape(target, right string, tp types.ValType, tk *token.Token) {
+	if e.stackRefs[right] && !e.stackRefs[target] && holdsRef(tp, false, map[*types.FixDecl]bool{}) {
+		panic(errors.NewErrorWithTk(errors.TYPE_REF_ESCAPE, "reference to stack local cannot be stored out of current function", tk))
+	}
+}
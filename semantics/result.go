@@ -0,0 +1,155 @@
+package semantics
+
+import (
+	"strconv"
+
+	"github.com/kingfolk/capybara/ast"
+	"github.com/kingfolk/capybara/errors"
+	"github.com/kingfolk/capybara/ir"
+	"github.com/kingfolk/capybara/types"
+)
+
+const (
+	resultOkIdx  = 0
+	resultErrIdx = 1
+)
+
+// declareResult registers builtin generic enum result to env, as if declared by
+//
+//	type ok = tup[T, E](T);
+//	type err = tup[T, E](E);
+//	type result = enum[T, E]{ ok[T, E], err[T, E] }
+//
+// It is built on every emit, since methods declared on it are kept by the type.
+func (e *Emitter) declareResult() {
+	variant := func(name string) *types.Rec {
+		types.TpUidCounter++
+		return &types.Rec{
+			ImplBundle: types.ImplBundle{
+				Fns:    map[string]*types.Func{},
+				Traits: map[uint64]bool{},
+			},
+			Uid:    types.TpUidCounter,
+			Keys:   []string{"0"},
+			MemTps: []types.ValType{&types.TypeVar{Name: name}},
+			TpVars: []*types.TypeVar{{Name: "T"}, {Name: "E"}},
+		}
+	}
+	okTp := variant("T")
+	errTp := variant("E")
+
+	var tps []types.ValType
+	for _, v := range []*types.Rec{okTp, errTp} {
+		tp, err := types.SubstRoot(v, []types.ValType{&types.TypeVar{Name: "T"}, &types.TypeVar{Name: "E"}})
+		if err != nil {
+			panic(err)
+		}
+		tps = append(tps, tp)
+	}
+	types.TpUidCounter++
+	e.resultTp = &types.Enum{
+		ImplBundle: types.ImplBundle{
+			Fns:    map[string]*types.Func{},
+			Traits: map[uint64]bool{},
+		},
+		Uid:    types.TpUidCounter,
+		Tokens: []string{"ok", "err"},
+		TpVars: []*types.TypeVar{{Name: "T"}, {Name: "E"}},
+		Tps:    tps,
+	}
+	e.env.Types["ok"] = okTp
+	e.env.Types["err"] = errTp
+	e.env.Types["result"] = e.resultTp
+}
+
+// resultOf gives t as instance of builtin result
+func (e *Emitter) resultOf(t types.ValType) (*types.Enum, bool) {
+	enumTp, ok := t.(*types.Enum)
+	if !ok || e.resultTp == nil || enumTp.Uid != e.resultTp.Uid {
+		return nil, false
+	}
+	return enumTp, true
+}
+
+// resultMember gives type of the value held by variant idx of result instance t
+func resultMember(t *types.Enum, idx int) types.ValType {
+	return t.Tps[idx].(*types.Rec).MemTps[0]
+}
+
+// emitPropagateInsn emits `r?`. It branches on discriminant of r: err is rebuilt as err of the enclosing function's
+// result and returned at once, and ok is unwrapped as the value of expression, where emit continues.
+func (e *Emitter) emitPropagateInsn(n *ast.Propagate) *ir.Instr {
+	target := e.emitInsn(n.Child)
+	targetTp := e.env.GetDefTrusted(target.Ident)
+	srcTp, ok := e.resultOf(targetTp)
+	if !ok {
+		panic(errors.NewErrorWithTk(errors.TYPE_PROPAGATE_ILLEGAL, "? applies to result only, but got "+targetTp.String(), n.QuestionToken))
+	}
+	if e.scope.ret == nil {
+		panic(errors.NewErrorWithTk(errors.TYPE_PROPAGATE_ILLEGAL, "? used outside of function", n.QuestionToken))
+	}
+	retTp, ok := e.resultOf(e.scope.ret)
+	if !ok {
+		panic(errors.NewErrorWithTk(errors.TYPE_PROPAGATE_ILLEGAL, "? used in function returning "+e.scope.ret.String()+" rather than result", n.QuestionToken))
+	}
+	srcErrTp := resultMember(srcTp, resultErrIdx)
+	retErrTp := resultMember(retTp, resultErrIdx)
+	if err := types.TypeCompatible(retErrTp, srcErrTp); err != nil {
+		panic(errors.NewErrorWithTk(errors.TYPE_PROPAGATE_ILLEGAL, "? cannot return err of "+srcErrTp.String()+" as "+retErrTp.String(), n.QuestionToken))
+	}
+
+	payload := e.rvalInstr(&ir.RecAcs{
+		Tp:     srcTp,
+		Target: target.Ident,
+		Idx:    1,
+	})
+	discr := e.formDiscriminant(target, srcTp)
+	errIdx := e.rvalInstr(ir.NewConst(types.Int, []byte(strconv.Itoa(resultErrIdx))))
+	cond := e.rvalInstr(ir.NewBinary(ir.EQ, discr.Ident, errIdx.Ident, types.Bool))
+	condBlk := e.scope.blk
+	errBlk := ir.NewBlock(&e.scope.blockId, "propagate "+target.Ident+" err")
+	okBlk := ir.NewBlock(&e.scope.blockId, "propagate "+target.Ident+" ok")
+	linkBB(condBlk, errBlk)
+	linkBB(condBlk, okBlk)
+
+	e.scope.blk = errBlk
+	errRec := e.emitUnbox(payload.Ident, srcTp.Tps[resultErrIdx], &types.TypeVar{Name: "dummy"})
+	errVal := e.rvalInstr(&ir.RecAcs{
+		Tp:     srcErrTp,
+		Target: errRec.Ident,
+		Idx:    0,
+	})
+	errArg, _ := e.emitCoerce(errVal.Ident, retErrTp)
+	lit := e.rvalInstr(&ir.RecLit{
+		Tp:   retTp.Tps[resultErrIdx].(*types.Rec),
+		Args: []string{errArg},
+	})
+	ret := e.rvalInstr(&ir.EnumVar{
+		Tp:  retTp,
+		Tok: "err",
+		Idx: resultErrIdx,
+		Box: lit.Ident,
+	})
+	e.rvalInstr(&ir.Ret{
+		Tp:     e.scope.ret,
+		Target: ret.Ident,
+	})
+
+	e.scope.blk = okBlk
+	okRec := e.emitUnbox(payload.Ident, srcTp.Tps[resultOkIdx], &types.TypeVar{Name: "dummy"})
+	okVal := e.rvalInstr(&ir.RecAcs{
+		Tp:     resultMember(srcTp, resultOkIdx),
+		Target: okRec.Ident,
+		Idx:    0,
+	})
+
+	// type of If is given by its branches, so it is emitted after them
+	e.scope.blk = condBlk
+	e.instr(&ir.If{
+		Cond: cond.Ident,
+		Then: errBlk,
+		Else: okBlk,
+	}, ir.DangleIdent(), ir.IfKind)
+	e.scope.blk = okBlk
+	return okVal
+}
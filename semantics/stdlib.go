@@ -0,0 +1,171 @@
+package semantics
+
+import (
+	"github.com/kingfolk/capybara/ast"
+	"github.com/kingfolk/capybara/errors"
+	"github.com/kingfolk/capybara/ir"
+	"github.com/kingfolk/capybara/stdlib"
+	"github.com/kingfolk/capybara/syntax"
+	"github.com/kingfolk/capybara/token"
+	"github.com/kingfolk/capybara/types"
+	"github.com/rhysd/locerr"
+)
+
+// libIdBase is where idents of stdlib modules are counted from. Modules are emitted ahead of user code, and idents
+// of user code, which names of blocks are derived from, are kept the same as without modules.
+const libIdBase = 1 << 20
+
+// runtimeFuncs gives funcs of C runtime which stdlib modules are built on, see codegen/stdlib.c. They are visible to
+// stdlib modules only. Buffer kept by runtime is referred by raw pointer, and its elements are boxed.
+func runtimeFuncs() map[string]*types.Func {
+	handle := &types.Ref{Ele: types.Int, Raw: true}
+	t := &types.TypeVar{Name: "T"}
+	fn := func(generic bool, ret types.ValType, params ...types.ValType) *types.Func {
+		types.TpUidCounter++
+		f := &types.Func{
+			Uid:    types.TpUidCounter,
+			Params: params,
+			Ret:    ret,
+		}
+		if generic {
+			f.TpVars = []*types.TypeVar{t}
+		}
+		return f
+	}
+	return map[string]*types.Func{
+		"cb_print_int":   fn(false, types.Unit, types.Int),
+		"cb_print_float": fn(false, types.Unit, types.Float),
+		"cb_print_char":  fn(false, types.Unit, types.Int),
+		"cb_read_int":    fn(false, types.Int),
+		"cb_vec_new":     fn(false, handle),
+		"cb_vec_len":     fn(false, types.Int, handle),
+		"cb_vec_push":    fn(true, types.Unit, handle, t),
+		"cb_vec_get":     fn(true, t, handle, types.Int),
+		"cb_vec_set":     fn(true, types.Unit, handle, types.Int, t),
+		"cb_vec_pop":     fn(true, t, handle),
+		"cb_map_new":     fn(false, handle),
+		"cb_map_len":     fn(false, types.Int, handle),
+		"cb_map_has":     fn(false, types.Int, handle, types.Int),
+		"cb_map_get":     fn(true, t, handle, types.Int),
+		"cb_map_put":     fn(true, types.Unit, handle, types.Int, t),
+		"cb_map_remove":  fn(false, types.Int, handle, types.Int),
+	}
+}
+
+// runtimeKept tells which params runtime funcs keep in their buffers past the call
+var runtimeKept = map[string][]bool{
+	"cb_vec_push": {false, true},
+	"cb_vec_set":  {false, false, true},
+	"cb_map_put":  {false, false, true},
+}
+
+// emitLibs emits prelude, then modules imported by mod. Declaration of user code takes precedence over stdlib: a
+// type of module whose name is declared by mod is left out, and so are declarations of modules referring to it.
+func (e *Emitter) emitLibs(mod *ast.AST) {
+	left := map[string]bool{}
+	for _, decl := range mod.TypeDecls {
+		left[decl.Ident.Name] = true
+	}
+	loaded := map[string]bool{}
+	origCount := e.count
+	e.count = libIdBase
+	e.emitLib("prelude", nil, loaded, left)
+	for _, imp := range mod.Imports {
+		e.emitLib(imp.Module.Name, imp.StartToken, loaded, left)
+	}
+	e.count = origCount
+}
+
+// emitLib emits module name of stdlib, after modules it imports. Module is emitted once however many times it is
+// imported.
+func (e *Emitter) emitLib(name string, tk *token.Token, loaded, left map[string]bool) {
+	if loaded[name] {
+		return
+	}
+	loaded[name] = true
+	src, ok := stdlib.Source(name)
+	if !ok {
+		panic(errors.NewErrorWithTk(errors.SCOPE_MODULE_UNDEFINED, "module not found in stdlib: "+name, tk))
+	}
+	lib, err := syntax.Parse(locerr.NewSourceFromString(name+".cb", src))
+	if err != nil {
+		panic("unreachable. stdlib module " + name + " is malformed: " + err.Error())
+	}
+	for _, imp := range lib.Imports {
+		e.emitLib(imp.Module.Name, imp.StartToken, loaded, left)
+	}
+
+	var decls []*ast.TypeDecl
+	for changed := true; changed; {
+		changed = false
+		decls = decls[:0]
+		for _, decl := range lib.TypeDecls {
+			if left[decl.Ident.Name] {
+				continue
+			}
+			if refersTo(decl.Type, left) {
+				left[decl.Ident.Name] = true
+				changed = true
+				continue
+			}
+			decls = append(decls, decl)
+		}
+	}
+	e.declareTypes(&ast.AST{TypeDecls: decls})
+	for _, decl := range decls {
+		if !e.startedTypes[decl] {
+			e.emitTypeDecl(decl)
+		}
+	}
+
+	runtime := runtimeFuncs()
+	for fname, tp := range runtime {
+		e.env.Defs[fname] = tp
+		e.kept[fname] = runtimeKept[fname]
+	}
+	origScope := e.scope
+	e.scope = NewScope()
+	e.scope.blk = ir.NewBlock(&e.scope.blockId, "$"+name+"$")
+	for _, node := range lib.Root {
+		f, ok := node.(*ast.LetRec)
+		if !ok || funcRefersTo(f.Func, left) {
+			continue
+		}
+		e.module.Libs = append(e.module.Libs, e.emitFuncInsn(f).Val.(*ir.Func))
+	}
+	e.scope = origScope
+	for fname := range runtime {
+		delete(e.env.Defs, fname)
+	}
+}
+
+// refersTo tests if type expression t refers to any type of names
+func refersTo(t ast.Expr, names map[string]bool) bool {
+	switch t := t.(type) {
+	case *ast.CtorType:
+		if names[t.Ctor.Name] {
+			return true
+		}
+		for _, p := range t.ParamTypes {
+			if refersTo(p, names) {
+				return true
+			}
+		}
+	case *ast.Param:
+		return refersTo(t.Type, names)
+	}
+	return false
+}
+
+// funcRefersTo tests if signature of f refers to any type of names
+func funcRefersTo(f *ast.FuncDef, names map[string]bool) bool {
+	if f.Rcv != nil && refersTo(f.Rcv.Type, names) {
+		return true
+	}
+	for _, p := range f.Params {
+		if refersTo(p.Type, names) {
+			return true
+		}
+	}
+	return f.RetType != nil && refersTo(f.RetType, names)
+}
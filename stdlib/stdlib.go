@@ -0,0 +1,18 @@
+// Package stdlib bundles the standard library of capybara. Each module is a capybara source embedded into the
+// compiler, which is loaded when a program imports it by `import name;`. prelude is the module compiled with every
+// program.
+package stdlib
+
+import "embed"
+
+//go:embed *.cb
+var files embed.FS
+
+// Source gives source of module name, false if there is no such module
+func Source(name string) (string, bool) {
+	src, err := files.ReadFile(name + ".cb")
+	if err != nil {
+		return "", false
+	}
+	return string(src), true
+}
@@ -84,6 +84,21 @@ import (
 %token<token> LBRACKET
 %token<token> RBRACKET
 %token<token> EXTERNAL
+%token<token> VAL
+%token<token> DERIVE
+%token<token> IMPL
+%token<token> WHERE
+%token<token> AMP
+%token<token> QUESTION
+%token<token> THROW
+%token<token> TRY
+%token<token> CATCH
+%token<token> EFFECT
+%token<token> HANDLE
+%token<token> YIELD
+%token<token> DOT_DOT
+%token<token> IMPORT
+%token<token> CONST
 
 %nonassoc IN
 %right prec_let
@@ -101,6 +116,7 @@ import (
 %left BAR_BAR
 %left AND_AND
 %left DOUBLE_EQUAL LESS_GREATER LESS GREATER LESS_EQUAL GREATER_EQUAL
+%nonassoc DOT_DOT
 %left PLUS MINUS PLUS_DOT MINUS_DOT
 %left STAR SLASH STAR_DOT SLASH_DOT PERCENT
 %right prec_unary_minus
@@ -111,6 +127,7 @@ import (
 %nonassoc LPAREN
 %nonassoc LBRACKET
 %left DOT
+%left QUESTION
 
 %type<node> exp
 %type<node> int_exp
@@ -120,6 +137,7 @@ import (
 %type<nodes> seq_case
 %type<node> vardef
 %type<nodes> args
+%type<nodes> tuple_elems
 %type<param> opt_fun_receiver
 %type<params> params
 %type<params> func_params
@@ -127,19 +145,31 @@ import (
 %type<decls> id_list
 %type<params> opt_type_params
 %type<params> named_args
+%type<params> rec_fields
+%type<param> rec_field
 %type<node> simple_type_annotation
 %type<param> tpvar
 %type<params> tpvar_list
+%type<node> bounds
+%type<params> opt_where
+%type<params> where_list
 %type<node> type
 %type<nodes> seq_type
 %type<node> trait_fun
 %type<nodes> seq_trait_fun
+%type<node> impl_member
+%type<nodes> seq_impl_member
 %type<node> simple_type
 %type<node> array_type
 %type<node> rec_type
 %type<node> tup_type
+%type<node> tuple_type
 %type<node> enum_type
 %type<node> trait_type
+%type<node> effect_type
+%type<decls> opt_effects
+%type<node> op_clause
+%type<nodes> seq_op_clause
 %type<program> toplevels
 %type<> program
 
@@ -158,13 +188,26 @@ program:
 toplevels:
 	/* empty */
 		{ $$ = &ast.AST{} }
-	| toplevels TYPE IDENT EQUAL type SEMICOLON
+	| toplevels TYPE IDENT EQUAL type opt_where SEMICOLON
 		{
-			decl := &ast.TypeDecl{$2, ast.NewSymbol($3.Value()), $5}
+			decl := &ast.TypeDecl{$2, ast.NewSymbol($3.Value()), typeWhere(yylex, $5, $6), nil}
 			tree := $1
 			tree.TypeDecls = append(tree.TypeDecls, decl)
 			$$ = tree
 		}
+	| toplevels TYPE IDENT EQUAL type opt_where DERIVE LPAREN id_list RPAREN SEMICOLON
+		{
+			decl := &ast.TypeDecl{$2, ast.NewSymbol($3.Value()), typeWhere(yylex, $5, $6), $9}
+			tree := $1
+			tree.TypeDecls = append(tree.TypeDecls, decl)
+			$$ = tree
+		}
+	| toplevels IMPORT IDENT SEMICOLON
+		{
+			tree := $1
+			tree.Imports = append(tree.Imports, &ast.Import{$2, $3, sym($3)})
+			$$ = tree
+		}
 	| toplevels EXTERNAL IDENT COLON type EQUAL STRING_LITERAL SEMICOLON
 		{
 			from := $7.Value()
@@ -230,6 +273,14 @@ exp:
 	| MINUS exp
 		%prec prec_unary_minus
 		{ $$ = &ast.Neg{$1, $2} }
+	| AMP exp
+		%prec prec_unary_minus
+		{ $$ = &ast.AddrOf{$1, $2} }
+	| STAR exp
+		%prec prec_unary_minus
+		{ $$ = &ast.Deref{$1, $2} }
+	| exp QUESTION
+		{ $$ = &ast.Propagate{$1, $2} }
 	| exp PLUS exp
 		{ $$ = &ast.Add{$1, $3} }
 	| exp MINUS exp
@@ -264,8 +315,36 @@ exp:
 		{
 			$$ = &ast.Loop{$1, $3, $6}
 		}
-	| ARRAY LBRACKET simple_type RBRACKET LPAREN args RPAREN
-		{ $$ = &ast.ArrayLit{$1, $7, $6} }
+	| FOR LPAREN IDENT IN exp RPAREN LCURLY seq_exp RCURLY
+		%prec prec_if
+		{ $$ = &ast.ForIn{$1, $9, sym($3), $5, $8} }
+	| YIELD exp
+		%prec prec_if
+		{ $$ = &ast.Yield{$1, $2} }
+	| exp DOT_DOT exp
+		{ $$ = &ast.Range{$1, $3} }
+	| THROW exp
+		%prec prec_if
+		{ $$ = &ast.Throw{$1, $2} }
+	| TRY LCURLY seq_exp RCURLY CATCH IDENT COLON type LCURLY seq_exp RCURLY
+		%prec prec_if
+		{ $$ = &ast.Try{$1, $11, $3, sym($6), $8, $10} }
+	| HANDLE LCURLY seq_exp RCURLY IDENT LCURLY seq_op_clause RCURLY
+		%prec prec_if
+		{
+			if $5.Value() != "with" {
+				yylex.Error("unexpected " + $5.Value() + " after handled body, expected with")
+			}
+			var clauses []*ast.OpClause
+			for _, c := range $7 {
+				clauses = append(clauses, c.(*ast.OpClause))
+			}
+			$$ = &ast.Handle{$1, $8, $3, clauses}
+		}
+	| ARRAY LBRACKET type RBRACKET LPAREN args RPAREN
+		{ $$ = &ast.ArrayLit{$1, $7, $6, $3} }
+	| LPAREN tuple_elems RPAREN
+		{ $$ = &ast.Tuple{$2} }
 	| vardef
 		{ $$ = $1 }
 	| exp LBRACKET list_exp RBRACKET
@@ -297,8 +376,18 @@ exp:
 					yylex.Error("array subscript more than one element")
 				}
 				$$ = &ast.ArrayPut{b.Expr, b.Args[0], $3}
+			} else if d, ok := $1.(*ast.DotAcs); ok {
+				key, ok := d.Dot.(*ast.VarRef)
+				if !ok {
+					yylex.Error("illegal field assignment")
+				}
+				$$ = &ast.RecordPut{d.Expr, key, $3}
+			} else if v, ok := $1.(*ast.VarRef); ok {
+				$$ = &ast.Mutate{v, $3}
+			} else if d, ok := $1.(*ast.Deref); ok {
+				$$ = &ast.DerefPut{d.StarToken, d.Child, $3}
 			} else {
-				$$ = &ast.Mutate{$1.(*ast.VarRef), $3}
+				yylex.Error("illegal assignment target")
 			}
 		}
 	| exp LCURLY named_args RCURLY
@@ -327,7 +416,7 @@ exp:
 			ref := &ast.VarRef{$3, sym($3)}
 			$$ = &ast.DotAcs{$1, ref, $3}
 		}
-	| FUN opt_fun_receiver IDENT opt_type_params func_params simple_type_annotation EQUAL LCURLY seq_exp RCURLY
+	| FUN opt_fun_receiver IDENT opt_type_params func_params simple_type_annotation opt_effects opt_where EQUAL LCURLY seq_exp RCURLY
 		%prec prec_fun
 		{
 			ident := sym($3)
@@ -335,12 +424,13 @@ exp:
 				FuncType: ast.FuncType{
 					Token: $1,
 					Params: $5,
-					TpParams: $4,
+					TpParams: applyWhere(yylex, $4, $8),
 					RetType: $6,
+					Effects: $7,
 				},
 				Symbol: ident,
 				Rcv: $2,
-				Body: $9,
+				Body: $11,
 			}
 			ref := &ast.VarRef{$1, ident}
 			$$ = &ast.LetRec{
@@ -349,6 +439,27 @@ exp:
 				Body: ref,
 			}
 		}
+	| IMPL IDENT FOR IDENT LCURLY seq_impl_member RCURLY
+		{
+			impl := &ast.Impl{StartToken: $1, EndToken: $7, Trait: sym($2), Target: sym($4)}
+			for _, e := range $6 {
+				switch m := e.(type) {
+				case *ast.AssocType:
+					impl.Types = append(impl.Types, m)
+				case *ast.AssocConst:
+					impl.Consts = append(impl.Consts, m)
+				case *ast.LetRec:
+					if m.Func.Rcv == nil {
+						yylex.Error("only method can be defined in impl block")
+						continue
+					}
+					impl.Methods = append(impl.Methods, m)
+				default:
+					yylex.Error("only method, associated type and const can be defined in impl block")
+				}
+			}
+			$$ = impl
+		}
 	| MATCH exp LCURLY seq_case RCURLY
 		%prec prec_if
 		{
@@ -377,7 +488,29 @@ seq_case:
 
 case:
 	CASE exp COLON seq_exp
-		{ $$ = &ast.Case{$1, $2, $4} }
+		{ $$ = &ast.Case{$1, $2, nil, $4} }
+	| CASE exp IF exp COLON seq_exp
+		{ $$ = &ast.Case{$1, $2, $4, $6} }
+
+seq_op_clause:
+	op_clause
+		{ $$ = []ast.Expr{$1} }
+	| seq_op_clause op_clause
+		{ $$ = append($1, $2) }
+
+op_clause:
+	IDENT LPAREN id_list RPAREN MINUS_GREATER seq_exp
+		{ $$ = &ast.OpClause{$1, sym($1), $3, $6} }
+
+opt_effects:
+		{ $$ = nil }
+	| IDENT id_list
+		{
+			if $1.Value() != "with" {
+				yylex.Error("unexpected " + $1.Value() + " after func signature, expected with")
+			}
+			$$ = $2
+		}
 
 vardef:
 	LET IDENT COLON type
@@ -389,6 +522,24 @@ vardef:
 	| LET IDENT COLON type EQUAL exp
 		%prec prec_let
 		{ $$ = &ast.Let{$1, sym($2), $6, $4} }
+	| LET LPAREN id_list RPAREN EQUAL exp
+		%prec prec_let
+		{ $$ = &ast.LetTuple{$1, $3, $6, nil, nil} }
+	| LET LPAREN id_list RPAREN COLON type EQUAL exp
+		%prec prec_let
+		{ $$ = &ast.LetTuple{$1, $3, $8, nil, $6} }
+	| VAL IDENT EQUAL exp
+		%prec prec_let
+		{ $$ = &ast.Let{$1, sym($2), $4, nil} }
+	| VAL IDENT COLON type EQUAL exp
+		%prec prec_let
+		{ $$ = &ast.Let{$1, sym($2), $6, $4} }
+	| VAL LPAREN id_list RPAREN EQUAL exp
+		%prec prec_let
+		{ $$ = &ast.LetTuple{$1, $3, $6, nil, nil} }
+	| VAL LPAREN id_list RPAREN COLON type EQUAL exp
+		%prec prec_let
+		{ $$ = &ast.LetTuple{$1, $3, $8, nil, $6} }
 
 func_params:
 	LPAREN opt_params RPAREN
@@ -411,6 +562,12 @@ named_args:
 	| named_args COMMA IDENT COLON exp
 		{ $$ = append($1, &ast.Param{$3, sym($3), $5}) }
 
+tuple_elems:
+	exp COMMA exp
+		{ $$ = []ast.Expr{$1, $3} }
+	| tuple_elems COMMA exp
+		{ $$ = append($1, $3) }
+
 args:
 		{ $$ = []ast.Expr{} }
 	| args COMMA exp
@@ -443,10 +600,14 @@ type:
 		{ $$ = $1 }
 	| tup_type
 		{ $$ = $1 }
+	| tuple_type
+		{ $$ = $1 }
 	| enum_type
 		{ $$ = $1 }
 	| trait_type
 		{ $$ = $1 }
+	| effect_type
+		{ $$ = $1 }
 
 seq_type:
 	type
@@ -459,17 +620,28 @@ simple_type:
 		{ $$ = &ast.CtorType{nil, $1, nil, nil, ast.NewSymbol($1.Value())} }
 	| IDENT LBRACKET list_exp RBRACKET
 		{ $$ = &ast.CtorType{nil, $1, $3, nil, ast.NewSymbol($1.Value())} }
+	| IDENT DOT IDENT
+		{
+			// associated type of type param like `T.item`
+			$$ = &ast.DotAcs{&ast.VarRef{$1, sym($1)}, &ast.VarRef{$3, sym($3)}, $3}
+		}
 
 array_type:
-	ARRAY LBRACKET simple_type COMMA int_exp RBRACKET
+	ARRAY LBRACKET type COMMA int_exp RBRACKET
 		{
 			ele := $3
 			size := $5
 			$$ = &ast.CtorType{$1, $6, []ast.Expr{ele, size}, nil, sym($1)}
 		}
+	| ARRAY LBRACKET type COMMA IDENT RBRACKET
+		{
+			ele := $3
+			size := &ast.VarRef{$5, sym($5)}
+			$$ = &ast.CtorType{$1, $6, []ast.Expr{ele, size}, nil, sym($1)}
+		}
 
 rec_type:
-	REC opt_type_params LCURLY params RCURLY
+	REC opt_type_params LCURLY rec_fields RCURLY
 		{
 			var e []ast.Expr
 			for _, p := range $4 {
@@ -478,12 +650,30 @@ rec_type:
 			$$ = &ast.CtorType{$1, $5, e, $2, sym($1)}
 		}
 
+rec_fields:
+	rec_field
+		{ $$ = []*ast.Param{$1} }
+	| rec_fields COMMA rec_field
+		{ $$ = append($1, $3) }
+
+rec_field:
+	IDENT COLON type
+		{ $$ = &ast.Param{$1, sym($1), $3} }
+	| VAL IDENT COLON type
+		{ $$ = &ast.Param{$1, sym($2), $4} }
+
 tup_type:
 	TUP opt_type_params LPAREN seq_type RPAREN
 		{
 			$$ = &ast.CtorType{$1, $5, $4, $2, sym($1)}
 		}
 
+tuple_type:
+	LPAREN type COMMA seq_type RPAREN
+		{
+			$$ = &ast.TupleType{append([]ast.Expr{$2}, $4...)}
+		}
+
 enum_type:
 	ENUM opt_type_params LCURLY seq_type RCURLY
 		{
@@ -495,17 +685,66 @@ trait_type:
 		{
 			$$ = &ast.CtorType{$1, $5, $4, $2, sym($1)}
 		}
+	| TRAIT opt_type_params COLON id_list LCURLY seq_trait_fun RCURLY
+		{
+			// supertraits lead the members as VarRef, so that their funcs are laid out first
+			var members []ast.Expr
+			for _, s := range $4 {
+				members = append(members, &ast.VarRef{$3, s})
+			}
+			$$ = &ast.CtorType{$1, $7, append(members, $6...), $2, sym($1)}
+		}
+
+effect_type:
+	EFFECT opt_type_params LCURLY seq_trait_fun RCURLY
+		{
+			$$ = &ast.CtorType{$1, $5, $4, $2, sym($1)}
+		}
 
 trait_fun:
-	IDENT func_params simple_type_annotation
+	IDENT opt_type_params func_params simple_type_annotation
 		{
 			tp := &ast.FuncType{
 				Token: $1,
-				Params: $2,
-				RetType: $3,
+				Params: $3,
+				TpParams: $2,
+				RetType: $4,
 			}
 			$$ = ast.Param{$1, sym($1), tp}
 		}
+	| IDENT opt_type_params func_params simple_type_annotation EQUAL LCURLY seq_exp RCURLY
+		{
+			ident := sym($1)
+			def := &ast.FuncDef{
+				FuncType: ast.FuncType{
+					Token: $1,
+					Params: $3,
+					TpParams: $2,
+					RetType: $4,
+				},
+				Symbol: ident,
+				Body: $7,
+			}
+			$$ = ast.Param{$1, ident, &ast.LetRec{$1, def, &ast.VarRef{$1, ident}}}
+		}
+	| TYPE IDENT
+		{ $$ = &ast.AssocType{$1, sym($2), nil} }
+	| CONST IDENT COLON type
+		{ $$ = &ast.AssocConst{$1, sym($2), $4, nil} }
+
+seq_impl_member:
+	impl_member
+		{ $$ = []ast.Expr{$1} }
+	| seq_impl_member SEMICOLON impl_member
+		{ $$ = append($1, $3) }
+
+impl_member:
+	exp
+		{ $$ = $1 }
+	| TYPE IDENT EQUAL type
+		{ $$ = &ast.AssocType{$1, sym($2), $4} }
+	| CONST IDENT COLON type EQUAL exp
+		{ $$ = &ast.AssocConst{$1, sym($2), $4, $6} }
 
 seq_trait_fun:
 	trait_fun
@@ -552,10 +791,38 @@ tpvar:
 		{
 			$$ = &ast.Param{$1, sym($1), nil}
 		}
-	| IDENT COLON IDENT
+	| IDENT COLON bounds
+		{
+			$$ = &ast.Param{$1, sym($1), $3}
+		}
+	| IDENT COLON CONST
+		{
+			$$ = &ast.Param{$3, sym($1), nil}
+		}
+
+bounds:
+	IDENT
+		{
+			$$ = &ast.VarRef{$1, ast.NewSymbol($1.Value())}
+		}
+	| bounds PLUS IDENT
+		{
+			$$ = mergeBounds($1, &ast.VarRef{$3, ast.NewSymbol($3.Value())})
+		}
+
+opt_where:
+		{ $$ = nil }
+	| WHERE where_list
+		{ $$ = $2 }
+
+where_list:
+	IDENT COLON bounds
 		{
-			id := &ast.VarRef{$3, ast.NewSymbol($3.Value())}
-			$$ = &ast.Param{$1, sym($1), id}
+			$$ = []*ast.Param{{$1, sym($1), $3}}
+		}
+	| where_list COMMA IDENT COLON bounds
+		{
+			$$ = append($1, &ast.Param{$3, sym($3), $5})
 		}
 
 id_list:
@@ -581,4 +848,54 @@ func sym(tok *token.Token) *ast.Symbol {
 	}
 }
 
+// mergeBounds joins trait bounds b1 and b2, each of which is VarRef or Bounds
+func mergeBounds(b1, b2 ast.Expr) ast.Expr {
+	var refs []*ast.VarRef
+	for _, b := range []ast.Expr{b1, b2} {
+		switch b := b.(type) {
+		case *ast.VarRef:
+			refs = append(refs, b)
+		case *ast.Bounds:
+			refs = append(refs, b.Refs...)
+		}
+	}
+	return &ast.Bounds{refs}
+}
+
+// applyWhere merges bounds of where clause into the type params they constrain
+func applyWhere(yylex yyLexer, tpParams []*ast.Param, where []*ast.Param) []*ast.Param {
+	for _, w := range where {
+		found := false
+		for _, p := range tpParams {
+			if p.Ident.Name != w.Ident.Name {
+				continue
+			}
+			found = true
+			if p.Type == nil {
+				p.Type = w.Type
+			} else {
+				p.Type = mergeBounds(p.Type, w.Type)
+			}
+		}
+		if !found {
+			yylex.Error("where clause constrains undeclared type parameter: " + w.Ident.Name)
+		}
+	}
+	return tpParams
+}
+
+// typeWhere applies where clause of type declaration to the type params of generic record
+func typeWhere(yylex yyLexer, t ast.Expr, where []*ast.Param) ast.Expr {
+	if where == nil {
+		return t
+	}
+	ctor, ok := t.(*ast.CtorType)
+	if !ok || ctor.TpParams == nil {
+		yylex.Error("where clause is only allowed on generic record type")
+		return t
+	}
+	ctor.TpParams = applyWhere(yylex, ctor.TpParams, where)
+	return t
+}
+
 // vim: noet
@@ -88,6 +88,14 @@ func (l *Lexer) emitIdent(ident string) {
 		l.emit(token.FOR)
 	case "let":
 		l.emit(token.LET)
+	case "val":
+		l.emit(token.VAL)
+	case "derive":
+		l.emit(token.DERIVE)
+	case "impl":
+		l.emit(token.IMPL)
+	case "where":
+		l.emit(token.WHERE)
 	case "in":
 		l.emit(token.IN)
 	case "rec":
@@ -112,6 +120,22 @@ func (l *Lexer) emitIdent(ident string) {
 		l.emit(token.EXTERNAL)
 	case "array":
 		l.emit(token.ARRAY)
+	case "throw":
+		l.emit(token.THROW)
+	case "try":
+		l.emit(token.TRY)
+	case "catch":
+		l.emit(token.CATCH)
+	case "effect":
+		l.emit(token.EFFECT)
+	case "handle":
+		l.emit(token.HANDLE)
+	case "yield":
+		l.emit(token.YIELD)
+	case "import":
+		l.emit(token.IMPORT)
+	case "const":
+		l.emit(token.CONST)
 	default:
 		l.emit(token.IDENT)
 	}
@@ -159,6 +183,16 @@ func (l *Lexer) forward() {
 	l.eof = false
 }
 
+// peek gives the rune following top without eating it
+func (l *Lexer) peek() rune {
+	r, _, err := l.input.ReadRune()
+	if err != nil {
+		return 0
+	}
+	l.input.UnreadRune()
+	return r
+}
+
 func (l *Lexer) eat() {
 	size := utf8.RuneLen(l.top)
 	l.current.Offset += size
@@ -304,16 +338,14 @@ func lexBar(l *Lexer) stateFn {
 	return lex
 }
 
-func lexLogicalAnd(l *Lexer) stateFn {
-	prev := l.top
+func lexAmpersand(l *Lexer) stateFn {
 	l.eat()
-
-	if prev != l.top {
-		l.expected("logical operator &&", l.top)
-		return nil
+	if l.top == '&' {
+		l.eat()
+		l.emit(token.AND_AND)
+	} else {
+		l.emit(token.AMP)
 	}
-	l.eat()
-	l.emit(token.AND_AND)
 
 	return lex
 }
@@ -370,8 +402,8 @@ func lexNumber(l *Lexer) stateFn {
 		l.eat()
 	}
 
-	// Note: Allow 1. as 1.0
-	if l.top == '.' {
+	// Note: Allow 1. as 1.0, but not 1.. which is int followed by '..'
+	if l.top == '.' && l.peek() != '.' {
 		tok = token.FLOAT
 		l.eat()
 		for isDigit(l.top) {
@@ -516,19 +548,27 @@ func lex(l *Lexer) stateFn {
 			l.emit(token.COMMA)
 		case '.':
 			l.eat()
-			l.emit(token.DOT)
+			if l.top == '.' {
+				l.eat()
+				l.emit(token.DOT_DOT)
+			} else {
+				l.emit(token.DOT)
+			}
 		case ';':
 			l.eat()
 			l.emit(token.SEMICOLON)
 		case '|':
 			return lexBar
 		case '&':
-			return lexLogicalAnd
+			return lexAmpersand
 		case '"':
 			return lexStringLiteral
 		case ':':
 			l.eat()
 			l.emit(token.COLON)
+		case '?':
+			l.eat()
+			l.emit(token.QUESTION)
 		case '[':
 			return lexLbracket
 		case ']':
@@ -69,6 +69,21 @@ const (
 	LBRACKET
 	RBRACKET
 	EXTERNAL
+	VAL
+	DERIVE
+	IMPL
+	WHERE
+	AMP
+	QUESTION
+	THROW
+	TRY
+	CATCH
+	EFFECT
+	HANDLE
+	YIELD
+	DOT_DOT
+	IMPORT
+	CONST
 	EOF
 )
 
@@ -133,6 +148,21 @@ var tokenTable = [...]string{
 	LBRACKET:       "[",
 	RBRACKET:       "]",
 	EXTERNAL:       "external",
+	VAL:            "val",
+	DERIVE:         "derive",
+	IMPL:           "impl",
+	WHERE:          "where",
+	AMP:            "&",
+	QUESTION:       "?",
+	THROW:          "throw",
+	TRY:            "try",
+	CATCH:          "catch",
+	EFFECT:         "effect",
+	HANDLE:         "handle",
+	YIELD:          "yield",
+	DOT_DOT:        "..",
+	IMPORT:         "import",
+	CONST:          "const",
 }
 
 // Token instance for GoCaml.
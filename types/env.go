@@ -2,6 +2,7 @@ package types
 
 import (
 	"strconv"
+	"strings"
 )
 
 type (
@@ -15,6 +16,12 @@ type (
 	ImplBundle struct {
 		Prefix string
 		Fns    map[string]*Func
+		// Traits uids of traits declared by `impl` block. Conformance to them is checked at declaration
+		Traits map[uint64]bool
+		// Assocs associated types bound by `impl` blocks
+		Assocs map[string]ValType
+		// Consts keys of methods defining associated constants
+		Consts map[string]bool
 	}
 
 	VoidImplBundle struct{}
@@ -36,12 +43,24 @@ type (
 		Ret    ValType
 		Params []ValType
 		TpVars []*TypeVar
+		// Effects effect row of func, the effects it may perform unhandled. Empty row means a pure func
+		Effects []*Effect
 	}
 
 	Arr struct {
 		VoidImplBundle
 		Ele  ValType
 		Size int
+		// SizeVar is the const type parameter standing for Size. nil if Size is known
+		SizeVar *TypeVar
+	}
+
+	// Ref is `ref[T]`, a mutable reference to a value of T, or raw pointer `ptr[T]` for FFI if Raw. Reference to
+	// stack local cannot be returned, while raw pointer is not checked.
+	Ref struct {
+		VoidImplBundle
+		Ele ValType
+		Raw bool
 	}
 
 	Rec struct {
@@ -51,6 +70,12 @@ type (
 		MemTps []ValType
 		TpVars []*TypeVar
 		Substs []ValType
+		// Anon anonymous tuple type like `(int, float)`. It is compared structurally rather than by Uid
+		Anon bool
+		// ReadOnly keys of fields declared by `val`
+		ReadOnly map[string]bool
+		// Frame frame of generator, which outlives the call making it, so it is allocated on heap
+		Frame bool
 	}
 
 	Enum struct {
@@ -60,6 +85,8 @@ type (
 		Tokens []string
 		TpVars []*TypeVar
 		Tps    []ValType
+		// Substs type arguments which TpVars are substituted by
+		Substs []ValType
 	}
 
 	Trait struct {
@@ -68,6 +95,24 @@ type (
 		Keys   []string
 		Fns    []*Func
 		TpVars []*TypeVar
+		// Defaults keys of funcs having default body. An implementor may omit them
+		Defaults map[string]bool
+		// Supers supertraits whose funcs are inherited. Their funcs are laid out ahead of own ones in Keys and Fns
+		Supers []*Trait
+		// Assocs associated types declared by `type item`. An implementor binds them in its impl block
+		Assocs []*TypeVar
+		// Consts keys of funcs standing for associated constants, which are accessed without call
+		Consts map[string]bool
+	}
+
+	// Effect is declared by `effect{ ops }`. An operation is performed by `e.op(args)` in code whose row has the
+	// effect, and is handled by the innermost `handle` of the effect at runtime.
+	Effect struct {
+		VoidImplBundle
+		Uid  uint64
+		Name string
+		Keys []string
+		Ops  []*Func
 	}
 
 	Symbol struct {
@@ -80,6 +125,18 @@ type (
 		VoidImplBundle
 		Name  string
 		Lower ValType
+		// Const marks a type parameter of kind int, e.g. `N:const`. It is substituted by ConstInt
+		Const bool
+		// Assoc marks an associated type declared in trait
+		Assoc bool
+		// Proj is the type param which associated type Key is projected from, e.g. T of `T.item`
+		Proj *TypeVar
+		Key  string
+	}
+
+	ConstInt struct {
+		VoidImplBundle
+		Val int
 	}
 
 	App struct {
@@ -88,6 +145,19 @@ type (
 		TpArgs []ValType
 		Args   []ValType
 	}
+
+	// Fix refers to a record or enum by its declaration, like `list[T]` in the members of list itself. It is
+	// unfolded to the declared type on access, thus recursive type stays finite.
+	Fix struct {
+		Decl *FixDecl
+		Args []ValType
+	}
+
+	// FixDecl is the declaration Fix refers to. Tp is filled once the declaration is emitted
+	FixDecl struct {
+		Name string
+		Tp   ValType
+	}
 )
 
 const (
@@ -104,6 +174,10 @@ const (
 	TpSym
 	TpFunc
 	TpApp
+	TpConst
+	TpFix
+	TpRef
+	TpEffect
 )
 
 var (
@@ -125,6 +199,10 @@ var _ ValType = (*Rec)(nil)
 var _ ValType = (*Enum)(nil)
 var _ ValType = (*Trait)(nil)
 var _ ValType = (*Symbol)(nil)
+var _ ValType = (*ConstInt)(nil)
+var _ ValType = (*Fix)(nil)
+var _ ValType = (*Ref)(nil)
+var _ ValType = (*Effect)(nil)
 
 func IsPrimitive(t ValType) bool {
 	_, ok := t.(*primitiveType)
@@ -162,6 +240,8 @@ func (t *primitiveType) String() string {
 		return "float"
 	case TpBool:
 		return "bool"
+	case TpVoidPtr:
+		return "void*"
 	default:
 		panic("unsupported type: " + strconv.Itoa(int(t.tp)))
 	}
@@ -172,6 +252,9 @@ func (t *primitiveType) Code() int {
 }
 
 func (t *Arr) String() string {
+	if t.SizeVar != nil {
+		return "arr<" + t.Ele.String() + ", " + t.SizeVar.String() + ">"
+	}
 	return "arr<" + t.Ele.String() + ", " + strconv.Itoa(t.Size) + ">"
 }
 
@@ -179,6 +262,17 @@ func (t *Arr) Code() int {
 	return TpArr
 }
 
+func (t *Ref) String() string {
+	if t.Raw {
+		return "ptr[" + t.Ele.String() + "]"
+	}
+	return "ref[" + t.Ele.String() + "]"
+}
+
+func (t *Ref) Code() int {
+	return TpRef
+}
+
 func (t *Rec) String() string {
 	var str string
 	if len(t.TpVars) > 0 {
@@ -198,6 +292,16 @@ func (t *Rec) String() string {
 		}
 		str += key + ":" + t.MemTps[i].String()
 	}
+	if t.Anon {
+		str = "("
+		for i, tp := range t.MemTps {
+			if i > 0 {
+				str += ", "
+			}
+			str += tp.String()
+		}
+		return str + ")"
+	}
 	return "rec" + str + "}"
 }
 
@@ -275,6 +379,91 @@ func (t *Trait) Code() int {
 	return TpTrait
 }
 
+func (t *Effect) String() string {
+	if t.Name != "" {
+		return t.Name
+	}
+	return "effect{" + strings.Join(t.Keys, ", ") + "}"
+}
+
+func (t *Effect) Code() int {
+	return TpEffect
+}
+
+// KeyIndex gives index of operation k in Keys, -1 if not found
+func (t *Effect) KeyIndex(k string) int {
+	for i, key := range t.Keys {
+		if key == k {
+			return i
+		}
+	}
+	return -1
+}
+
+// HasEffect tests if effect row has eff
+func HasEffect(row []*Effect, eff *Effect) bool {
+	for _, r := range row {
+		if r.Uid == eff.Uid {
+			return true
+		}
+	}
+	return false
+}
+
+// Inherits tests if t has super as one of its supertraits, directly or transitively
+func (t *Trait) Inherits(super *Trait) bool {
+	for _, s := range t.Supers {
+		if s.Uid == super.Uid || s.Inherits(super) {
+			return true
+		}
+	}
+	return false
+}
+
+// KeyIndex gives index of func k in Keys, -1 if not found
+func (t *Trait) KeyIndex(k string) int {
+	for i, key := range t.Keys {
+		if key == k {
+			return i
+		}
+	}
+	return -1
+}
+
+// AssocIndex gives index of associated type k in Assocs, -1 if not found
+func (t *Trait) AssocIndex(k string) int {
+	for i, a := range t.Assocs {
+		if a.Name == k {
+			return i
+		}
+	}
+	return -1
+}
+
+// SuperOf finds the supertrait declaring func k. nil if k is declared by t itself
+func (t *Trait) SuperOf(k string) *Trait {
+	for _, s := range t.Supers {
+		if s.KeyIndex(k) >= 0 {
+			return s
+		}
+	}
+	return nil
+}
+
+// SameVtable tests if t and o have the same funcs in the same order. Then a boxed value of o can be used as t as is,
+// as both boxes are of the same layout. A supertrait box is of a shorter vtable, so it needs the vtable sliced
+func (t *Trait) SameVtable(o *Trait) bool {
+	if len(t.Keys) != len(o.Keys) {
+		return false
+	}
+	for i, k := range t.Keys {
+		if o.Keys[i] != k {
+			return false
+		}
+	}
+	return true
+}
+
 func (t *Symbol) Code() int {
 	return TpSym
 }
@@ -302,7 +491,16 @@ func (t *Func) String() string {
 		}
 		str += p.String()
 	}
-	return str + ")" + "->" + t.Ret.String()
+	str += ")" + "->" + t.Ret.String()
+	for i, eff := range t.Effects {
+		if i == 0 {
+			str += " with "
+		} else {
+			str += ", "
+		}
+		str += eff.String()
+	}
+	return str
 }
 
 func (t *Func) Code() int {
@@ -311,6 +509,9 @@ func (t *Func) Code() int {
 
 func (t *TypeVar) String() string {
 	str := "'" + t.Name
+	if t.Const {
+		return str + ":const"
+	}
 	if t.Lower == nil {
 		return str
 	}
@@ -321,6 +522,14 @@ func (t *TypeVar) Code() int {
 	return TpVar
 }
 
+func (t *ConstInt) String() string {
+	return strconv.Itoa(t.Val)
+}
+
+func (t *ConstInt) Code() int {
+	return TpConst
+}
+
 func (t *App) String() string {
 	var str string
 	if len(t.TpArgs) > 0 {
@@ -349,3 +558,28 @@ func (t *App) Code() int {
 func (t *App) Impls() *ImplBundle {
 	return nil
 }
+
+func (t *Fix) String() string {
+	if len(t.Args) == 0 {
+		return t.Decl.Name
+	}
+	str := t.Decl.Name + "["
+	for i, a := range t.Args {
+		if i > 0 {
+			str += ", "
+		}
+		str += a.String()
+	}
+	return str + "]"
+}
+
+func (t *Fix) Code() int {
+	return TpFix
+}
+
+func (t *Fix) Impls() *ImplBundle {
+	if t.Decl.Tp == nil {
+		return nil
+	}
+	return t.Decl.Tp.Impls()
+}
@@ -42,8 +42,77 @@ func TypeCheckMutate(left, right ValType) error {
 	return TypeCompatible(left, right)
 }
 
+// Comparable tests if values of t can be compared structurally. Records, tuples, arrays and enums are compared by
+// equality member-wise, enums by discriminant plus payload. Ordering is only defined for numbers and tuples of
+// ordered elements, which compare lexicographically.
+func Comparable(t ValType, ordered bool) error {
+	return checkComparable(t, ordered, true)
+}
+
+func checkComparable(t ValType, ordered, top bool) error {
+	switch tp := t.(type) {
+	case *Rec:
+		if ordered && !tp.Anon {
+			return errors.NewError(errors.TYPE_INCOMPARABLE, "record "+t.String()+" has no ordering")
+		}
+		for _, m := range tp.MemTps {
+			if err := checkComparable(m, ordered, false); err != nil {
+				return err
+			}
+		}
+		return nil
+	case *Arr:
+		if ordered {
+			return errors.NewError(errors.TYPE_INCOMPARABLE, "array "+t.String()+" has no ordering")
+		}
+		// array length is only known at runtime through the const param passed to current function
+		if tp.SizeVar != nil && !top {
+			return errors.NewError(errors.TYPE_INCOMPARABLE, "nested array "+t.String()+" sized by const param is not comparable")
+		}
+		return checkComparable(tp.Ele, false, false)
+	case *Enum:
+		if ordered {
+			return errors.NewError(errors.TYPE_INCOMPARABLE, "enum "+t.String()+" has no ordering")
+		}
+		for _, v := range tp.Tps {
+			if v.Code() == TpSym {
+				continue
+			}
+			if err := checkComparable(v, false, false); err != nil {
+				return err
+			}
+		}
+		return nil
+	case *TypeVar:
+		if tp.Lower != nil {
+			return checkComparable(tp.Lower, ordered, top)
+		}
+		return errors.NewError(errors.TYPE_INCOMPARABLE, "type var "+t.String()+" is not comparable")
+	}
+	switch t.Code() {
+	case TpInt, TpFloat:
+		return nil
+	case TpBool, TpUnit:
+		if !ordered {
+			return nil
+		}
+	}
+	return errors.NewError(errors.TYPE_INCOMPARABLE, t.String()+" is not comparable")
+}
+
 // TypeCompatible mainly test if t1 can as a container to receive t2
 func TypeCompatible(t1, t2 ValType) error {
+	if t1.Code() == TpFix || t2.Code() == TpFix {
+		u1, err := Unfold(t1)
+		if err != nil {
+			return err
+		}
+		u2, err := Unfold(t2)
+		if err != nil {
+			return err
+		}
+		return TypeCompatible(u1, u2)
+	}
 	// int and simple enum are compatible
 	if (t1.Code() == TpInt && t2.Code() == TpEnum && t2.(*Enum).Simple) || (t2.Code() == TpInt && t1.Code() == TpEnum && t1.(*Enum).Simple) {
 		return nil
@@ -62,6 +131,9 @@ func TypeCompatible(t1, t2 ValType) error {
 		}
 		return errors.NewError(errors.TYPE_INCOMPATIBLE_PRIMITIVE, t1.String()+" and "+t2.String()+" not compatible")
 	case TpRec:
+		if t1.(*Rec).Anon {
+			return anonTupleCompatible(t1.(*Rec), t2)
+		}
 		if t2.Code() != t1.Code() || t1.(*Rec).Uid != t2.(*Rec).Uid || len(t1.(*Rec).Substs) != len(t2.(*Rec).Substs) {
 			return errors.NewError(errors.TYPE_INCOMPATIBLE_RECORD, "record "+t1.String()+" and "+t2.String()+" not compatible")
 		}
@@ -79,10 +151,21 @@ func TypeCompatible(t1, t2 ValType) error {
 		if t1.(*Enum).Uid != t2.(*Enum).Uid {
 			return errors.NewError(errors.TYPE_INCOMPATIBLE_ENUM, "enum "+t1.String()+" and "+t2.String()+" not compatible")
 		}
+		return nil
 	case TpTrait:
 		if t1.Code() == t2.Code() && t1.(*Trait).Uid == t2.(*Trait).Uid {
 			return nil
 		}
+		if tv, ok := t2.(*TypeVar); ok {
+			// a bounded type var satisfies trait by its bound
+			if tv.Lower == nil {
+				return errors.NewError(errors.TYPE_INCOMPATIBLE_TRAIT, "trait "+t1.String()+" and "+t2.String()+" not compatible")
+			}
+			return TypeCompatible(t1, tv.Lower)
+		}
+		if t2.Code() == TpTrait && t2.(*Trait).Inherits(t1.(*Trait)) {
+			return nil
+		}
 		var impls map[string]*Func
 		if t2.Code() == TpTrait {
 			impls = map[string]*Func{}
@@ -93,35 +176,393 @@ func TypeCompatible(t1, t2 ValType) error {
 			impls = t2.Impls().Fns
 		}
 		tt := t1.(*Trait)
-		if len(impls) < len(tt.Fns) {
-			return errors.NewError(errors.TYPE_INCOMPATIBLE_TRAIT, "trait "+t1.String()+" and "+t2.String()+" not compatible")
+		if bundle := t2.Impls(); bundle != nil && bundle.Traits[tt.Uid] {
+			// conformance is already checked by `impl` block
+			return nil
+		}
+		if len(tt.Assocs) > 0 && t2.Code() != TpTrait {
+			return errors.NewError(errors.TYPE_INCOMPATIBLE_TRAIT, "trait "+t1.String()+" and "+t2.String()+" not compatible. associated type is bound only by impl block")
 		}
+		// trait receiver is reused as is without boxing, so it has to provide every func in place
+		useDefault := t2.Code() != TpTrait
 		for i, k := range tt.Keys {
-			traitFn := tt.Fns[i]
 			rightFn, ok := impls[k]
-			if !ok {
-				return errors.NewError(errors.TYPE_INCOMPATIBLE_TRAIT, "trait "+t1.String()+" and "+t2.String()+" not compatible. missing fun: "+k)
-			}
-			if len(traitFn.Params) != len(rightFn.Params) {
-				return errors.NewError(errors.TYPE_INCOMPATIBLE_TRAIT, "trait "+t1.String()+" and "+t2.String()+" not compatible. fun "+k+" params not compatible")
+			if !ok && useDefault && tt.Defaults[k] {
+				continue
 			}
-			for i := 1; i < len(traitFn.Params); i++ {
-				if err := TypeCompatible(traitFn.Params[i], rightFn.Params[i]); err != nil {
-					return err
+			if !ok {
+				msg := "trait " + t1.String() + " and " + t2.String() + " not compatible. missing fun: " + k
+				if tt.SuperOf(k) != nil {
+					msg += " of supertrait"
 				}
+				return errors.NewError(errors.TYPE_INCOMPATIBLE_TRAIT, msg)
 			}
-			if err := TypeCompatible(traitFn.Ret, rightFn.Ret); err != nil {
+			if err := MethodCompatible(tt, i, t2, rightFn); err != nil {
 				return err
 			}
 		}
 		return nil
 	case TpArr:
-		// TODO not handle array type check for the moment
+		if t2.Code() != t1.Code() || !sameArrSize(t1.(*Arr), t2.(*Arr)) {
+			return errors.NewError(errors.TYPE_INCOMPATIBLE_ARRAY, "array "+t1.String()+" and "+t2.String()+" not compatible")
+		}
+		ele1, ele2 := t1.(*Arr).Ele, t2.(*Arr).Ele
+		// elements are stored in place, a trait array can only receive an array of the very same trait
+		if ele1.Code() == TpTrait && (ele2.Code() != TpTrait || ele1.(*Trait).Uid != ele2.(*Trait).Uid) {
+			return errors.NewError(errors.TYPE_INCOMPATIBLE_ARRAY, "array "+t1.String()+" and "+t2.String()+" not compatible. element need box")
+		}
+		if err := TypeCompatible(ele1, ele2); err != nil {
+			return errors.NewError(errors.TYPE_INCOMPATIBLE_ARRAY, "array "+t1.String()+" and "+t2.String()+" not compatible. "+err.Error())
+		}
+		return nil
+	case TpRef:
+		// ref converts to ptr but not vice versa. element is written through reference, so it is invariant
+		r1, ok := t2.(*Ref)
+		if !ok || (r1.Raw && !t1.(*Ref).Raw) {
+			return errors.NewError(errors.TYPE_INCOMPATIBLE_REF, "reference "+t1.String()+" and "+t2.String()+" not compatible")
+		}
+		ele1, ele2 := t1.(*Ref).Ele, r1.Ele
+		if TypeCompatible(ele1, ele2) != nil || TypeCompatible(ele2, ele1) != nil {
+			return errors.NewError(errors.TYPE_INCOMPATIBLE_REF, "reference "+t1.String()+" and "+t2.String()+" not compatible")
+		}
 		return nil
 	}
 	return errors.NewError(errors.INTERNAL_ERROR, "unhandled type compatible check left: "+t1.String()+". right: "+t2.String())
 }
 
+// IsSelf tests if t, as param or return type of a func of trait tt, stands for the implementing type. A trait func
+// referring to the trait itself means Self, like `eq(o: Eq): bool` of builtin Eq.
+func IsSelf(tt *Trait, t ValType) bool {
+	st, ok := t.(*Trait)
+	return ok && st.Uid == tt.Uid
+}
+
+// InheritFunc rebinds func fn of supertrait super to trait sub. Receiver and Self of super become sub
+func InheritFunc(super, sub *Trait, fn *Func) *Func {
+	params := make([]ValType, len(fn.Params))
+	for i, p := range fn.Params {
+		if i == 0 || IsSelf(super, p) {
+			params[i] = sub
+		} else {
+			params[i] = p
+		}
+	}
+	ret := fn.Ret
+	if IsSelf(super, ret) {
+		ret = sub
+	}
+	TpUidCounter++
+	return &Func{
+		Uid:    TpUidCounter,
+		Params: params,
+		Ret:    ret,
+		TpVars: fn.TpVars,
+	}
+}
+
+// ProjectAssoc resolves associated type key of t. It stays as a projection like `T.item` if t is a type param
+func ProjectAssoc(t ValType, key string) (ValType, error) {
+	if tv, ok := t.(*TypeVar); ok {
+		if tt, ok := tv.Lower.(*Trait); ok && tt.AssocIndex(key) >= 0 {
+			return &TypeVar{Name: tv.Name + "." + key, Proj: tv, Key: key}, nil
+		}
+		return nil, errors.NewError(errors.TYPE_ASSOC_ILLEGAL, "type var "+tv.String()+" has no associated type "+key)
+	}
+	if impl := t.Impls(); impl != nil {
+		if a, ok := impl.Assocs[key]; ok {
+			return a, nil
+		}
+	}
+	return nil, errors.NewError(errors.TYPE_ASSOC_ILLEGAL, t.String()+" has no associated type "+key)
+}
+
+// HasAssoc tests if trait func fn takes or gives associated type of the trait
+func HasAssoc(fn *Func) bool {
+	tps := []ValType{fn.Ret}
+	for _, t := range append(tps, fn.Params[1:]...) {
+		if tv, ok := t.(*TypeVar); ok && tv.Assoc {
+			return true
+		}
+		if t.Code() == TpTrait {
+			continue
+		}
+		for _, tv := range CollectTpVar(t) {
+			if tv.Assoc {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Mentions tests if t uses any of type vars tpVars
+func Mentions(t ValType, tpVars []*TypeVar) bool {
+	used := CollectTpVar(t)
+	for _, tv := range tpVars {
+		if _, ok := used[tv.Name]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// SameSignature tests if two trait funcs take and give the same types, the leading receiver param aside
+func SameSignature(f1, f2 *Func) bool {
+	if len(f1.Params) != len(f2.Params) {
+		return false
+	}
+	for i := 1; i < len(f1.Params); i++ {
+		if TypeCompatible(f1.Params[i], f2.Params[i]) != nil || TypeCompatible(f2.Params[i], f1.Params[i]) != nil {
+			return false
+		}
+	}
+	return TypeCompatible(f1.Ret, f2.Ret) == nil && TypeCompatible(f2.Ret, f1.Ret) == nil
+}
+
+// MethodCompatible checks fn implemented by impl against the i-th func of trait tt. The leading receiver param is
+// not compared
+func MethodCompatible(tt *Trait, i int, impl ValType, fn *Func) error {
+	k := tt.Keys[i]
+	traitFn := tt.Fns[i]
+	for _, eff := range fn.Effects {
+		// trait call site knows only the row of trait func
+		if !HasEffect(traitFn.Effects, eff) {
+			return errors.NewError(errors.TYPE_INCOMPATIBLE_TRAIT, "trait "+tt.String()+" and "+impl.String()+" not compatible. fun "+k+" performs effect "+eff.String())
+		}
+	}
+	if len(traitFn.Params) != len(fn.Params) {
+		return errors.NewError(errors.TYPE_INCOMPATIBLE_TRAIT, "trait "+tt.String()+" and "+impl.String()+" not compatible. fun "+k+" params not compatible")
+	}
+	fn, err := renameOwnTpVars(traitFn, impl, fn)
+	if err != nil {
+		return errors.NewError(errors.TYPE_INCOMPATIBLE_TRAIT, "trait "+tt.String()+" and "+impl.String()+" not compatible. fun "+k+" "+err.Error())
+	}
+	for j := 1; j < len(traitFn.Params); j++ {
+		if IsSelf(tt, traitFn.Params[j]) {
+			if err := selfCompatible(impl, fn.Params[j]); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := TypeCompatible(traitFn.Params[j], fn.Params[j]); err != nil {
+			return err
+		}
+	}
+	if IsSelf(tt, traitFn.Ret) {
+		return selfCompatible(impl, fn.Ret)
+	}
+	return TypeCompatible(traitFn.Ret, fn.Ret)
+}
+
+// renameOwnTpVars renames type params of implementing func fn to those of trait func traitFn by position, so that
+// generic funcs are compared as the same. Type params of a generic receiver follow the func's own ones in fn.TpVars.
+func renameOwnTpVars(traitFn *Func, impl ValType, fn *Func) (*Func, error) {
+	own := fn.TpVars
+	var rcvTpVars []*TypeVar
+	switch t := impl.(type) {
+	case *Rec:
+		rcvTpVars = t.TpVars
+	case *Enum:
+		rcvTpVars = t.TpVars
+	}
+	if len(own) >= len(rcvTpVars) {
+		own = own[:len(own)-len(rcvTpVars)]
+	}
+	if len(own) != len(traitFn.TpVars) {
+		return nil, errors.NewError(errors.TYPE_INCOMPATIBLE_TRAIT, "type params not compatible")
+	}
+	if len(own) == 0 {
+		return fn, nil
+	}
+	set := map[string]ValType{}
+	for j, tv := range own {
+		ttv := traitFn.TpVars[j]
+		if tv.Const != ttv.Const || (tv.Lower == nil) != (ttv.Lower == nil) {
+			return nil, errors.NewError(errors.TYPE_INCOMPATIBLE_TRAIT, "type param "+tv.String()+" not compatible")
+		}
+		// a bounded arg is boxed to its bound by caller, thus the bounds must be the same
+		if tv.Lower != nil && (TypeCompatible(tv.Lower, ttv.Lower) != nil || TypeCompatible(ttv.Lower, tv.Lower) != nil) {
+			return nil, errors.NewError(errors.TYPE_INCOMPATIBLE_TRAIT, "type param "+tv.String()+" not compatible")
+		}
+		set[tv.Name] = ttv
+	}
+	params, err := SubstList(fn.Params[1:], set)
+	if err != nil {
+		return nil, err
+	}
+	ret, err := Subst(fn.Ret, set)
+	if err != nil {
+		return nil, err
+	}
+	return &Func{
+		Uid:    fn.Uid,
+		Params: append([]ValType{fn.Params[0]}, params...),
+		Ret:    ret,
+	}, nil
+}
+
+// selfCompatible tests if tp of implementing func is the Self of implementor impl. For trait implementor, Self is
+// the trait itself.
+func selfCompatible(impl, tp ValType) error {
+	if it, ok := impl.(*Trait); ok {
+		if !IsSelf(it, tp) {
+			return errors.NewError(errors.TYPE_INCOMPATIBLE_TRAIT, "trait "+impl.String()+" Self and "+tp.String()+" not compatible")
+		}
+		return nil
+	}
+	return TypeCompatible(impl, tp)
+}
+
+// Derivable tests if builtin trait methods can be derived for t. Derived methods walk the whole shape of t, thus
+// t cannot hold trait, function or type var. ordered additionally needs every member ordered, enum is ordered by
+// discriminant first.
+func Derivable(t ValType, ordered bool) error {
+	switch tp := t.(type) {
+	case *Rec:
+		for _, m := range tp.MemTps {
+			if err := Derivable(m, ordered); err != nil {
+				return err
+			}
+		}
+		return nil
+	case *Arr:
+		if ordered {
+			return errors.NewError(errors.TYPE_DERIVE_ILLEGAL, "array "+t.String()+" has no ordering")
+		}
+		if tp.SizeVar != nil {
+			return errors.NewError(errors.TYPE_DERIVE_ILLEGAL, "array "+t.String()+" sized by const param")
+		}
+		return Derivable(tp.Ele, false)
+	case *Enum:
+		for _, v := range tp.Tps {
+			if v.Code() == TpSym {
+				continue
+			}
+			if err := Derivable(v, ordered); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	switch t.Code() {
+	case TpInt, TpFloat:
+		return nil
+	case TpBool, TpUnit:
+		if !ordered {
+			return nil
+		}
+	}
+	return errors.NewError(errors.TYPE_DERIVE_ILLEGAL, t.String()+" is not derivable")
+}
+
+// anonTupleCompatible anonymous tuple is structural. Each member is stored in place, thus member is compared as array
+// element, that a trait member can only receive the very same trait.
+func anonTupleCompatible(t1 *Rec, t2 ValType) error {
+	t2r, ok := t2.(*Rec)
+	if !ok || !t2r.Anon || len(t1.MemTps) != len(t2r.MemTps) {
+		return errors.NewError(errors.TYPE_INCOMPATIBLE_RECORD, "tuple "+t1.String()+" and "+t2.String()+" not compatible")
+	}
+	for i, m1 := range t1.MemTps {
+		m2 := t2r.MemTps[i]
+		if m1.Code() == TpTrait && (m2.Code() != TpTrait || m1.(*Trait).Uid != m2.(*Trait).Uid) {
+			return errors.NewError(errors.TYPE_INCOMPATIBLE_RECORD, "tuple "+t1.String()+" and "+t2.String()+" not compatible. member need box")
+		}
+		if err := TypeCompatible(m1, m2); err != nil {
+			return errors.NewError(errors.TYPE_INCOMPATIBLE_RECORD, "tuple "+t1.String()+" and "+t2.String()+" not compatible. "+err.Error())
+		}
+	}
+	return nil
+}
+
+// WidthSubtype tests if record t2 is a width subtype of record t1, that is t2 has every field of t1 of the same type
+// and more. Records of the very same fields stay distinct types. A value of t2 is coerced to t1 by projecting the
+// fields, thus record is not compatible with its width supertype in place, e.g. as type argument or array element.
+func WidthSubtype(t1, t2 ValType) error {
+	r1, ok1 := t1.(*Rec)
+	r2, ok2 := t2.(*Rec)
+	if !ok1 || !ok2 || r1.Anon || r2.Anon || r1.Uid == r2.Uid {
+		return errors.NewError(errors.TYPE_INCOMPATIBLE_RECORD, "record "+t1.String()+" and "+t2.String()+" have no width subtyping")
+	}
+	if len(r1.TpVars) > 0 || len(r2.TpVars) > 0 {
+		return errors.NewError(errors.TYPE_INCOMPATIBLE_RECORD, "generic record "+t1.String()+" and "+t2.String()+" have no width subtyping")
+	}
+	if len(r2.Keys) <= len(r1.Keys) {
+		return errors.NewError(errors.TYPE_INCOMPATIBLE_RECORD, "record "+t2.String()+" is not subtype of "+t1.String()+". no extra field")
+	}
+	for i, k := range r1.Keys {
+		idx := r2.KeyIndex(k)
+		if idx < 0 {
+			return errors.NewError(errors.TYPE_INCOMPATIBLE_RECORD, "record "+t2.String()+" is not subtype of "+t1.String()+". missing field: "+k)
+		}
+		// fields are invariant, as field of record type is projected by reference
+		m1, m2 := r1.MemTps[i], r2.MemTps[idx]
+		if TypeCompatible(m1, m2) != nil || TypeCompatible(m2, m1) != nil {
+			return errors.NewError(errors.TYPE_INCOMPATIBLE_RECORD, "record "+t2.String()+" is not subtype of "+t1.String()+". field "+k+" of different type")
+		}
+	}
+	return nil
+}
+
+// Subtype tests if a value of t2 can be used as t1, either compatible in place or by width subtyping of record
+func Subtype(t1, t2 ValType) error {
+	err := TypeCompatible(t1, t2)
+	if err != nil && WidthSubtype(t1, t2) == nil {
+		return nil
+	}
+	return err
+}
+
+// sameArrSize compares sizes of two arrays. A generic size only equals to the very same const type parameter
+func sameArrSize(a1, a2 *Arr) bool {
+	if a1.SizeVar != nil || a2.SizeVar != nil {
+		return a1.SizeVar != nil && a2.SizeVar != nil && a1.SizeVar.Name == a2.SizeVar.Name
+	}
+	return a1.Size == a2.Size
+}
+
+// Unfold gives the declared type Fix refers to, substituted by its type args. Other types stay as is. Members of the
+// unfolded type may be Fix again, so it is unfolded by one level only.
+func Unfold(t ValType) (ValType, error) {
+	fix, ok := t.(*Fix)
+	if !ok {
+		return t, nil
+	}
+	if fix.Decl.Tp == nil {
+		return nil, errors.NewError(errors.TYPE_RECURSIVE_ILLEGAL, "type "+fix.Decl.Name+" is used before its declaration is done")
+	}
+	return SubstRoot(fix.Decl.Tp, fix.Args)
+}
+
+// Recursive tests if record t, or a variant of enum t, has member referring to a declaration by Fix. Value of such
+// type may be reached from itself, so it is allocated on heap rather than stack.
+func Recursive(t ValType) bool {
+	switch tp := t.(type) {
+	case *Rec:
+		for _, m := range tp.MemTps {
+			if refersFix(m) {
+				return true
+			}
+		}
+	case *Enum:
+		for _, v := range tp.Tps {
+			if v.Code() == TpFix || Recursive(v) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func refersFix(t ValType) bool {
+	switch tp := t.(type) {
+	case *Fix:
+		return true
+	case *Arr:
+		return refersFix(tp.Ele)
+	}
+	return false
+}
+
 func HasTpVar(t ValType) bool {
 	if t.Code() == TpVar {
 		return true
@@ -150,7 +591,13 @@ func CollectTpVar(t ValType) map[string]*TypeVar {
 				walk(arg)
 			}
 		case *Trait:
-			for _, arg := range tp.Fns {
+			for name, tv := range traitFreeTpVars(tp) {
+				set[name] = tv
+			}
+		case *Arr:
+			walk(tp.Ele)
+		case *Fix:
+			for _, arg := range tp.Args {
 				walk(arg)
 			}
 		}
@@ -159,6 +606,30 @@ func CollectTpVar(t ValType) map[string]*TypeVar {
 	return set
 }
 
+// traitFreeTpVars collects type vars used by funcs of trait tt, except for type params of the funcs themselves and
+// associated types, which are not free in tt. Self is skipped as it is tt itself.
+func traitFreeTpVars(tt *Trait) map[string]*TypeVar {
+	set := map[string]*TypeVar{}
+	for _, fn := range tt.Fns {
+		own := map[string]bool{}
+		for _, tv := range fn.TpVars {
+			own[tv.Name] = true
+		}
+		tps := []ValType{fn.Ret}
+		for _, t := range append(tps, fn.Params[1:]...) {
+			if IsSelf(tt, t) {
+				continue
+			}
+			for name, tv := range CollectTpVar(t) {
+				if !own[name] && !tv.Assoc {
+					set[name] = tv
+				}
+			}
+		}
+	}
+	return set
+}
+
 func HasPartialTpVar(t ValType) bool {
 	var walk func(tt ValType) bool
 	walk = func(tt ValType) bool {
@@ -185,20 +656,9 @@ func HasPartialTpVar(t ValType) bool {
 			if len(tp.TpVars) > 0 {
 				return true
 			}
-			for _, fn := range tp.Fns {
-				for _, arg := range fn.Params {
-					if arg.Code() == TpTrait && arg.(*Trait).Uid == tp.Uid {
-						continue
-					}
-					if walk(arg) {
-						return true
-					}
-				}
-				if fn.Ret.Code() == TpTrait && fn.Ret.(*Trait).Uid == tp.Uid {
-					return false
-				}
-				return walk(fn.Ret)
-			}
+			return len(traitFreeTpVars(tp)) > 0
+		case *Fix:
+			return len(tp.Args) > 0
 		}
 		return false
 	}
@@ -241,8 +701,17 @@ func Subst(t ValType, set map[string]ValType) (ValType, error) {
 	}
 	switch tp := t.(type) {
 	case *TypeVar:
+		if tp.Proj != nil {
+			if s, ok := set[tp.Proj.Name]; ok {
+				return ProjectAssoc(s, tp.Key)
+			}
+			return t, nil
+		}
 		s, ok := set[tp.Name]
 		if ok {
+			if err := checkConstSubst(tp, s); err != nil {
+				return nil, err
+			}
 			if tp.Lower != nil {
 				if err := TypeCompatible(tp.Lower, s); err != nil {
 					return nil, err
@@ -261,9 +730,10 @@ func Subst(t ValType, set map[string]ValType) (ValType, error) {
 			return nil, err
 		}
 		return &Func{
-			Uid:    tp.Uid,
-			Ret:    ret,
-			Params: tps,
+			Uid:     tp.Uid,
+			Ret:     ret,
+			Params:  tps,
+			Effects: tp.Effects,
 		}, nil
 	case *Rec:
 		var substs []ValType
@@ -288,13 +758,61 @@ func Subst(t ValType, set map[string]ValType) (ValType, error) {
 			MemTps:     tps,
 			TpVars:     tpVars,
 			Substs:     substs,
+			Anon:       tp.Anon,
+			ReadOnly:   tp.ReadOnly,
 		}
 		return tr, nil
+	case *Fix:
+		args, err := SubstList(tp.Args, set)
+		if err != nil {
+			return nil, err
+		}
+		return &Fix{
+			Decl: tp.Decl,
+			Args: args,
+		}, nil
+	case *Arr:
+		ele, err := Subst(tp.Ele, set)
+		if err != nil {
+			return nil, err
+		}
+		arr := &Arr{
+			Ele:     ele,
+			Size:    tp.Size,
+			SizeVar: tp.SizeVar,
+		}
+		if tp.SizeVar != nil {
+			if s, ok := set[tp.SizeVar.Name]; ok {
+				if err := checkConstSubst(tp.SizeVar, s); err != nil {
+					return nil, err
+				}
+				switch size := s.(type) {
+				case *ConstInt:
+					arr.Size, arr.SizeVar = size.Val, nil
+				case *TypeVar:
+					arr.SizeVar = size
+				}
+			}
+		}
+		return arr, nil
 	case *Enum:
 		tps, err := SubstList(tp.Tps, set)
 		if err != nil {
 			return nil, err
 		}
+		substs := tp.Substs
+		if substs == nil {
+			for _, tv := range tp.TpVars {
+				if s, ok := set[tv.Name]; ok {
+					substs = append(substs, s)
+				}
+			}
+		} else {
+			substs, err = SubstList(substs, set)
+			if err != nil {
+				return nil, err
+			}
+		}
 		return &Enum{
 			ImplBundle: tp.ImplBundle,
 			Uid:        tp.Uid,
@@ -302,6 +820,7 @@ func Subst(t ValType, set map[string]ValType) (ValType, error) {
 			Tokens:     tp.Tokens,
 			TpVars:     tp.TpVars,
 			Tps:        tps,
+			Substs:     substs,
 		}, nil
 	case *Trait:
 		var tpVars []*TypeVar
@@ -322,9 +841,13 @@ func Subst(t ValType, set map[string]ValType) (ValType, error) {
 			}
 		}
 		trait := &Trait{
-			Uid:    tp.Uid,
-			Keys:   tp.Keys,
-			TpVars: tpVars,
+			Uid:      tp.Uid,
+			Keys:     tp.Keys,
+			TpVars:   tpVars,
+			Defaults: tp.Defaults,
+			Supers:   tp.Supers,
+			Assocs:   tp.Assocs,
+			Consts:   tp.Consts,
 		}
 		var fns []*Func
 		for _, fn := range tp.Fns {
@@ -349,6 +872,21 @@ func Subst(t ValType, set map[string]ValType) (ValType, error) {
 	return t, nil
 }
 
+// checkConstSubst makes sure a const type parameter is only substituted by int constant or another const type
+// parameter, and a normal type parameter never by int constant.
+func checkConstSubst(tv *TypeVar, s ValType) error {
+	if tv.Const {
+		if s.Code() == TpConst || (s.Code() == TpVar && s.(*TypeVar).Const) {
+			return nil
+		}
+		return errors.NewError(errors.TYPE_CONST_PARAM_ILLEGAL, "const type parameter "+tv.String()+" cannot be substituted by "+s.String())
+	}
+	if s.Code() == TpConst || (s.Code() == TpVar && s.(*TypeVar).Const) {
+		return errors.NewError(errors.TYPE_CONST_PARAM_ILLEGAL, "type parameter "+tv.String()+" cannot be substituted by const "+s.String())
+	}
+	return nil
+}
+
 func SubstList(ts []ValType, set map[string]ValType) ([]ValType, error) {
 	res := make([]ValType, len(ts))
 	var err error